@@ -0,0 +1,148 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PrefixUsage is the number of keys under a prefix, the first segment of
+// the key, and the size of their values before and after compression.
+type PrefixUsage struct {
+	Prefix     string `json:"prefix"`
+	Keys       int64  `json:"keys"`
+	Size       int64  `json:"size"`
+	StoredSize int64  `json:"stored_size"`
+}
+
+// usageMeta names the certmagic_meta row recording that certmagic_usage
+// accounts for every key.
+const usageMeta = "usage"
+
+// usageDelta is a change of the keys and value sizes of a prefix.
+type usageDelta struct {
+	keys, size, storedSize int64
+}
+
+// minus returns d without o.
+func (d usageDelta) minus(o usageDelta) usageDelta {
+	return usageDelta{d.keys - o.keys, d.size - o.size, d.storedSize - o.storedSize}
+}
+
+// rowUsage returns what the row of key counts for in the accounting,
+// nothing if it doesn't exist.
+func (s *SqliteStorage) rowUsage(ctx context.Context, tx *sql.Tx, key, keyHash string) (usageDelta, error) {
+	if s.indexKey != nil {
+		return usageDelta{}, nil
+	}
+	d := usageDelta{keys: 1}
+	err := s.queryRow(ctx, tx, "SELECT COALESCE(size, 0), COALESCE(stored_size, 0) FROM certmagic_data WHERE key_hash = ?", []string{key}, keyHash).Scan(&d.size, &d.storedSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return usageDelta{}, nil
+	}
+	return d, err
+}
+
+// addUsage adds d to the accounting of the prefix of key, in the
+// transaction of the write to key that changed it. Hidden keys aren't
+// accounted, their prefixes are only known after decrypting them.
+func (s *SqliteStorage) addUsage(ctx context.Context, tx *sql.Tx, key string, d usageDelta) error {
+	if s.indexKey != nil || d == (usageDelta{}) {
+		return nil
+	}
+	_, err := s.exec(ctx, tx, s.dialect.usageUpsert, []string{key}, keyPrefix(key), d.keys, d.size, d.storedSize)
+	return err
+}
+
+// ensureUsage fills the accounting from the existing keys, unless the
+// meta records that it is complete, and empties it while keys are hidden.
+func (s *SqliteStorage) ensureUsage(ctx context.Context, tx *sql.Tx) error {
+	if s.dialect == dialects[Sqlite] {
+		// The triggers that kept the accounting before writes did would
+		// now count them twice.
+		for _, trigger := range []string{"certmagic_usage_insert", "certmagic_usage_update", "certmagic_usage_delete"} {
+			if _, err := tx.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+trigger); err != nil {
+				return err
+			}
+		}
+	}
+	var complete string
+	err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT value FROM certmagic_meta WHERE name = ?"), usageMeta).Scan(&complete)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if (s.indexKey == nil) == (complete != "") {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM certmagic_usage"); err != nil {
+		return err
+	}
+	if s.indexKey != nil {
+		_, err := tx.ExecContext(ctx, s.dialect.rebind("DELETE FROM certmagic_meta WHERE name = ?"), usageMeta)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(fmt.Sprintf(`INSERT INTO certmagic_usage (prefix, keys, size, stored_size)
+	SELECT %s AS prefix, count(*), COALESCE(SUM(size), 0), COALESCE(SUM(stored_size), 0)
+	FROM certmagic_data GROUP BY prefix`, s.dialect.prefixExpr)))
+	if err != nil {
+		return err
+	}
+	return s.replaceMeta(ctx, tx, usageMeta, "complete")
+}
+
+// Usage returns the keys and value sizes of every prefix, by prefix. It
+// reads the accounting kept up to date by every write, hidden keys need a
+// scan of all keys.
+func (s *SqliteStorage) Usage(ctx context.Context) ([]PrefixUsage, error) {
+	byPrefix := map[string]*PrefixUsage{}
+	err := s.retry(ctx, "usage", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		query := "SELECT prefix, keys, size, stored_size FROM certmagic_usage WHERE keys > 0"
+		if s.indexKey != nil {
+			// Hidden keys are grouped after decrypting them.
+			query = "SELECT key, 1, COALESCE(size, 0), COALESCE(stored_size, 0) FROM certmagic_data"
+		}
+		rows, err := s.query(ctx, s.readDB(), query, nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(byPrefix)
+		for rows.Next() {
+			var u PrefixUsage
+			if err := rows.Scan(&u.Prefix, &u.Keys, &u.Size, &u.StoredSize); err != nil {
+				return err
+			}
+			if s.indexKey != nil {
+				key, err := s.plainKey(u.Prefix)
+				if err != nil {
+					return err
+				}
+				u.Prefix = keyPrefix(key)
+			}
+			total := byPrefix[u.Prefix]
+			if total == nil {
+				total = &PrefixUsage{Prefix: u.Prefix}
+				byPrefix[u.Prefix] = total
+			}
+			total.Keys += u.Keys
+			total.Size += u.Size
+			total.StoredSize += u.StoredSize
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]PrefixUsage, 0, len(byPrefix))
+	for _, u := range byPrefix {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Prefix < usage[j].Prefix })
+	return usage, nil
+}
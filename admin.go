@@ -0,0 +1,624 @@
+package storagesqlite
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves endpoints exposing the state of the sqlite storages
+// opened by this process.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.sqlite_storage",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/storage/sqlite/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/storage/sqlite/locks",
+			Handler: caddy.AdminHandlerFunc(a.handleLocks),
+		},
+		{
+			Pattern: "/storage/sqlite/snapshot",
+			Handler: caddy.AdminHandlerFunc(a.handleSnapshot),
+		},
+		{
+			Pattern: "/storage/sqlite/maintenance/",
+			Handler: caddy.AdminHandlerFunc(a.handleMaintenance),
+		},
+		{
+			Pattern: "/storage/sqlite/jobs",
+			Handler: caddy.AdminHandlerFunc(a.handleJobs),
+		},
+		{
+			Pattern: "/storage/sqlite/jobs/",
+			Handler: caddy.AdminHandlerFunc(a.handleJobs),
+		},
+		{
+			Pattern: "/storage/sqlite/domain_policies",
+			Handler: caddy.AdminHandlerFunc(a.handleDomainPolicies),
+		},
+		{
+			Pattern: "/storage/sqlite/domain_policies/ask",
+			Handler: caddy.AdminHandlerFunc(a.handleAsk),
+		},
+		{
+			Pattern: changesPath,
+			Handler: caddy.AdminHandlerFunc(a.handleChanges),
+		},
+	}
+}
+
+// handleStats returns Stats for every open storage as JSON.
+func (a *adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	stats := []Stats{}
+	for _, s := range registeredStorages() {
+		if err := s.authorize(r, ScopeRead); err != nil {
+			return err
+		}
+		st, err := s.Stats(r.Context())
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("collecting stats for %s: %v", s.Dsn, err),
+			}
+		}
+		stats = append(stats, st)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(stats)
+}
+
+// handleLocks returns the held locks of every open storage keyed by DSN.
+func (a *adminAPI) handleLocks(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	locks := map[string][]LockInfo{}
+	for _, s := range registeredStorages() {
+		if err := s.authorize(r, ScopeRead); err != nil {
+			return err
+		}
+		l, err := s.Locks(r.Context())
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("listing locks of %s: %v", s.Dsn, err),
+			}
+		}
+		locks[s.Dsn] = l
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(locks)
+}
+
+// handleJobs lists the background jobs of every open storage keyed by DSN
+// on GET /storage/sqlite/jobs, and on POST /storage/sqlite/jobs/<name>
+// runs the job right away on every storage that has it, or only on the one
+// given by the dsn query parameter, returning its status after the run.
+func (a *adminAPI) handleJobs(w http.ResponseWriter, r *http.Request) error {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/storage/sqlite/jobs"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		jobs := map[string][]JobStatus{}
+		for _, s := range registeredStorages() {
+			if err := s.authorize(r, ScopeRead); err != nil {
+				return err
+			}
+			jobs[s.Dsn] = s.jobStatuses()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(jobs)
+	case r.Method == http.MethodPost && name != "":
+	case r.Method == http.MethodPost:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing job name, expected POST /storage/sqlite/jobs/<name>"),
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	dsn := r.URL.Query().Get("dsn")
+	results := map[string]JobStatus{}
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		j := s.background.jobs[name]
+		if j == nil {
+			continue
+		}
+		if err := s.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		err := s.runJob(r.Context(), j)
+		if errors.Is(err, errJobRunning) || errors.Is(err, errJobLeased) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusConflict,
+				Err:        fmt.Errorf("%s of %s: %v", name, s.Dsn, err),
+			}
+		}
+		// Failures are reported in the status.
+		results[s.Dsn] = j.Status()
+	}
+	if len(results) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no open storage with job %s", name),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleDomainPolicies manages the on-demand TLS domain policies. GET
+// lists them for every open storage keyed by DSN. PUT with a DomainPolicy
+// as body sets it, and DELETE removes the pattern given by the pattern
+// query parameter, on every open storage or only on the one given by the
+// dsn query parameter.
+func (a *adminAPI) handleDomainPolicies(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodGet {
+		policies := map[string][]DomainPolicy{}
+		for _, s := range registeredStorages() {
+			if err := s.authorize(r, ScopeRead); err != nil {
+				return err
+			}
+			p, err := s.DomainPolicies(r.Context())
+			if err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusInternalServerError,
+					Err:        fmt.Errorf("listing domain policies of %s: %v", s.Dsn, err),
+				}
+			}
+			policies[s.Dsn] = p
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(policies)
+	}
+
+	var update func(*SqliteStorage) error
+	switch r.Method {
+	case http.MethodPut:
+		var p DomainPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding domain policy: %v", err),
+			}
+		}
+		if _, err := normalizePattern(p.Pattern); err != nil || (p.Action != PolicyAllow && p.Action != PolicyDeny) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid domain policy %q %q", p.Pattern, p.Action),
+			}
+		}
+		update = func(s *SqliteStorage) error { return s.SetDomainPolicy(r.Context(), p.Pattern, p.Action) }
+	case http.MethodDelete:
+		pattern := r.URL.Query().Get("pattern")
+		if _, err := normalizePattern(pattern); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		update = func(s *SqliteStorage) error {
+			if err := s.DeleteDomainPolicy(r.Context(), pattern); !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	dsn := r.URL.Query().Get("dsn")
+	updated := 0
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		if err := s.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		if err := update(s); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("updating domain policies of %s: %v", s.Dsn, err),
+			}
+		}
+		updated++
+	}
+	if updated == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no open storage with dsn %s", dsn),
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleAsk answers the on-demand TLS ask requests of Caddy, configured as
+//
+//	on_demand_tls {
+//		ask http://localhost:2019/storage/sqlite/domain_policies/ask
+//	}
+//
+// with 200 if the domain query parameter is allowed by the policies of an
+// open storage, or of the one given by the dsn query parameter, and 403
+// otherwise. A storage that denies the domain, or fails to answer, wins
+// over those allowing it. It needs no credentials, as Caddy sends none.
+func (a *adminAPI) handleAsk(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	domain := r.URL.Query().Get("domain")
+	dsn := r.URL.Query().Get("dsn")
+	allowed := false
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		allows, denies, err := s.domainPolicies(r.Context(), domain)
+		if err != nil {
+			caddy.Log().Named(logStorage).Warn(fmt.Sprintf("asking %s about %q: %v", s.Dsn, domain, err))
+		}
+		if err != nil || denies {
+			return caddy.APIError{
+				HTTPStatus: http.StatusForbidden,
+				Err:        fmt.Errorf("domain %q is not allowed by %s", domain, redactDSN(s.Dsn)),
+			}
+		}
+		allowed = allowed || allows
+	}
+	if !allowed {
+		return caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        fmt.Errorf("domain %q is not allowed", domain),
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleSnapshot immediately writes a snapshot of every open storage with
+// a backup directory, or only of the one given by the dsn query parameter.
+func (a *adminAPI) handleSnapshot(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	dsn := r.URL.Query().Get("dsn")
+	snapshots := map[string]string{}
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		if dsn == "" && (s.Backups == nil || s.Backups.Dir == "") {
+			continue
+		}
+		if err := s.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		path, err := s.Backup(r.Context())
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("snapshot of %s: %v", s.Dsn, err),
+			}
+		}
+		snapshots[s.Dsn] = path
+	}
+	if dsn != "" && len(snapshots) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no open storage with dsn %s", dsn),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(snapshots)
+}
+
+// handleMaintenance runs the maintenance operation named by the last path
+// segment (vacuum, incremental_vacuum, checkpoint, integrity_check, rebuild,
+// analyze or lock_gc) on every open storage, or only on the one given by the
+// dsn query parameter.
+func (a *adminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	op := strings.TrimPrefix(r.URL.Path, "/storage/sqlite/maintenance/")
+	switch op {
+	case MaintenanceVacuum, MaintenanceIncrementalVacuum, MaintenanceCheckpoint, MaintenanceAnalyze, MaintenanceLockGC, MaintenanceIntegrityCheck, MaintenanceRebuild:
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("unknown maintenance operation: %s", op),
+		}
+	}
+	dsn := r.URL.Query().Get("dsn")
+	results := map[string]MaintenanceResult{}
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		if err := s.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		result, err := s.Maintain(r.Context(), op)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("maintenance of %s: %v", s.Dsn, err),
+			}
+		}
+		results[s.Dsn] = result
+	}
+	if dsn != "" && len(results) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no open storage with dsn %s", dsn),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleChanges returns a ChangeSet of the change feed of the storage given
+// by the dsn query parameter, which may be left out if only one is open.
+// The since and limit parameters are passed to Changes; limit defaults to
+// 500. With stream=true it writes the changes as JSON lines instead, one
+// batch of limit after the other until it is caught up. Responses are gzip
+// compressed if the client accepts it. A ChangeSet posted to it is applied
+// to the storage instead, which is how sync peers push their changes. As
+// the feed holds private keys, it is refused for storages without auth.
+func (a *adminAPI) handleChanges(w http.ResponseWriter, r *http.Request) error {
+	dsn := r.URL.Query().Get("dsn")
+	var storage *SqliteStorage
+	for _, s := range registeredStorages() {
+		if dsn != "" && s.Dsn != dsn {
+			continue
+		}
+		if storage != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("more than one open storage, dsn is required"),
+			}
+		}
+		storage = s
+	}
+	if storage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no open storage with dsn %s", dsn),
+		}
+	}
+	if storage.Auth == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        fmt.Errorf("the change feed of %s requires auth to be configured", storage.Dsn),
+		}
+	}
+	return serveChanges(w, r, storage)
+}
+
+// serveChanges serves the change feed of storage for handleChanges and the
+// replication listener.
+func serveChanges(w http.ResponseWriter, r *http.Request, storage *SqliteStorage) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		// Pushed changes overwrite keys, so only authenticated peers may
+		// push, whatever else guards the endpoint.
+		if storage.Auth == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusForbidden,
+				Err:        fmt.Errorf("applying changes to %s requires auth to be configured", storage.Dsn),
+			}
+		}
+		if err := storage.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		return applyChanges(w, r, storage)
+	}
+	if err := storage.authorize(r, ScopeRead); err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	var since int64
+	limit := 500
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid since: %s", v),
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid limit: %s", v),
+			}
+		}
+	}
+
+	set, err := storage.Changes(r.Context(), since, limit)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("changes of %s: %v", storage.Dsn, err),
+		}
+	}
+
+	stream := q.Get("stream") == "true"
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	out := &flushWriter{w: w}
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		out.gz = gzip.NewWriter(w)
+	}
+	defer out.Close()
+	if !stream {
+		return json.NewEncoder(out).Encode(set)
+	}
+
+	// The status is sent with the first batch, so later failures can only
+	// end the stream early. Readers resume after the last seq they got.
+	enc := json.NewEncoder(out)
+	for set.Last != since {
+		for _, c := range set.Changes {
+			if err := enc.Encode(c); err != nil {
+				return nil
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return nil
+		}
+		since = set.Last
+		if set, err = storage.Changes(r.Context(), since, limit); err != nil {
+			caddy.Log().Named(logReplication).Error(fmt.Sprintf("streaming changes of %s: %v", storage.Dsn, err))
+			return nil
+		}
+	}
+	return nil
+}
+
+// acceptsGzip reports whether the client accepts a gzip compressed
+// response.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if name == "gzip" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flushWriter writes a response, optionally gzip compressed, and sends what
+// was written so far on Flush.
+type flushWriter struct {
+	w  http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	if f.gz != nil {
+		return f.gz.Write(p)
+	}
+	return f.w.Write(p)
+}
+
+func (f *flushWriter) Flush() error {
+	if f.gz != nil {
+		if err := f.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(f.w).Flush()
+}
+
+func (f *flushWriter) Close() error {
+	if f.gz != nil {
+		return f.gz.Close()
+	}
+	return nil
+}
+
+// applyChanges applies a posted ChangeSet to storage and returns the
+// number of changes per result.
+func applyChanges(w http.ResponseWriter, r *http.Request, storage *SqliteStorage) error {
+	var set ChangeSet
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding changes: %v", err),
+		}
+	}
+	results := map[string]int{}
+	for _, c := range set.Changes {
+		result, err := storage.applyChange(r.Context(), r.RemoteAddr, c)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("applying %s to %s: %v", c.Key, storage.Dsn, err),
+			}
+		}
+		sqliteMetrics.replicatedChanges.WithLabelValues(result).Inc()
+		results[result]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,122 @@
+package storagesqlite
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("sqlite_storage", parseAppOption)
+}
+
+// DatabaseProvider offers an open storage and its database to other
+// modules, which get it from the sqlite_storage app:
+//
+//	app, err := ctx.App("sqlite_storage")
+//	db := app.(storagesqlite.DatabaseProvider).DB()
+type DatabaseProvider interface {
+	// Storage returns the open storage, to keep data as keys and values.
+	Storage() *SqliteStorage
+	// DB returns the handle writes run on, to keep data in tables of
+	// their own. Its queries bypass the storage's write queue and retry
+	// policy. The storage closes the handle and opens a new one when it
+	// reopens the database, after failed health checks, a vault rotation
+	// or a rebuild, so call DB for every use instead of keeping the
+	// handle.
+	DB() *sql.DB
+	// Bucket returns a namespace of keys and values kept apart from the
+	// certificates.
+	Bucket(name string) KV
+}
+
+// App is the sqlite_storage Caddy app. It opens one database when the
+// config is loaded and offers it to other modules as a DatabaseProvider,
+// so that handlers and plugins persist their own data in the same file
+// instead of each opening sqlite separately. The database is closed when
+// the config is unloaded.
+type App struct {
+	// The database to open, configured like caddy.storage.sqlite.
+	Config *SqliteStorage `json:"storage,omitempty"`
+}
+
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sqlite_storage",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision opens the database, so that modules provisioned after the app
+// can use it right away.
+func (a *App) Provision(ctx caddy.Context) error {
+	if a.Config == nil {
+		return errors.New("sqlite_storage: storage is required")
+	}
+	if err := a.Config.Provision(ctx); err != nil {
+		return err
+	}
+	if err := a.Config.Validate(); err != nil {
+		return err
+	}
+	_, err := a.Config.CertMagicStorage()
+	return err
+}
+
+func (a *App) Start() error { return nil }
+
+func (a *App) Stop() error { return nil }
+
+// Cleanup closes the database.
+func (a *App) Cleanup() error {
+	if a.Config == nil {
+		return nil
+	}
+	return a.Config.Cleanup()
+}
+
+// Storage implements DatabaseProvider.
+func (a *App) Storage() *SqliteStorage {
+	return a.Config.storage
+}
+
+// DB implements DatabaseProvider.
+func (a *App) DB() *sql.DB {
+	return a.Config.storage.writeDB()
+}
+
+// Bucket implements DatabaseProvider.
+func (a *App) Bucket(name string) KV {
+	return a.Config.storage.Bucket(name)
+}
+
+// parseAppOption parses the sqlite_storage global option, whose block
+// takes the same subdirectives as the sqlite storage:
+//
+//	{
+//		sqlite_storage {
+//			dsn /var/lib/caddy/data.sqlite
+//		}
+//	}
+func parseAppOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	config := new(SqliteStorage)
+	if err := config.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "sqlite_storage",
+		Value: caddyconfig.JSON(App{Config: config}, nil),
+	}, nil
+}
+
+var (
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
+	_ DatabaseProvider   = (*App)(nil)
+)
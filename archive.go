@@ -0,0 +1,137 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// jobArchive is the name of the job rolling the database into an archive.
+const jobArchive = "archive"
+
+// archiveTimeFormat is the time in the names of archives, in UTC.
+const archiveTimeFormat = "20060102T150405Z"
+
+// ArchiveConfig rolls the database periodically: the live database is
+// copied to a file named after the time, and kept serving, so that its
+// past states can be audited. Unlike backups, archives are pruned by age.
+// Archives are only readable by the current user and, if backups have an
+// encryption key, encrypted with it like backups.
+type ArchiveConfig struct {
+	// Directory the archives are written to. Defaults to the directory
+	// of the database.
+	Dir string `json:"dir,omitempty"`
+	// Time between two archives. Defaults to 24h.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Archives older than this are removed. Zero keeps them regardless of
+	// their age.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+	// Number of archives to keep, older ones are removed. Zero keeps all.
+	Keep int `json:"keep,omitempty"`
+}
+
+func (c *ArchiveConfig) setDefaults(dsn string) {
+	if c.Dir == "" {
+		c.Dir = filepath.Dir(dbFilePath(dsn))
+	}
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(24 * time.Hour)
+	}
+}
+
+// archivePattern returns the glob matching the archives of the database,
+// <name>.archive-<time>.sqlite. Encrypted archives add .enc to the name.
+func (s *SqliteStorage) archivePattern() string {
+	base := strings.TrimSuffix(filepath.Base(dbFilePath(s.Dsn)), filepath.Ext(dbFilePath(s.Dsn)))
+	return filepath.Join(s.Archive.Dir, base+".archive-*.sqlite")
+}
+
+// Roll copies the live database to a new archive, removes the archives
+// past max_age and keep, and returns the path of the new one. The archive
+// is encrypted with the backup encryption key, if one is set.
+func (s *SqliteStorage) Roll(ctx context.Context) (string, error) {
+	if s.Archive == nil {
+		return "", fmt.Errorf("no archive configured")
+	}
+	if s.dialect != dialects[Sqlite] {
+		return "", fmt.Errorf("archives are not supported for %s", s.dialect.name)
+	}
+	var aead cipher.AEAD
+	if s.Backups != nil {
+		var err error
+		if aead, err = s.Backups.aead(); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(s.Archive.Dir, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	path := strings.Replace(s.archivePattern(), "*", now.UTC().Format(archiveTimeFormat), 1)
+
+	// Like for backups, the plaintext of encrypted archives is staged
+	// next to the database.
+	staging := s.Archive.Dir
+	if aead != nil {
+		staging = filepath.Dir(dbFilePath(s.Dsn))
+	}
+	snapshot, cleanup, err := s.stageSnapshot(ctx, staging)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if path, err = publishSnapshot(aead, snapshot, path); err != nil {
+		return "", err
+	}
+	return path, s.pruneArchives(now)
+}
+
+// pruneArchives removes the archives older than max_age and all but the
+// newest keep ones.
+func (s *SqliteStorage) pruneArchives(now time.Time) error {
+	archives, err := filepath.Glob(s.archivePattern())
+	if err != nil {
+		return err
+	}
+	encrypted, err := filepath.Glob(s.archivePattern() + ".enc")
+	if err != nil {
+		return err
+	}
+	archives = append(archives, encrypted...)
+	// The names sort by time.
+	sort.Strings(archives)
+	prefix, suffix, _ := strings.Cut(filepath.Base(s.archivePattern()), "*")
+	for i, archive := range archives {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archive), prefix), ".enc"), suffix)
+		created, err := time.Parse(archiveTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		expired := s.Archive.MaxAge > 0 && now.Sub(created) > time.Duration(s.Archive.MaxAge)
+		excess := s.Archive.Keep > 0 && i < len(archives)-s.Archive.Keep
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveJob rolls the database, it runs every archive interval.
+func (s *SqliteStorage) archiveJob(ctx context.Context) (int64, error) {
+	path, err := s.Roll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	caddy.Log().Named(logMaintenance).Info(fmt.Sprintf("database archived to %s", path))
+	return 1, nil
+}
@@ -0,0 +1,260 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Kinds of AuthToken.
+const (
+	// The secret is sent as is in an "Authorization: Bearer" header.
+	AuthBearer = "bearer"
+	// The secret signs the request, see signRequest. Each signature is
+	// accepted once.
+	AuthHMAC = "hmac"
+)
+
+// Scopes of an AuthToken. The admin scope includes the read scope.
+const (
+	// Read the stats, locks and change feed, which holds private keys.
+	ScopeRead = "read"
+	// Also take snapshots, run maintenance and apply pushed changes.
+	ScopeAdmin = "admin"
+)
+
+// hmacScheme is the Authorization scheme of HMAC signed requests.
+const hmacScheme = "HMAC-SHA256"
+
+// hmacMaxSkew is how far the timestamp of a signed request may be off.
+const hmacMaxSkew = 5 * time.Minute
+
+// hmacMaxBody is the largest body a signed request may have, since it is
+// read into memory to check the signature.
+var hmacMaxBody int64 = 64 << 20
+
+// errBodyTooLarge is returned by authenticate for a signed request whose
+// body exceeds hmacMaxBody, or the limit of an http.MaxBytesReader.
+var errBodyTooLarge = errors.New("signed body too large")
+
+// AuthConfig requires the admin endpoints and the replication listener to
+// be called with one of its tokens for the storage. Without it the
+// endpoints are open to whoever can reach them, except the change feed of
+// the admin API, which is refused.
+type AuthConfig struct {
+	Tokens []AuthToken `json:"tokens,omitempty"`
+
+	// Nonces of the signed requests accepted within hmacMaxSkew, by
+	// key and nonce, so that a captured request can't be replayed.
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// AuthToken is a credential accepted by AuthConfig, or sent to peers as
+// peer_auth.
+type AuthToken struct {
+	// bearer (the default) or hmac.
+	Type string `json:"type,omitempty"`
+	// Names the token in logs, and the key of HMAC signatures.
+	ID string `json:"id,omitempty"`
+	// The token, or file:<path> or env:<name> to read it from a file or
+	// environment variable.
+	Secret string `json:"secret,omitempty"`
+	// read (the default) or admin. Not used by peer_auth.
+	Scope string `json:"scope,omitempty"`
+}
+
+func (t *AuthToken) setDefaults() {
+	if t.Type == "" {
+		t.Type = AuthBearer
+	}
+	if t.Scope == "" {
+		t.Scope = ScopeRead
+	}
+}
+
+func (t AuthToken) validate() error {
+	if t.Type != AuthBearer && t.Type != AuthHMAC {
+		return fmt.Errorf("unknown type %q", t.Type)
+	}
+	if t.Scope != ScopeRead && t.Scope != ScopeAdmin {
+		return fmt.Errorf("unknown scope %q", t.Scope)
+	}
+	if t.ID == "" || t.Secret == "" {
+		return errors.New("id and secret are required")
+	}
+	return nil
+}
+
+// validate checks the tokens, whose ids must be unique.
+func (c *AuthConfig) validate() error {
+	ids := map[string]bool{}
+	for _, t := range c.Tokens {
+		t.setDefaults()
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("token %s: %v", t.ID, err)
+		}
+		if ids[t.ID] {
+			return fmt.Errorf("duplicate token id %s", t.ID)
+		}
+		ids[t.ID] = true
+	}
+	return nil
+}
+
+// authenticate returns the token r was sent or signed with.
+func (c *AuthConfig) authenticate(r *http.Request) (AuthToken, error) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch scheme {
+	case "":
+		return AuthToken{}, errors.New("missing credentials")
+	case "Bearer":
+		for _, t := range c.Tokens {
+			if t.Type == AuthBearer && subtle.ConstantTimeCompare([]byte(t.Secret), []byte(credentials)) == 1 {
+				return t, nil
+			}
+		}
+		return AuthToken{}, errors.New("unknown token")
+	case hmacScheme:
+		params := map[string]string{}
+		for _, param := range strings.Split(credentials, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			params[name] = value
+		}
+		ts, err := strconv.ParseInt(params["ts"], 10, 64)
+		if err != nil {
+			return AuthToken{}, errors.New("invalid signature timestamp")
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return AuthToken{}, errors.New("signature expired")
+		}
+		sig, err := hex.DecodeString(params["sig"])
+		if err != nil {
+			return AuthToken{}, errors.New("invalid signature")
+		}
+		nonce := params["nonce"]
+		if nonce == "" {
+			return AuthToken{}, errors.New("missing signature nonce")
+		}
+		for _, t := range c.Tokens {
+			if t.Type != AuthHMAC || t.ID != params["key"] {
+				continue
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, hmacMaxBody+1))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return AuthToken{}, errBodyTooLarge
+			}
+			if err != nil {
+				return AuthToken{}, err
+			}
+			if int64(len(body)) > hmacMaxBody {
+				return AuthToken{}, errBodyTooLarge
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if !hmac.Equal(sig, signature(t.Secret, r.Method, r.URL.RequestURI(), ts, nonce, body)) {
+				return AuthToken{}, errors.New("invalid signature")
+			}
+			if !c.useNonce(t.ID+" "+nonce, time.Unix(ts, 0).Add(hmacMaxSkew)) {
+				return AuthToken{}, errors.New("replayed signature")
+			}
+			return t, nil
+		}
+		return AuthToken{}, errors.New("unknown key")
+	}
+	return AuthToken{}, fmt.Errorf("unsupported authorization scheme %s", scheme)
+}
+
+// useNonce records nonce until expires, when its timestamp is too old to
+// be accepted anyway, and reports whether it wasn't used before.
+func (c *AuthConfig) useNonce(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.nonces == nil {
+		c.nonces = map[string]time.Time{}
+	}
+	if now.Sub(c.pruned) > time.Minute {
+		for n, e := range c.nonces {
+			if now.After(e) {
+				delete(c.nonces, n)
+			}
+		}
+		c.pruned = now
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expires
+	return true
+}
+
+// signature is the HMAC-SHA256 with secret of the method, URI, timestamp,
+// nonce and body hash of a request, one per line.
+func signature(secret, method, uri string, ts int64, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s", method, uri, ts, nonce, hex.EncodeToString(bodyHash[:]))
+	return mac.Sum(nil)
+}
+
+// authorize checks that r may act on the storage with scope, and returns
+// the caddy.APIError to fail with if not.
+func (s *SqliteStorage) authorize(r *http.Request, scope string) error {
+	if s.Auth == nil {
+		return nil
+	}
+	t, err := s.Auth.authenticate(r)
+	if err != nil {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("refused request %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err))
+		status := http.StatusUnauthorized
+		if errors.Is(err, errBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		return caddy.APIError{
+			HTTPStatus: status,
+			Err:        fmt.Errorf("authenticating for %s: %v", s.Dsn, err),
+		}
+	}
+	if scope == ScopeAdmin && t.Scope != ScopeAdmin {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("refused request %s %s from %s: token %s lacks the %s scope", r.Method, r.URL.Path, r.RemoteAddr, t.ID, scope))
+		return caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        fmt.Errorf("token %s lacks the %s scope for %s", t.ID, scope, s.Dsn),
+		}
+	}
+	return nil
+}
+
+// signRequest adds the peer_auth credential to a request to a peer, whose
+// body is body.
+func (s *SqliteStorage) signRequest(req *http.Request, body []byte) {
+	t := s.PeerAuth
+	if t == nil {
+		return
+	}
+	if t.Type == AuthHMAC {
+		ts := time.Now().Unix()
+		nonce := make([]byte, 16)
+		rand.Read(nonce)
+		n := hex.EncodeToString(nonce)
+		sig := signature(t.Secret, req.Method, req.URL.RequestURI(), ts, n, body)
+		req.Header.Set("Authorization", fmt.Sprintf("%s key=%s, ts=%d, nonce=%s, sig=%s", hmacScheme, t.ID, ts, n, hex.EncodeToString(sig)))
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+t.Secret)
+}
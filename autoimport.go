@@ -0,0 +1,109 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// metaAutoImport names the certmagic_meta row recording that the
+// automatic import ran.
+const metaAutoImport = "auto_import"
+
+// defaultStoragePath returns the root of Caddy's default file system
+// storage, the source of auto_import.
+var defaultStoragePath = caddy.AppDataDir
+
+// autoImport copies Caddy's default file system storage into an empty
+// database once. Completion is recorded in certmagic_meta so the import
+// never repeats, not even after the database was emptied again. A missing
+// file system storage is not recorded, it may still appear later.
+func (s *SqliteStorage) autoImport(ctx context.Context) error {
+	logger := caddy.Log().Named(logMaintenance)
+
+	if err := s.Lock(ctx, metaAutoImport); err != nil {
+		return err
+	}
+	defer s.Unlock(ctx, metaAutoImport)
+
+	done, err := s.meta(ctx, metaAutoImport)
+	if err != nil {
+		return err
+	}
+	if done != "" {
+		return nil
+	}
+
+	keys, err := s.keysWithPrefix(ctx, "")
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return s.setMeta(ctx, metaAutoImport, "skipped: database not empty")
+	}
+
+	dir := defaultStoragePath()
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		logger.Debug(fmt.Sprintf("auto_import: no file system storage at %s", dir))
+		return nil
+	}
+
+	n, err := s.importFrom(ctx, &certmagic.FileStorage{Path: dir})
+	if err != nil {
+		return fmt.Errorf("auto_import from %s: %v", dir, err)
+	}
+	logger.Info(fmt.Sprintf("auto_import: imported %d keys from %s", n, dir))
+	return s.setMeta(ctx, metaAutoImport, fmt.Sprintf("imported %d keys from %s at %s", n, dir, time.Now().UTC().Format(time.RFC3339)))
+}
+
+// meta returns the value of the certmagic_meta row name, or an empty
+// string if there is none.
+func (s *SqliteStorage) meta(ctx context.Context, name string) (string, error) {
+	var value sql.NullString
+	err := s.retry(ctx, "meta", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		return s.readDB().QueryRowContext(ctx, s.dialect.rebind("SELECT value FROM certmagic_meta WHERE name = ?"), name).Scan(&value)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value.String, err
+}
+
+// setMeta inserts or replaces the certmagic_meta row name.
+func (s *SqliteStorage) setMeta(ctx context.Context, name, value string) error {
+	return s.retryWrite(ctx, "meta", s.writeMeta(name, value))
+}
+
+// writeMeta returns the write of setMeta.
+func (s *SqliteStorage) writeMeta(name, value string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := s.replaceMeta(ctx, tx, name, value); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+}
+
+// replaceMeta replaces the certmagic_meta row name within tx.
+func (s *SqliteStorage) replaceMeta(ctx context.Context, tx *sql.Tx, name, value string) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("DELETE FROM certmagic_meta WHERE name = ?"), name); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO certmagic_meta (name, value) VALUES (?, ?)"), name, value)
+	return err
+}
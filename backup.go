@@ -0,0 +1,257 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// BackupConfig configures periodic snapshots of the database.
+type BackupConfig struct {
+	// Directory the snapshots are written to.
+	Dir string `json:"dir,omitempty"`
+	// Time between two snapshots. Zero disables scheduled snapshots.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Number of snapshots to keep, older ones are removed. Zero keeps all.
+	Keep int `json:"keep,omitempty"`
+	// Base64 encoded AES key (16, 24 or 32 bytes), or a file: or env:
+	// reference to one. When set, snapshots are encrypted with AES-GCM
+	// before they are written to Dir.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	// Write a snapshot when the process receives SIGUSR1 (Unix only).
+	SnapshotOnSignal bool `json:"snapshot_on_signal,omitempty"`
+}
+
+// encryptedMagic starts every encrypted backup archive.
+var encryptedMagic = []byte("CSQLENC1")
+
+func (b *BackupConfig) aead() (cipher.AEAD, error) {
+	if b.EncryptionKey == "" {
+		return nil, nil
+	}
+	return newAEAD(b.EncryptionKey)
+}
+
+func newAEAD(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding encryption key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptArchive seals plaintext into the encrypted archive format: the
+// magic, the nonce and the AES-GCM ciphertext.
+func encryptArchive(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	return seal(aead, plaintext, encryptedMagic)
+}
+
+// decryptArchive reverses encryptArchive.
+func decryptArchive(aead cipher.AEAD, archive []byte) ([]byte, error) {
+	return open(aead, archive, encryptedMagic)
+}
+
+// seal encrypts plaintext in the encrypted archive format, authenticating
+// ad along with it.
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, encryptedMagic...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, archive, ad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(archive, encryptedMagic) || len(archive) < len(encryptedMagic)+aead.NonceSize() {
+		return nil, errors.New("not in the encrypted archive format")
+	}
+	archive = archive[len(encryptedMagic):]
+	nonce, ciphertext := archive[:aead.NonceSize()], archive[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// backupTimeFormat is the time in the names of backups, in UTC. It has
+// nanoseconds so that backups taken in the same second don't replace each
+// other, and sorts by time.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// Backup writes a snapshot of the database into the backup directory and
+// returns its path.
+func (s *SqliteStorage) Backup(ctx context.Context) (string, error) {
+	if s.Backups == nil || s.Backups.Dir == "" {
+		return "", errors.New("no backup directory configured")
+	}
+	if s.dialect != dialects[Sqlite] {
+		return "", fmt.Errorf("backups are not supported for %s", s.dialect.name)
+	}
+	aead, err := s.Backups.aead()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.Backups.Dir, 0o700); err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(dbFilePath(s.Dsn)), filepath.Ext(dbFilePath(s.Dsn)))
+	name := fmt.Sprintf("%s-%s.sqlite", base, time.Now().UTC().Format(backupTimeFormat))
+	path := filepath.Join(s.Backups.Dir, name)
+
+	// The plaintext of encrypted backups never reaches the backup
+	// directory, it is staged next to the database it was copied from.
+	staging := s.Backups.Dir
+	if aead != nil {
+		staging = filepath.Dir(dbFilePath(s.Dsn))
+	}
+	snapshot, cleanup, err := s.stageSnapshot(ctx, staging)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if path, err = publishSnapshot(aead, snapshot, path); err != nil {
+		return "", err
+	}
+	s.background.lastBackup.Store(time.Now().UnixNano())
+
+	if err := s.pruneBackups(base); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// publishSnapshot moves the staged snapshot to path or, with aead, writes
+// it encrypted to path.enc, and returns the path written.
+func publishSnapshot(aead cipher.AEAD, snapshot, path string) (string, error) {
+	if aead != nil {
+		plaintext, err := os.ReadFile(snapshot)
+		if err != nil {
+			return "", err
+		}
+		archive, err := encryptArchive(aead, plaintext)
+		if err != nil {
+			return "", err
+		}
+		path += ".enc"
+		tmp := path + ".tmp"
+		defer os.Remove(tmp)
+		if err := os.WriteFile(tmp, archive, 0o600); err != nil {
+			return "", err
+		}
+		snapshot = tmp
+	}
+	if err := os.Rename(snapshot, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// stageSnapshot writes a snapshot of the database into a new directory
+// under dir that only the current user can access, and returns the path
+// of the snapshot and a function removing the directory. The snapshot
+// holds private keys, sqlite would create it readable by everyone.
+func (s *SqliteStorage) stageSnapshot(ctx context.Context, dir string) (string, func(), error) {
+	staging, err := os.MkdirTemp(dir, ".snapshot-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(staging) }
+	path := filepath.Join(staging, "snapshot.sqlite")
+	if err := s.writeSnapshot(ctx, path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// writeSnapshot writes a consistent copy of the database to path and
+// checks it.
+func (s *SqliteStorage) writeSnapshot(ctx context.Context, path string) error {
+	// VACUUM INTO reads inside a single transaction, so the snapshot is
+	// consistent even while other connections keep writing.
+	caddy.Log().Named(logMaintenance).Debug(fmt.Sprintf("VACUUM INTO %s", path))
+	if _, err := s.writeDB().ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("writing snapshot: %v", err)
+	}
+	return verifySnapshot(ctx, path)
+}
+
+// verifySnapshot runs an integrity check on the snapshot at path.
+func verifySnapshot(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("checking snapshot: %v", err)
+	}
+	problems, err := integrityProblems(rows)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("snapshot failed integrity check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// pruneBackups removes all but the newest Keep snapshots.
+func (s *SqliteStorage) pruneBackups(base string) error {
+	if s.Backups.Keep <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(s.Backups.Dir, base+"-*.sqlite*"))
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > s.Backups.Keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backupJob writes a snapshot, it runs every backup interval and at the
+// times of the backup schedule.
+func (s *SqliteStorage) backupJob(ctx context.Context) (int64, error) {
+	path, err := s.Backup(ctx)
+	if err != nil {
+		return 0, err
+	}
+	caddy.Log().Named(logMaintenance).Info(fmt.Sprintf("backup written to %s", path))
+	return 1, nil
+}
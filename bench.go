@@ -0,0 +1,109 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// benchPrefix holds the keys written by benchmarks.
+const benchPrefix = "bench/"
+
+// benchTime is how long the bench command runs each benchmark.
+const benchTime = time.Second
+
+// benchmark is one storage benchmark, shared by the Go benchmarks and the
+// bench command. op runs iteration i against a store prefilled with keys
+// keys.
+type benchmark struct {
+	name string
+	op   func(ctx context.Context, s *SqliteStorage, keys, i int) error
+}
+
+var benchmarks = []benchmark{
+	{"store", func(ctx context.Context, s *SqliteStorage, keys, i int) error {
+		return s.Store(ctx, benchKey(i%keys), benchStoreValue)
+	}},
+	{"load", func(ctx context.Context, s *SqliteStorage, keys, i int) error {
+		_, err := s.Load(ctx, benchKey(i%keys))
+		return err
+	}},
+	{"list", func(ctx context.Context, s *SqliteStorage, keys, i int) error {
+		_, err := s.List(ctx, benchPrefix, false)
+		return err
+	}},
+	{"lock", func(ctx context.Context, s *SqliteStorage, keys, i int) error {
+		key := benchKey(i % keys)
+		if err := s.Lock(ctx, key); err != nil {
+			return err
+		}
+		return s.Unlock(ctx, key)
+	}},
+}
+
+// benchResult is the outcome of runBenchmark.
+type benchResult struct {
+	N       int
+	Elapsed time.Duration
+}
+
+// PerOp returns the average time of one iteration.
+func (r benchResult) PerOp() time.Duration {
+	if r.N == 0 {
+		return 0
+	}
+	return r.Elapsed / time.Duration(r.N)
+}
+
+// runBenchmark runs bm until a round of iterations takes at least d,
+// growing the rounds by the time the previous one took.
+func (s *SqliteStorage) runBenchmark(ctx context.Context, bm benchmark, keys int, d time.Duration) (benchResult, error) {
+	n := 1
+	for {
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := bm.op(ctx, s, keys, i); err != nil {
+				return benchResult{}, fmt.Errorf("%s benchmark: %v", bm.name, err)
+			}
+		}
+		elapsed := time.Since(start)
+		if elapsed >= d || n >= 1e9 {
+			return benchResult{N: n, Elapsed: elapsed}, nil
+		}
+		// Aim 20% past d, but grow at most 100x per round.
+		next := 100 * n
+		if elapsed > 0 {
+			next = int(int64(n) * int64(d) / int64(elapsed) * 6 / 5)
+		}
+		n = max(n+1, min(next, 100*n))
+	}
+}
+
+func benchKey(i int) string {
+	return benchPrefix + strconv.Itoa(i)
+}
+
+// benchStoreValue is written by the store benchmark, allocated once so
+// that it isn't measured.
+var benchStoreValue = benchValue()
+
+// benchValue is about the size of a PEM encoded certificate chain.
+func benchValue() []byte {
+	value := make([]byte, 4096)
+	for i := range value {
+		value[i] = byte('A' + i%26)
+	}
+	return value
+}
+
+// prefillBench writes keys benchmark keys.
+func (s *SqliteStorage) prefillBench(ctx context.Context, keys int) error {
+	value := benchValue()
+	for i := 0; i < keys; i++ {
+		if err := s.Store(ctx, benchKey(i), value); err != nil {
+			return fmt.Errorf("prefilling %s: %v", benchKey(i), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// States of the circuit breaker, exported as the circuit_breaker_state
+// gauge.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = [...]string{"closed", "open", "half_open"}
+
+// BreakerConfig fails operations fast after repeated failures instead of
+// stacking up queries that time out one after the other.
+type BreakerConfig struct {
+	// Consecutive failed operations that open the breaker. Defaults to 5.
+	Failures int `json:"failures,omitempty"`
+	// How long the open breaker fails operations before it lets a single
+	// one through to probe the database. Defaults to 30s.
+	Cooldown caddy.Duration `json:"cooldown,omitempty"`
+}
+
+func (c *BreakerConfig) setDefaults() {
+	if c.Failures == 0 {
+		c.Failures = 5
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = caddy.Duration(30 * time.Second)
+	}
+}
+
+type breaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	opened   time.Time
+	// whether the probing operation of the half open breaker is running.
+	probing bool
+}
+
+// isBreakerFailure reports whether err means the database failed, as
+// opposed to an answer such as a missing key, a held lock or a caller
+// giving up.
+func isBreakerFailure(err error) bool {
+	var corruption *CorruptionError
+	switch {
+	case err == nil,
+		errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, sql.ErrNoRows),
+		errors.Is(err, ErrLocked),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, errClosing),
+		errors.Is(err, ErrReadOnly),
+		errors.Is(err, ErrCircuitOpen),
+		errors.As(err, &corruption):
+		return false
+	}
+	return true
+}
+
+// breakerState returns the name of the current breaker state.
+func (s *SqliteStorage) breakerState() string {
+	if s.CircuitBreaker == nil {
+		return ""
+	}
+	s.breaker.mu.Lock()
+	defer s.breaker.mu.Unlock()
+	return breakerStates[s.breaker.state]
+}
+
+// breakerAllow returns ErrCircuitOpen if the operation must not run. Once the
+// cooldown passed, a single operation is let through to probe the
+// database.
+func (s *SqliteStorage) breakerAllow() error {
+	if s.CircuitBreaker == nil {
+		return nil
+	}
+	b := s.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.opened) >= time.Duration(s.CircuitBreaker.Cooldown) {
+		b.setState(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerClosed:
+		return nil
+	case b.state == breakerHalfOpen && !b.probing:
+		b.probing = true
+		return nil
+	}
+	return ErrCircuitOpen
+}
+
+// breakerRecord records the outcome of an operation let through by
+// breakerAllow.
+func (s *SqliteStorage) breakerRecord(err error) {
+	if s.CircuitBreaker == nil {
+		return
+	}
+	b := s.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		// Says nothing about the database, a half open breaker probes
+		// again.
+		return
+	}
+	if !isBreakerFailure(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+			caddy.Log().Named(logStorage).Info("circuit breaker closed, the database answers again")
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= s.CircuitBreaker.Failures) {
+		b.opened = time.Now()
+		b.setState(breakerOpen)
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("circuit breaker opened for %s after %d failed operations: %v",
+			time.Duration(s.CircuitBreaker.Cooldown), b.failures, err))
+	}
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	sqliteMetrics.breakerState.Set(float64(state))
+	sqliteMetrics.breakerTransitions.WithLabelValues(breakerStates[state]).Inc()
+}
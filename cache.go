@@ -0,0 +1,170 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// CacheConfig configures the in-process read cache.
+type CacheConfig struct {
+	// Maximum number of cached values. The least recently used value is
+	// evicted first.
+	Size int `json:"size,omitempty"`
+	// Age after which a cached value is revalidated by comparing its
+	// modified time and version with the database. Writes from this
+	// instance invalidate the cache immediately, writes from other
+	// instances are noticed after at most this long.
+	Revalidate caddy.Duration `json:"revalidate,omitempty"`
+}
+
+func (c *CacheConfig) setDefaults() {
+	if c.Size == 0 {
+		c.Size = 1000
+	}
+	if c.Revalidate == 0 {
+		c.Revalidate = caddy.Duration(10 * time.Second)
+	}
+}
+
+type cacheEntry struct {
+	keyHash  string
+	value    secret
+	modified time.Time
+	version  int64
+	checked  time.Time
+}
+
+// readCache is an LRU cache of values keyed on key_hash.
+type readCache struct {
+	size       int
+	revalidate time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	// Number of invalidations so far. A value read from the database is
+	// only added if there was none since the read started, as it may
+	// predate the write that caused it.
+	generation uint64
+}
+
+func newReadCache(c *CacheConfig) *readCache {
+	if c == nil {
+		return nil
+	}
+	c.setDefaults()
+	return &readCache{
+		size:       c.Size,
+		revalidate: time.Duration(c.Revalidate),
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *readCache) get(keyHash string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[keyHash]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return *el.Value.(*cacheEntry), true
+}
+
+// begin returns the generation to pass to add for a value about to be
+// read from the database.
+func (c *readCache) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// add caches a value read since begin returned generation, unless the
+// cache was invalidated meanwhile.
+func (c *readCache) add(keyHash string, value secret, modified time.Time, version int64, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &cacheEntry{keyHash: keyHash, value: newSecret(bytes.Clone(value.reveal())), modified: modified, version: version, checked: time.Now()}
+	if el, ok := c.entries[keyHash]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[keyHash] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).keyHash)
+	}
+}
+
+func (c *readCache) touch(keyHash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[keyHash]; ok {
+		el.Value.(*cacheEntry).checked = time.Now()
+	}
+}
+
+func (c *readCache) remove(keyHash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if el, ok := c.entries[keyHash]; ok {
+		c.order.Remove(el)
+		delete(c.entries, keyHash)
+	}
+}
+
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.order.Init()
+	clear(c.entries)
+}
+
+// invalidate drops key_hash from the cache, if there is one.
+func (s *SqliteStorage) invalidate(keyHash string) {
+	if s.cache != nil {
+		s.cache.remove(keyHash)
+	}
+}
+
+// cachedValue returns the cached value of key_hash and its modified time.
+// Entries older than the revalidation interval are only returned if the row's modified time and
+// version did not change in the meantime.
+func (s *SqliteStorage) cachedValue(ctx context.Context, keyHash string) (secret, time.Time, bool) {
+	if s.cache == nil {
+		return secret{}, time.Time{}, false
+	}
+	entry, ok := s.cache.get(keyHash)
+	if !ok {
+		sqliteMetrics.cacheRequests.WithLabelValues("miss").Inc()
+		return secret{}, time.Time{}, false
+	}
+	if time.Since(entry.checked) >= s.cache.revalidate {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		var modified time.Time
+		var version int64
+		err := s.queryRow(ctx, s.readDB(), "SELECT modified, version FROM certmagic_data WHERE key_hash = ?", nil, keyHash).Scan(&modified, &version)
+		if err != nil || !modified.Equal(entry.modified) || version != entry.version {
+			s.cache.remove(keyHash)
+			sqliteMetrics.cacheRequests.WithLabelValues("stale").Inc()
+			return secret{}, time.Time{}, false
+		}
+		s.cache.touch(keyHash)
+	}
+	sqliteMetrics.cacheRequests.WithLabelValues("hit").Inc()
+	return newSecret(bytes.Clone(entry.value.reveal())), entry.modified, true
+}
@@ -0,0 +1,119 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// deletedAtLayout is the format of certmagic_changes.deleted_at, written
+// by the triggers in UTC.
+const deletedAtLayout = "2006-01-02 15:04:05.000"
+
+// Change is an entry of the change feed: the latest change of a key. The
+// domain policies are in the feed too, under keys starting with
+// :domain_policies/ followed by the pattern, with the action as value.
+type Change struct {
+	// Position in the feed, increasing with every change.
+	Seq int64  `json:"seq"`
+	Key string `json:"key"`
+	// Decoded value of the key, empty if it was deleted.
+	Value []byte `json:"value,omitempty"`
+	// When the value was written, or when the key was deleted.
+	Modified time.Time `json:"modified"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// ChangeSet is a batch of the change feed.
+type ChangeSet struct {
+	Changes []Change `json:"changes"`
+	// Sequence number to ask for the next batch with.
+	Last int64 `json:"last"`
+}
+
+// Changes returns up to limit changes made after the sequence number since,
+// oldest first. Every key appears once, with its latest change, so a
+// reader that falls behind skips intermediate values. Only sqlite
+// databases keep a change feed.
+func (s *SqliteStorage) Changes(ctx context.Context, since int64, limit int) (ChangeSet, error) {
+	set := ChangeSet{Changes: []Change{}, Last: since}
+	if s.dialect != dialects[Sqlite] {
+		return set, fmt.Errorf("the change feed is not supported for %s", s.Dialect)
+	}
+	err := s.View(ctx, func(v *ReadView) error {
+		rows, err := s.query(ctx, v.tx, "SELECT seq, key, deleted_at FROM certmagic_changes WHERE seq > ? ORDER BY seq LIMIT ?", nil, since, limit)
+		if err != nil {
+			return err
+		}
+		var changes []Change
+		for rows.Next() {
+			var c Change
+			var deletedAt sql.NullString
+			if err := rows.Scan(&c.Seq, &c.Key, &deletedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			if !strings.HasPrefix(c.Key, domainPolicyFeedPrefix) {
+				if c.Key, err = s.plainKey(c.Key); err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			if deletedAt.Valid {
+				c.Deleted = true
+				if c.Modified, err = time.Parse(deletedAtLayout, deletedAt.String); err != nil {
+					rows.Close()
+					return fmt.Errorf("deletion time of %s: %v", c.Key, err)
+				}
+			}
+			changes = append(changes, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, c := range changes {
+			set.Last = c.Seq
+			if pattern, ok := strings.CutPrefix(c.Key, domainPolicyFeedPrefix); ok && !c.Deleted {
+				action, created, err := s.domainPolicy(ctx, v.tx, pattern)
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				c.Value, c.Modified = []byte(action), created
+			} else if !c.Deleted {
+				value, info, err := v.LoadWithInfo(ctx, c.Key)
+				if errors.Is(err, fs.ErrNotExist) {
+					// Changed without a trigger, such as by hand.
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				c.Value, c.Modified = value, info.Modified
+			}
+			set.Changes = append(set.Changes, c)
+		}
+		return nil
+	})
+	return set, err
+}
+
+// lastSeq returns the sequence number of the latest change, 0 if there
+// is none.
+func (s *SqliteStorage) lastSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := s.retry(ctx, "last_seq", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		return s.queryRow(ctx, s.readDB(), "SELECT COALESCE(MAX(seq), 0) FROM certmagic_changes", nil).Scan(&seq)
+	})
+	return seq, err
+}
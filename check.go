@@ -0,0 +1,127 @@
+package storagesqlite
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Problem is a structural issue found in the stored certmagic data.
+type Problem struct {
+	Key     string
+	Problem string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Problem)
+}
+
+// site collects the files certmagic keeps for one certificate.
+type site struct {
+	cert, key, meta string
+}
+
+// checkLayout parses the certmagic tree (certificates, account data and
+// OCSP staples) and reports certificates without private keys or metadata,
+// unparseable PEM and JSON files and staples without a certificate.
+func (s *SqliteStorage) checkLayout(ctx context.Context) ([]Problem, error) {
+	keys, err := s.keysWithPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.LoadMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	sites := make(map[string]*site)
+	domains := make(map[string]bool)
+	var staples []string
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		switch {
+		case parts[0] == "certificates" && len(parts) == 4:
+			dir := path.Dir(key)
+			if sites[dir] == nil {
+				sites[dir] = &site{}
+			}
+			domains[parts[2]] = true
+			switch path.Ext(key) {
+			case ".crt":
+				sites[dir].cert = key
+			case ".key":
+				sites[dir].key = key
+			case ".json":
+				sites[dir].meta = key
+			}
+		case parts[0] == "ocsp" && len(parts) == 2:
+			staples = append(staples, key)
+		}
+
+		var problem string
+		switch path.Ext(key) {
+		case ".crt":
+			problem = checkPEM(values[key], "CERTIFICATE")
+		case ".key":
+			problem = checkPEM(values[key], "PRIVATE KEY")
+		case ".json":
+			problem = checkJSON(values[key])
+		}
+		if problem != "" {
+			problems = append(problems, Problem{Key: key, Problem: problem})
+		}
+	}
+
+	for dir, site := range sites {
+		switch {
+		case site.cert != "" && site.key == "":
+			problems = append(problems, Problem{Key: site.cert, Problem: "certificate without private key"})
+		case site.cert == "" && site.key != "":
+			problems = append(problems, Problem{Key: site.key, Problem: "private key without certificate"})
+		case site.cert == "":
+			problems = append(problems, Problem{Key: dir, Problem: "site without certificate"})
+		}
+		if site.cert != "" && site.meta == "" {
+			problems = append(problems, Problem{Key: site.cert, Problem: "certificate without metadata"})
+		}
+	}
+
+	for _, key := range staples {
+		name := path.Base(key)
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			name = name[:i]
+		}
+		if !domains[name] {
+			problems = append(problems, Problem{Key: key, Problem: "OCSP staple without certificate"})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems, nil
+}
+
+// checkPEM reports a problem if value is not a PEM block whose type
+// contains blockType.
+func checkPEM(value []byte, blockType string) string {
+	block, _ := pem.Decode(value)
+	if block == nil {
+		return "not PEM encoded"
+	}
+	if !strings.Contains(block.Type, blockType) {
+		return fmt.Sprintf("unexpected PEM block %q", block.Type)
+	}
+	return ""
+}
+
+// checkJSON reports a problem if value is not valid JSON.
+func checkJSON(value []byte) string {
+	if !json.Valid(value) {
+		return "unreadable JSON"
+	}
+	return ""
+}
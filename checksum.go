@@ -0,0 +1,37 @@
+package storagesqlite
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// CorruptionError is returned by Load when the stored value does not match
+// the checksum recorded when it was written.
+type CorruptionError struct {
+	Key string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("checksum mismatch for key: %s", e.Key)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func valueChecksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyChecksum returns a *CorruptionError if a recorded checksum does
+// not match value.
+func verifyChecksum(key string, value []byte, checksum sql.NullString) error {
+	if !checksum.Valid || checksum.String == valueChecksum(value) {
+		return nil
+	}
+	sqliteMetrics.corruptions.Inc()
+	return &CorruptionError{Key: key}
+}
@@ -0,0 +1,672 @@
+package storagesqlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "sqlite-storage",
+		Short: "Commands for working with the sqlite storage",
+		Long: `
+Tools operating directly on a sqlite storage database. The database is
+given with --dsn, falling back to the CADDY_SQLITE_DSN environment
+variable, or the former sqlite_DSN, and the default location.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			verifyCmd := &cobra.Command{
+				Use:   "verify --dsn <dsn> --against <dir>",
+				Short: "Compares the database against a file_system storage tree",
+				Long: `
+Compares keys, sizes and SHA-256 hashes of the values in the database with
+the files of a file_system storage root and reports keys that are missing on
+either side or whose contents differ. Exits with a non-zero status if
+differences are found.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdVerify),
+			}
+			verifyCmd.Flags().String("dsn", "", "Database to verify")
+			verifyCmd.Flags().String("against", "", "Root of the file_system storage (required)")
+			cmd.AddCommand(verifyCmd)
+
+			diffCmd := &cobra.Command{
+				Use:   "diff <a.db> <b.db>",
+				Short: "Lists differences between two databases",
+				Long: `
+Lists keys present in only one of the two databases and keys whose values
+or modification times differ, for example to validate a backup or replica.
+Both databases are opened read-only. Exits with a non-zero status if
+differences are found.
+`,
+				Args: cobra.ExactArgs(2),
+				RunE: func(cmd *cobra.Command, args []string) error {
+					return cmdDiff(args[0], args[1])
+				},
+			}
+			cmd.AddCommand(diffCmd)
+
+			checkCmd := &cobra.Command{
+				Use:   "check --dsn <dsn>",
+				Short: "Checks the stored certmagic data for structural problems",
+				Long: `
+Parses the stored certificates, private keys, metadata and OCSP staples and
+reports certificates without private keys or metadata, files that cannot
+be parsed and staples whose certificate is gone. Exits with a non-zero
+status if problems are found.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdCheck),
+			}
+			checkCmd.Flags().String("dsn", "", "Database to check")
+			cmd.AddCommand(checkCmd)
+
+			importFromCmd := &cobra.Command{
+				Use:   "import-from --dsn <dsn> --storage <json>",
+				Short: "Copies the contents of another storage module into the database",
+				Long: `
+Loads the storage module described by --storage, given as the JSON that
+would appear in the "storage" field of a Caddy config, and copies every
+key into the database. Any storage module compiled into this binary can be
+used, for example redis, consul or postgres:
+
+$ caddy sqlite-storage import-from --dsn certs.sqlite \
+> --storage '{"module": "redis", "host": "127.0.0.1", "port": "6379"}'
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdImportFrom),
+			}
+			importFromCmd.Flags().String("dsn", "", "Database to import into")
+			importFromCmd.Flags().String("storage", "", "JSON config of the source storage module (required)")
+			cmd.AddCommand(importFromCmd)
+
+			decryptCmd := &cobra.Command{
+				Use:   "decrypt-backup --key <base64> --input <path> --output <path>",
+				Short: "Decrypts an encrypted backup archive",
+				Long: `
+Decrypts a backup archive written with a backup encryption_key, restoring
+the plain sqlite database file.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdDecryptBackup),
+			}
+			decryptCmd.Flags().String("key", "", "Base64 encoded encryption key (required)")
+			decryptCmd.Flags().StringP("input", "i", "", "Encrypted archive (required)")
+			decryptCmd.Flags().StringP("output", "o", "", "Path of the decrypted database (required)")
+			cmd.AddCommand(decryptCmd)
+
+			locksCmd := &cobra.Command{
+				Use:   "locks --dsn <dsn>",
+				Short: "Lists the locks currently held in the database",
+				Long: `
+Lists every lock that has not expired with the instance, host and pid that
+took it and how long it has been held.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdLocks),
+			}
+			locksCmd.Flags().String("dsn", "", "Database to inspect")
+			cmd.AddCommand(locksCmd)
+
+			deletePrefixCmd := &cobra.Command{
+				Use:   "delete-prefix --dsn <dsn> <prefix>",
+				Short: "Deletes every key starting with a prefix",
+				Long: `
+Deletes all keys starting with the given prefix in a single statement, for
+example to remove the certificates of an issuer that is no longer used:
+
+$ caddy sqlite-storage delete-prefix --dsn certs.sqlite \
+> certificates/acme-staging-v02.api.letsencrypt.org-directory/
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: func(cmd *cobra.Command, args []string) error {
+					dsn, err := cmd.Flags().GetString("dsn")
+					if err != nil {
+						return err
+					}
+					return cmdDeletePrefix(dsn, args[0])
+				},
+			}
+			deletePrefixCmd.Flags().String("dsn", "", "Database to delete from")
+			cmd.AddCommand(deletePrefixCmd)
+
+			selftestCmd := &cobra.Command{
+				Use:   "selftest --dsn <dsn>",
+				Short: "Runs a round trip of storage operations against the database",
+				Long: `
+Stores, loads, stats, lists, locks, unlocks and deletes a scratch key and
+prints the latency of every step, to quickly validate a new deployment.
+Exits with a non-zero status if a step fails.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdSelftest),
+			}
+			selftestCmd.Flags().String("dsn", "", "Database to test")
+			cmd.AddCommand(selftestCmd)
+
+			benchCmd := &cobra.Command{
+				Use:   "bench --dsn <dsn> [--keys <n>]",
+				Short: "Benchmarks storage operations against the database",
+				Long: `
+Writes --keys keys under bench/ and measures Store, Load, List and
+Lock/Unlock against the database, printing the time per operation. Use it
+to compare hardware or pragma settings. The keys are deleted afterwards.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdBench),
+			}
+			benchCmd.Flags().String("dsn", "", "Database to benchmark")
+			benchCmd.Flags().Int("keys", 1000, "Number of keys in the benchmarked store")
+			cmd.AddCommand(benchCmd)
+
+			exportCmd := &cobra.Command{
+				Use:   "export --dsn <dsn> --format tar|jsonl [--prefix <prefix>] --output <path>",
+				Short: "Exports the keys of the database",
+				Long: `
+Exports every key of the database, or only those starting with --prefix,
+for example certificates/ or the directory of a single issuer. The tar
+format writes a gzipped tarball with one file per key, keeping modification
+times, which any certmagic storage can import. The jsonl format writes one
+JSON object per line with the fields key, modified and value_base64,
+suitable for jq and fixtures.
+
+--output is required, - can be given for stdout.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdExport),
+			}
+			exportCmd.Flags().String("dsn", "", "Database to export")
+			exportCmd.Flags().String("format", "tar", "Export format")
+			exportCmd.Flags().String("prefix", "", "Only export keys starting with this prefix")
+			exportCmd.Flags().StringP("output", "o", "", "Output path (required)")
+			cmd.AddCommand(exportCmd)
+
+			importCmd := &cobra.Command{
+				Use:   "import --dsn <dsn> --format tar|jsonl --input <path>",
+				Short: "Imports keys written by export",
+				Long: `
+Stores every key of an export into the database, overwriting existing keys.
+
+--input is required, - can be given for stdin.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdImport),
+			}
+			importCmd.Flags().String("dsn", "", "Database to import into")
+			importCmd.Flags().String("format", "tar", "Import format")
+			importCmd.Flags().StringP("input", "i", "", "Input path (required)")
+			cmd.AddCommand(importCmd)
+
+			manifestCmd := &cobra.Command{
+				Use:   "manifest --dsn <dsn> --key <pem> --output <path>",
+				Short: "Writes a signed manifest of the values of the database",
+				Long: `
+Writes a JSON manifest with the SHA-256 of the value of every key, read in
+a single transaction, signed with the Ed25519 private key in the PKCS #8 PEM
+file --key. Check the database against it later with verify-manifest. A
+key can be created with:
+
+$ openssl genpkey -algorithm ed25519 -out manifest.key
+$ openssl pkey -in manifest.key -pubout -out manifest.pub
+
+--output is required, - can be given for stdout.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdManifest),
+			}
+			manifestCmd.Flags().String("dsn", "", "Database to describe")
+			manifestCmd.Flags().String("key", "", "Ed25519 private key PEM file (required)")
+			manifestCmd.Flags().StringP("output", "o", "", "Output path (required)")
+			cmd.AddCommand(manifestCmd)
+
+			verifyManifestCmd := &cobra.Command{
+				Use:   "verify-manifest --dsn <dsn> --public-key <pem> --manifest <path>",
+				Short: "Checks the database against a signed manifest",
+				Long: `
+Checks the signature of a manifest written by the manifest command with the
+Ed25519 public key in the PEM file --public-key, then reports keys added,
+removed or changed since. Exits with a non-zero status if the signature is
+invalid or differences are found.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdVerifyManifest),
+			}
+			verifyManifestCmd.Flags().String("dsn", "", "Database to verify")
+			verifyManifestCmd.Flags().String("public-key", "", "Ed25519 public key PEM file (required)")
+			verifyManifestCmd.Flags().String("manifest", "", "Manifest to verify against (required)")
+			cmd.AddCommand(verifyManifestCmd)
+		},
+	})
+}
+
+// openStorage opens the database named by dsn for command line use.
+func openStorage(dsn string) (*SqliteStorage, error) {
+	dsn, err := argDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newCommandStorage(dsn)
+}
+
+// openReadOnly opens the database named by dsn read-only, so that
+// comparing databases such as backups and replicas neither migrates nor
+// writes to them.
+func openReadOnly(dsn string) (*SqliteStorage, error) {
+	dsn, err := argDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if ro, ok := readOnlyDSN(dsn); ok {
+		dsn = ro
+	}
+	return newCommandStorage(dsn)
+}
+
+// argDSN resolves a relative path given on the command line against the
+// working directory, as usual for arguments, rather than against the data
+// directory as in the config.
+func argDSN(dsn string) (string, error) {
+	if dsn == "" || dsn == ":memory:" || strings.HasPrefix(dsn, "file:") {
+		return dsn, nil
+	}
+	return filepath.Abs(dsn)
+}
+
+// newCommandStorage opens dsn with the default options.
+func newCommandStorage(dsn string) (*SqliteStorage, error) {
+	c := SqliteStorage{Dsn: dsn}
+	c.setDefaults()
+	s, err := NewStorage(c)
+	if err != nil {
+		if s != nil {
+			s.(*SqliteStorage).Close()
+		}
+		return nil, err
+	}
+	return s.(*SqliteStorage), nil
+}
+
+func cmdVerify(fl caddycmd.Flags) (int, error) {
+	against := fl.String("against")
+	if against == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--against is required")
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	diffs, err := s.verifyAgainstDir(context.Background(), against)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(os.Stdout, d)
+	}
+	if len(diffs) > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%d differences found", len(diffs))
+	}
+	fmt.Println("Storage matches", against)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdDiff(aDsn, bDsn string) error {
+	a, err := openReadOnly(aDsn)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := openReadOnly(bDsn)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	diffs, err := diffStorages(context.Background(), a, b)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(os.Stdout, d)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d differences found", len(diffs))
+	}
+	fmt.Println("Databases match")
+	return nil
+}
+
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	problems, err := s.checkLayout(context.Background())
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stdout, p)
+	}
+	if len(problems) > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("No problems found")
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdImportFrom(fl caddycmd.Flags) (int, error) {
+	storageFlag := fl.String("storage")
+	if storageFlag == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--storage is required")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	src, err := loadStorageModule(ctx, json.RawMessage(storageFlag))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	imported, err := s.importFrom(ctx, src)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	fmt.Printf("Imported %d keys\n", imported)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdDecryptBackup(fl caddycmd.Flags) (int, error) {
+	key, input, output := fl.String("key"), fl.String("input"), fl.String("output")
+	if key == "" || input == "" || output == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--key, --input and --output are required")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	archive, err := os.ReadFile(input)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	plaintext, err := decryptArchive(aead, archive)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("decrypting %s: %v", input, err)
+	}
+	if err := os.WriteFile(output, plaintext, 0o600); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	fmt.Println("Decrypted backup written to", output)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	output := fl.String("output")
+	if output == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--output is required")
+	}
+	var export func(*SqliteStorage, context.Context, io.Writer, string) (int, error)
+	switch format := fl.String("format"); format {
+	case "tar":
+		export = (*SqliteStorage).exportTar
+	case "jsonl":
+		export = (*SqliteStorage).exportJSON
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown format: %s", format)
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	f := os.Stdout
+	if output != "-" {
+		f, err = os.Create(output)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("opening output file: %v", err)
+		}
+		defer f.Close()
+	}
+
+	exported, err := export(s, context.Background(), f, fl.String("prefix"))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d keys\n", exported)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	input := fl.String("input")
+	if input == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--input is required")
+	}
+	var importer func(*SqliteStorage, context.Context, io.Reader) (int, error)
+	switch format := fl.String("format"); format {
+	case "tar":
+		importer = (*SqliteStorage).importTar
+	case "jsonl":
+		importer = (*SqliteStorage).importJSON
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown format: %s", format)
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	f := os.Stdin
+	if input != "-" {
+		f, err = os.Open(input)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("opening input file: %v", err)
+		}
+		defer f.Close()
+	}
+
+	imported, err := importer(s, context.Background(), f)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	fmt.Printf("Imported %d keys\n", imported)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdManifest(fl caddycmd.Flags) (int, error) {
+	keyFile, output := fl.String("key"), fl.String("output")
+	if keyFile == "" || output == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--key and --output are required")
+	}
+	key, err := loadSigningKey(keyFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	m, err := s.Manifest(context.Background())
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if err := m.Sign(key); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	data = append(data, '\n')
+	if output == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		// The manifest lists every key name, readable by the owner only,
+		// also when it replaces an existing file.
+		if err = os.WriteFile(output, data, 0o600); err == nil {
+			err = os.Chmod(output, 0o600)
+		}
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	fmt.Fprintf(os.Stderr, "Manifest of %d keys written\n", len(m.Keys))
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdVerifyManifest(fl caddycmd.Flags) (int, error) {
+	keyFile, manifestFile := fl.String("public-key"), fl.String("manifest")
+	if keyFile == "" || manifestFile == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--public-key and --manifest are required")
+	}
+	key, err := loadVerifyKey(keyFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding %s: %v", manifestFile, err)
+	}
+	if err := m.VerifySignature(key); err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%s: %v", manifestFile, err)
+	}
+
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	diffs, err := s.verifyManifest(context.Background(), &m)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(os.Stdout, d)
+	}
+	if len(diffs) > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%d differences found", len(diffs))
+	}
+	fmt.Printf("Database matches the manifest of %s\n", m.Created.Format(time.RFC3339))
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdLocks(fl caddycmd.Flags) (int, error) {
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	locks, err := s.Locks(context.Background())
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tOWNER\tHOST\tPID\tHELD\tEXPIRES")
+	for _, l := range locks {
+		held := "-"
+		if !l.AcquiredAt.IsZero() {
+			held = time.Since(l.AcquiredAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", l.Key, l.Owner, l.Host, l.Pid, held, l.Expires.Format(time.RFC3339))
+	}
+	w.Flush()
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdDeletePrefix(dsn, prefix string) error {
+	if prefix == "" {
+		return errors.New("prefix must not be empty")
+	}
+	s, err := openStorage(dsn)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	deleted, err := s.DeletePrefix(context.Background(), prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d keys\n", deleted)
+	return nil
+}
+
+func cmdSelftest(fl caddycmd.Flags) (int, error) {
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tLATENCY\tRESULT")
+	var failed error
+	for _, step := range s.selfTest(context.Background()) {
+		result := "ok"
+		if step.Err != nil {
+			result = step.Err.Error()
+			failed = fmt.Errorf("%s failed: %v", step.Name, step.Err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", step.Name, step.Latency.Round(time.Microsecond), result)
+	}
+	w.Flush()
+	if failed != nil {
+		return caddy.ExitCodeFailedQuit, failed
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdBench(fl caddycmd.Flags) (int, error) {
+	keys := fl.Int("keys")
+	if keys < 1 {
+		return caddy.ExitCodeFailedStartup, errors.New("--keys must be positive")
+	}
+	s, err := openStorage(fl.String("dsn"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	if err := s.prefillBench(ctx, keys); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	defer s.DeletePrefix(ctx, benchPrefix)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tKEYS\tITERATIONS\tTIME/OP\tOPS/S")
+	for _, bm := range benchmarks {
+		result, err := s.runBenchmark(ctx, bm, keys, benchTime)
+		if err != nil {
+			return caddy.ExitCodeFailedQuit, err
+		}
+		perOp := result.PerOp()
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%.0f\n", bm.name, keys, result.N, perOp, float64(time.Second)/float64(perOp))
+	}
+	w.Flush()
+	return caddy.ExitCodeSuccess, nil
+}
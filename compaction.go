@@ -0,0 +1,217 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// compactionEvent is the name of the Caddy event emitted after an automatic
+// compaction.
+const compactionEvent = "sqlite_storage_compacted"
+
+// CompactionConfig compacts a sqlite database automatically once its
+// unused pages exceed a fraction of all pages.
+type CompactionConfig struct {
+	// Fraction of free pages, from 0 to 1, that triggers a compaction.
+	// Defaults to 0.25.
+	FreeRatio float64 `json:"free_ratio,omitempty"`
+	// How often the free page ratio is checked. Defaults to 10m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Local time range, such as 02:00-04:00, in which a full VACUUM may
+	// run. Incremental vacuums run at any time. Empty allows full
+	// vacuums at any time.
+	Window string `json:"window,omitempty"`
+	// Switch the database to incremental auto_vacuum. It takes effect
+	// with the next full VACUUM, after which compactions only free pages
+	// incrementally and don't rewrite the whole database.
+	Incremental bool `json:"incremental,omitempty"`
+	// Pages per second freed by incremental vacuums run in small steps
+	// after deletes, so that space is reclaimed continuously rather than
+	// at the next check. Only used in incremental auto_vacuum mode. Zero
+	// disables it.
+	PagesPerSecond int `json:"vacuum_pages_per_second,omitempty"`
+}
+
+func (c *CompactionConfig) setDefaults() {
+	if c.FreeRatio == 0 {
+		c.FreeRatio = 0.25
+	}
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(10 * time.Minute)
+	}
+}
+
+// parseWindow parses a window of the form HH:MM-HH:MM into minutes since
+// midnight. The end may be before the start for windows spanning
+// midnight.
+func parseWindow(window string) (start, end int, err error) {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", window)
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", clock, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inWindow reports whether now is within the maintenance window.
+func (c *CompactionConfig) inWindow(now time.Time) bool {
+	if c.Window == "" {
+		return true
+	}
+	start, end, err := parseWindow(c.Window)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// compactionJob checks the free page ratio, it runs every compaction
+// interval. It counts the vacuums it ran.
+func (s *SqliteStorage) compactionJob(ctx context.Context) (int64, error) {
+	op, err := s.compact(ctx, time.Now())
+	if err != nil || op == "" {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// compact runs an incremental vacuum, or a full one within the window,
+// if the free page ratio exceeds the threshold. It returns the operation
+// run, or an empty string if none was due.
+func (s *SqliteStorage) compact(ctx context.Context, now time.Time) (string, error) {
+	stats, err := s.fileStats(ctx)
+	if err != nil {
+		return "", err
+	}
+	if stats.PageCount == 0 || float64(stats.FreelistPages)/float64(stats.PageCount) < s.Compaction.FreeRatio {
+		return "", nil
+	}
+
+	var mode int
+	if err := s.writeDB().QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return "", err
+	}
+	op := MaintenanceIncrementalVacuum
+	if mode != autoVacuumIncremental {
+		if !s.Compaction.inWindow(now) {
+			caddy.Log().Named(logMaintenance).Debug(fmt.Sprintf("%d of %d pages are free, waiting for the window %s to vacuum",
+				stats.FreelistPages, stats.PageCount, s.Compaction.Window))
+			return "", nil
+		}
+		if s.Compaction.Incremental {
+			if _, err := s.exec(ctx, s.writeDB(), "PRAGMA auto_vacuum = INCREMENTAL", nil); err != nil {
+				return "", err
+			}
+		}
+		op = MaintenanceVacuum
+	}
+
+	result, err := s.Maintain(ctx, op)
+	if err != nil {
+		return "", err
+	}
+	s.emit(compactionEvent, map[string]any{
+		"database":       dbFilePath(s.Dsn),
+		"operation":      op,
+		"page_count":     stats.PageCount,
+		"freelist_pages": stats.FreelistPages,
+		"reclaimed":      result.Reclaimed,
+		"duration":       result.Duration,
+	})
+	return op, nil
+}
+
+// vacuumBudgetTick is the shortest time between two budgeted incremental
+// vacuum steps.
+const vacuumBudgetTick = 100 * time.Millisecond
+
+// vacuumBudget returns how many pages a budgeted incremental vacuum step
+// frees and how often one runs to free PagesPerSecond pages per second.
+func (c *CompactionConfig) vacuumBudget() (int, time.Duration) {
+	pages := max(1, (c.PagesPerSecond+9)/10)
+	return pages, time.Second * time.Duration(pages) / time.Duration(c.PagesPerSecond)
+}
+
+// deleted wakes up the budgeted incremental vacuum after keys were
+// deleted.
+func (s *SqliteStorage) deleted() {
+	if s.vacuumKick != nil {
+		wakeJob(s.vacuumKick)
+	}
+}
+
+// vacuumBudgetJob frees the pages left by deletes a few at a time until
+// none are left, so that no single vacuum holds the write lock for long,
+// and returns the number of pages freed.
+func (s *SqliteStorage) vacuumBudgetJob(ctx context.Context) (int64, error) {
+	var mode int
+	var free int64
+	err := s.writeDB().QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode)
+	if err == nil && mode == autoVacuumIncremental {
+		err = s.writeDB().QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&free)
+	}
+	if err != nil || mode != autoVacuumIncremental || free == 0 {
+		return 0, err
+	}
+	pages, interval := s.Compaction.vacuumBudget()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		left, err := s.vacuumStep(ctx, pages)
+		if err != nil {
+			return 0, fmt.Errorf("incremental vacuum: %v", err)
+		}
+		if left == 0 {
+			return free, nil
+		}
+		select {
+		case <-ctx.Done():
+			return free - left, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// vacuumStep frees up to pages unused pages and returns how many are
+// left.
+func (s *SqliteStorage) vacuumStep(ctx context.Context, pages int) (int64, error) {
+	var left int64
+	err := s.retryWrite(ctx, MaintenanceIncrementalVacuum, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		vacuum := s.maintenanceFunc(MaintenanceIncrementalVacuum, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages), nil)
+		if err := vacuum(ctx); err != nil {
+			return err
+		}
+		return s.writeDB().QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&left)
+	})
+	return left, err
+}
+
+// emit emits a Caddy event if the storage was provisioned by Caddy.
+func (s *SqliteStorage) emit(name string, data map[string]any) {
+	if s.events != nil {
+		s.events.Emit(s.eventsCtx, name, data)
+	}
+}
@@ -0,0 +1,111 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// CompatFileSystem makes List and Stat behave like certmagic's
+// FileStorage, which treats the segments of a key as directories.
+const CompatFileSystem = "file_system"
+
+// listDir implements List like certmagic.FileStorage: it returns the
+// entries below the directory prefix, only the direct ones unless
+// recursive, including the directories themselves, in the order of a file
+// system walk. A prefix naming a key lists nothing, a prefix naming
+// neither a key nor a directory fails with fs.ErrNotExist.
+func (s *SqliteStorage) listDir(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	dir := strings.Trim(path.Clean("/"+prefix), "/")
+	under := ""
+	if dir != "" {
+		under = dir + "/"
+	}
+	keys, err := s.keysWithPrefix(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var entries []string
+	found, isKey := dir == "", false
+	for _, key := range keys {
+		if key == dir {
+			isKey = true
+			continue
+		}
+		rel, ok := strings.CutPrefix(key, under)
+		if !ok {
+			// Shares the prefix but not the directory, such as a-c for a.
+			continue
+		}
+		found = true
+		parts := strings.Split(rel, "/")
+		depth := 1
+		if recursive {
+			depth = len(parts)
+		}
+		for i := 1; i <= depth; i++ {
+			entry := path.Join(prefix, strings.Join(parts[:i], "/"))
+			if !seen[entry] {
+				seen[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if isKey {
+		return nil, nil
+	}
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return walkLess(entries[i], entries[j])
+	})
+	return entries, nil
+}
+
+// walkLess orders paths like a file system walk, which visits a directory
+// before its entries and the entries of a directory by name.
+func walkLess(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// statDir returns the KeyInfo of a directory, the prefix of at least one
+// key, like certmagic.FileStorage.Stat does. Its modification time is the
+// latest of the keys below it.
+func (s *SqliteStorage) statDir(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	dir := strings.Trim(path.Clean("/"+key), "/") + "/"
+	var modified time.Time
+	err := s.retry(ctx, "stat", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		if s.indexKey != nil {
+			var err error
+			modified, err = s.statHiddenDir(ctx, dir)
+			return err
+		}
+		cond, args := s.dialect.prefixRange(dir)
+		err := s.queryRow(ctx, s.readDB(), "select modified from certmagic_data where "+cond+" order by modified desc limit 1", []string{dir}, args...).Scan(&modified)
+		if err == sql.ErrNoRows {
+			return fs.ErrNotExist
+		}
+		return err
+	})
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{Key: key, Modified: modified, IsTerminal: false}, nil
+}
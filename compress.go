@@ -0,0 +1,105 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encodingGzip marks values stored gzip compressed in the encoding column.
+const encodingGzip = "gzip"
+
+// encodeValue returns value as it is written to the database together
+// with its encoding, the applied transformations joined by "+". Values are
+// compressed if compression is enabled, they are at least CompressMinSize
+// bytes long and compression saves space, and then encrypted if the
+// encryption rules say so.
+func (s *SqliteStorage) encodeValue(key string, value secret) (secret, sql.NullString, error) {
+	var encodings []string
+	stored := value
+	if s.Compress && value.len() >= s.CompressMinSize {
+		compressed, err := compress(value.reveal(), s.CompressLevel)
+		if err != nil {
+			return secret{}, sql.NullString{}, err
+		}
+		if len(compressed) < value.len() {
+			stored = newSecret(compressed)
+			encodings = append(encodings, encodingGzip)
+		}
+	}
+	if s.aead != nil && s.Encryption.encrypts(key) {
+		encrypted, err := sealValue(s.aead, s.keyID, key, stored.reveal())
+		if err != nil {
+			return secret{}, sql.NullString{}, err
+		}
+		stored = newSecret(encrypted)
+		encodings = append(encodings, encodingAESGCM+":"+s.keyID)
+	}
+	if len(encodings) == 0 {
+		return stored, sql.NullString{}, nil
+	}
+	return stored, sql.NullString{String: strings.Join(encodings, "+"), Valid: true}, nil
+}
+
+func compress(value []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeValue reverses encodeValue.
+func (s *SqliteStorage) decodeValue(key string, stored secret, encoding sql.NullString) (secret, error) {
+	if encoding.String == "" {
+		return stored, nil
+	}
+	encodings := strings.Split(encoding.String, "+")
+	value := stored
+	for i := len(encodings) - 1; i >= 0; i-- {
+		name, keyID, bound := strings.Cut(encodings[i], ":")
+		switch name {
+		case encodingGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(value.reveal()))
+			if err != nil {
+				return secret{}, fmt.Errorf("decompressing %s: %v", key, err)
+			}
+			decompressed, err := io.ReadAll(zr)
+			if err != nil {
+				return secret{}, fmt.Errorf("decompressing %s: %v", key, err)
+			}
+			value = newSecret(decompressed)
+		case encodingAESGCM:
+			if s.aead == nil {
+				return secret{}, fmt.Errorf("%s is encrypted but no encryption key is configured", key)
+			}
+			if bound && keyID != s.keyID {
+				return secret{}, fmt.Errorf("%s is encrypted with key %s, but the configured key is %s", key, keyID, s.keyID)
+			}
+			var decrypted []byte
+			var err error
+			if bound {
+				decrypted, err = openValue(s.aead, keyID, key, value.reveal())
+			} else {
+				decrypted, err = decryptArchive(s.aead, value.reveal())
+			}
+			if err != nil {
+				return secret{}, fmt.Errorf("decrypting %s: %v", key, err)
+			}
+			value = newSecret(decrypted)
+		default:
+			return secret{}, fmt.Errorf("%s: unknown value encoding %q", key, encoding.String)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,64 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// versionTracker remembers the version of every key this instance last
+// read or wrote, so that a write based on an outdated version can be
+// recognized as a conflicting concurrent update.
+type versionTracker struct {
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func newVersionTracker() *versionTracker {
+	return &versionTracker{versions: make(map[string]int64)}
+}
+
+func (t *versionTracker) observe(keyHash string, version int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.versions[keyHash] = version
+}
+
+func (t *versionTracker) forget(keyHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.versions, keyHash)
+}
+
+func (t *versionTracker) seen(keyHash string) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	version, ok := t.versions[keyHash]
+	return version, ok
+}
+
+// checkConflict compares the stored version of key with the one this
+// instance last saw. A newer version written by another instance means the
+// write about to happen overwrites an update this instance never saw; the
+// write still wins, but the conflict is logged and counted.
+func (s *SqliteStorage) checkConflict(ctx context.Context, tx *sql.Tx, key, keyHash string) (int64, error) {
+	var version int64
+	var updatedBy sql.NullString
+	err := s.queryRow(ctx, tx, "SELECT version, updated_by FROM certmagic_data WHERE key_hash = ?", []string{key}, keyHash).Scan(&version, &updatedBy)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seen, ok := s.versions.seen(keyHash)
+	if ok && version != seen && updatedBy.String != s.InstanceID {
+		sqliteMetrics.writeConflicts.Inc()
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("conflicting write to %s: version %d by %s was never seen by %s (last seen %d)",
+			key, version, updatedBy.String, s.InstanceID, seen))
+	}
+	return version, nil
+}
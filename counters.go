@@ -0,0 +1,112 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// nameHash identifies the row of name in the tables keyed by a name,
+// such as the counters.
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:20])
+}
+
+// Increment atomically adds delta to the counter name, shared by every
+// instance using the database, and returns its new value and when its
+// window ends. A counter whose window ended starts over from zero with a
+// new window of window. With a zero window the counter never resets and
+// the returned end is the zero time.
+//
+// Together with Allow this coordinates rate limits across the nodes of a
+// cluster, such as the new orders an ACME CA accepts per account.
+func (s *SqliteStorage) Increment(ctx context.Context, name string, delta int64, window time.Duration) (int64, time.Time, error) {
+	if name == "" {
+		return 0, time.Time{}, errors.New("counter name is required")
+	}
+	var value int64
+	var ends sql.NullTime
+	err := s.retryWrite(ctx, "increment", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		var expires sql.NullTime
+		if window > 0 {
+			expires = sql.NullTime{Time: now.Add(window), Valid: true}
+		}
+		// The window is checked against the old expiry in both
+		// assignments, as the expiry is assigned last.
+		query := `INSERT INTO certmagic_counters (key_hash, name, value, expires) VALUES (?, ?, ?, ?)
+	ON CONFLICT(key_hash) DO UPDATE SET
+	value = CASE WHEN certmagic_counters.expires <= ? THEN ? ELSE certmagic_counters.value + ? END,
+	expires = CASE WHEN certmagic_counters.expires <= ? THEN ? ELSE certmagic_counters.expires END`
+		if _, err := s.exec(ctx, tx, query, nil, nameHash(name), name, delta, expires,
+			now, delta, delta, now, expires); err != nil {
+			return err
+		}
+		if err := s.queryRow(ctx, tx, "SELECT value, expires FROM certmagic_counters WHERE key_hash = ?", nil, nameHash(name)).Scan(&value, &ends); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return value, ends.Time, err
+}
+
+// Counter returns the value of the counter name and when its window ends,
+// zero if it doesn't exist or its window ended.
+func (s *SqliteStorage) Counter(ctx context.Context, name string) (int64, time.Time, error) {
+	var value int64
+	var ends sql.NullTime
+	err := s.retry(ctx, "counter", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		err := s.queryRow(ctx, s.readDB(), "SELECT value, expires FROM certmagic_counters WHERE key_hash = ? AND (expires IS NULL OR expires > ?)", nil,
+			nameHash(name), time.Now()).Scan(&value, &ends)
+		if err == sql.ErrNoRows {
+			value, ends = 0, sql.NullTime{}
+			return nil
+		}
+		return err
+	})
+	return value, ends.Time, err
+}
+
+// Allow counts an event against the limit of the counter name per window.
+// If the limit is reached it isn't counted, and Allow returns false and
+// how long until the window ends.
+func (s *SqliteStorage) Allow(ctx context.Context, name string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	value, ends, err := s.Increment(ctx, name, 1, window)
+	if err != nil {
+		return false, 0, err
+	}
+	if value <= limit {
+		return true, 0, nil
+	}
+	// Take the event back unless the window ended meanwhile.
+	err = s.retryWrite(ctx, "increment", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		_, err := s.exec(ctx, s.writeDB(), "UPDATE certmagic_counters SET value = value - 1 WHERE key_hash = ? AND (expires IS NULL OR expires > ?)", nil,
+			nameHash(name), time.Now())
+		return err
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	var retryAfter time.Duration
+	if !ends.IsZero() {
+		retryAfter = time.Until(ends)
+	}
+	return false, retryAfter, nil
+}
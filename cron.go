@@ -0,0 +1,173 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values a field of a cron expression matches,
+// one bit per value.
+type cronField uint64
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// cronSchedule is a parsed cron expression with the five fields minute,
+// hour, day of month, month and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// A restricted day of month or day of week matches if either matches,
+	// as in cron.
+	domStar, dowStar bool
+	loc              *time.Location
+	expr             string
+}
+
+// cronDescriptors are the shorthands accepted in place of the five fields.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a cron expression, such as "30 2 * * 1-5", or one of
+// the descriptors @hourly, @daily, @weekly, @monthly and @yearly. Its
+// times are in loc.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if d, ok := cronDescriptors[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		fields = strings.Fields(d)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+	c := &cronSchedule{
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+		loc:     loc,
+		expr:    expr,
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	// 7 is Sunday too.
+	if c.dow.has(7) {
+		c.dow |= 1
+	}
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and
+// *, each optionally followed by a step (/n). names are accepted in place
+// of the values from min on.
+func parseCronField(field string, min, max int, names []string) (cronField, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var f cronField
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", span)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+// dayMatches reports whether the day of t matches the day of month and day
+// of week fields.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom.has(t.Day()), c.dow.has(int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after after that the schedule matches, or
+// the zero time if it doesn't within five years.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case !c.hour.has(t.Hour()):
+			// Adding minutes rather than building the next hour keeps
+			// moving forward across daylight saving changes.
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
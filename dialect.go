@@ -0,0 +1,427 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// dialect holds what differs between the SQL databases the storage can
+// drive. Queries are written for sqlite with ? placeholders and rewritten
+// by rebind for the other databases.
+type dialect struct {
+	name string
+	// Default database/sql driver name. The driver has to be imported
+	// into the binary for anything but sqlite.
+	driver string
+	// Statements creating the tables, run on every start. Like queries
+	// they are passed through rebind, which quotes the key column. Key
+	// columns compare byte-wise, so prefix scans are case-sensitive as they
+	// are in sqlite.
+	schema []string
+	// Statements creating indexes on columns added by ensureColumn, run
+	// on every start after the columns exist.
+	indexes []string
+	// Query returning the column names of the table given as parameter.
+	columnsQuery string
+	// Query returning size and modified of the key_hash given as
+	// parameter without reading the value.
+	statQuery string
+	// Query returning the size of the database in bytes.
+	sizeQuery string
+	// Expression extracting the first path segment of the key column.
+	prefixExpr string
+	// Statement adding keys, size and stored size, the last three
+	// parameters, to the certmagic_usage row of the prefix, the first.
+	usageUpsert string
+	// Expression comparing the key column byte-wise, used for prefix
+	// range scans on the key index.
+	keyOrder string
+}
+
+var dialects = map[Database]*dialect{
+	Sqlite: {
+		name:   "sqlite",
+		driver: "sqlite",
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS
+	certmagic_data (
+  	key_hash char(40) NOT NULL,
+  	key TEXT NOT NULL,
+  	value BLOB,
+  	modified TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  	PRIMARY KEY (key_hash)
+	)`,
+			`
+  	CREATE TABLE IF NOT EXISTS certmagic_locks (
+  	key_hash char(40) NOT NULL,
+  	key TEXT NOT NULL,
+  	expires TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  	PRIMARY KEY (key_hash)
+	)`,
+			// Replaced by certmagic_data_modified, which only fires for value
+			// changes made outside of Store, which always bumps the version
+			// and sets modified itself.
+			`DROP TRIGGER IF EXISTS Trg_LastUpdated`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_data_modified
+	AFTER UPDATE OF value ON certmagic_data
+	FOR EACH ROW WHEN NEW.version IS OLD.version
+	BEGIN
+	UPDATE certmagic_data SET modified = CURRENT_TIMESTAMP WHERE key_hash = NEW.key_hash;
+	END
+	`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_key ON certmagic_data (key)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_meta (
+	name VARCHAR(255) NOT NULL,
+	value TEXT,
+	PRIMARY KEY (name)
+	)`,
+			// The change feed: the sequence number of the last change of
+			// every key, and when it was deleted if it was.
+			`CREATE TABLE IF NOT EXISTS certmagic_changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	key TEXT NOT NULL,
+	deleted_at TEXT
+	)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_changes_key ON certmagic_changes (key)`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_changes_insert
+	AFTER INSERT ON certmagic_data
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key = NEW.key;
+	INSERT INTO certmagic_changes (key) VALUES (NEW.key);
+	END
+	`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_changes_update
+	AFTER UPDATE OF key, value, modified ON certmagic_data
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key IN (OLD.key, NEW.key);
+	INSERT INTO certmagic_changes (key, deleted_at) SELECT OLD.key, strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE OLD.key IS NOT NEW.key;
+	INSERT INTO certmagic_changes (key) VALUES (NEW.key);
+	END
+	`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_changes_delete
+	AFTER DELETE ON certmagic_data
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key = OLD.key;
+	INSERT INTO certmagic_changes (key, deleted_at) VALUES (OLD.key, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+	END
+	`,
+			// Keys written before the change feed existed.
+			`INSERT INTO certmagic_changes (key)
+	SELECT key FROM certmagic_data WHERE key NOT IN (SELECT key FROM certmagic_changes)`,
+			// Remote changes discarded by replication because the local
+			// key was changed later.
+			`CREATE TABLE IF NOT EXISTS certmagic_conflicts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	key TEXT NOT NULL,
+	source TEXT NOT NULL,
+	local_modified TIMESTAMP,
+	remote_modified TIMESTAMP,
+	remote_deleted INTEGER NOT NULL DEFAULT 0,
+	recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+			// The buckets of the KV API, apart from the certmagic data.
+			`CREATE TABLE IF NOT EXISTS certmagic_kv (
+	key_hash char(40) NOT NULL,
+	bucket VARCHAR(255) NOT NULL,
+	key TEXT NOT NULL,
+	value BLOB,
+	modified TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_kv_key ON certmagic_kv (bucket, key)`,
+			// The counters of Increment and Allow.
+			`CREATE TABLE IF NOT EXISTS certmagic_counters (
+	key_hash char(40) NOT NULL,
+	name TEXT NOT NULL,
+	value INTEGER NOT NULL DEFAULT 0,
+	expires TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			// The on-demand TLS patterns of SetDomainPolicy.
+			`CREATE TABLE IF NOT EXISTS certmagic_domain_policies (
+	key_hash char(40) NOT NULL,
+	pattern VARCHAR(255) NOT NULL,
+	action VARCHAR(16) NOT NULL,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			// The change feed records the policies under
+			// domainPolicyFeedPrefix and their pattern.
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_domain_policies_insert
+	AFTER INSERT ON certmagic_domain_policies
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key = ':domain_policies/' || NEW.pattern;
+	INSERT INTO certmagic_changes (key) VALUES (':domain_policies/' || NEW.pattern);
+	END
+	`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_domain_policies_update
+	AFTER UPDATE ON certmagic_domain_policies
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key = ':domain_policies/' || NEW.pattern;
+	INSERT INTO certmagic_changes (key) VALUES (':domain_policies/' || NEW.pattern);
+	END
+	`,
+			`
+	CREATE TRIGGER IF NOT EXISTS certmagic_domain_policies_delete
+	AFTER DELETE ON certmagic_domain_policies
+	BEGIN
+	DELETE FROM certmagic_changes WHERE key = ':domain_policies/' || OLD.pattern;
+	INSERT INTO certmagic_changes (key, deleted_at) VALUES (':domain_policies/' || OLD.pattern, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+	END
+	`,
+			// Policies set before they were in the change feed.
+			`INSERT INTO certmagic_changes (key)
+	SELECT ':domain_policies/' || pattern FROM certmagic_domain_policies
+	WHERE ':domain_policies/' || pattern NOT IN (SELECT key FROM certmagic_changes)`,
+			// The keys and value sizes of every prefix, see addUsage.
+			`CREATE TABLE IF NOT EXISTS certmagic_usage (
+	prefix TEXT NOT NULL,
+	keys INTEGER NOT NULL DEFAULT 0,
+	size INTEGER NOT NULL DEFAULT 0,
+	stored_size INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (prefix)
+	)`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS certmagic_data_stat ON certmagic_data (key_hash, size, modified)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_sizes ON certmagic_data (size, stored_size)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_kind ON certmagic_data (kind)`,
+		},
+		columnsQuery: "SELECT name FROM pragma_table_info(?)",
+		// The primary key index would otherwise be preferred over the
+		// covering one.
+		statQuery:  "select size, modified from certmagic_data INDEXED BY certmagic_data_stat where key_hash = ?",
+		sizeQuery:  "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+		prefixExpr: "CASE WHEN instr(key, '/') > 0 THEN substr(key, 1, instr(key, '/') - 1) ELSE key END",
+		usageUpsert: `INSERT INTO certmagic_usage (prefix, keys, size, stored_size) VALUES (?, ?, ?, ?)
+	ON CONFLICT (prefix) DO UPDATE SET keys = certmagic_usage.keys + excluded.keys, size = certmagic_usage.size + excluded.size, stored_size = certmagic_usage.stored_size + excluded.stored_size`,
+		keyOrder: "key",
+	},
+	Postgres: {
+		name:   "postgres",
+		driver: "postgres",
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS certmagic_data (
+	key_hash char(40) NOT NULL,
+	key TEXT NOT NULL,
+	value BYTEA,
+	modified TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_locks (
+	key_hash char(40) NOT NULL,
+	key TEXT NOT NULL,
+	expires TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_key ON certmagic_data ((key COLLATE "C"))`,
+			`CREATE TABLE IF NOT EXISTS certmagic_meta (
+	name VARCHAR(255) NOT NULL,
+	value TEXT,
+	PRIMARY KEY (name)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_kv (
+	key_hash char(40) NOT NULL,
+	bucket VARCHAR(255) NOT NULL,
+	key TEXT NOT NULL,
+	value BYTEA,
+	modified TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	expires TIMESTAMPTZ,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_kv_key ON certmagic_kv (bucket, (key COLLATE "C"))`,
+			`CREATE TABLE IF NOT EXISTS certmagic_counters (
+	key_hash char(40) NOT NULL,
+	name TEXT NOT NULL,
+	value BIGINT NOT NULL DEFAULT 0,
+	expires TIMESTAMPTZ,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_domain_policies (
+	key_hash char(40) NOT NULL,
+	pattern VARCHAR(255) NOT NULL,
+	action VARCHAR(16) NOT NULL,
+	created TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_usage (
+	prefix TEXT NOT NULL,
+	keys BIGINT NOT NULL DEFAULT 0,
+	size BIGINT NOT NULL DEFAULT 0,
+	stored_size BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (prefix)
+	)`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS certmagic_data_stat ON certmagic_data (key_hash) INCLUDE (size, modified)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_sizes ON certmagic_data (size, stored_size)`,
+			`CREATE INDEX IF NOT EXISTS certmagic_data_kind ON certmagic_data (kind)`,
+		},
+		columnsQuery: "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?",
+		statQuery:    "select size, modified from certmagic_data where key_hash = ?",
+		sizeQuery:    "SELECT pg_database_size(current_database())",
+		prefixExpr:   "split_part(key, '/', 1)",
+		usageUpsert: `INSERT INTO certmagic_usage (prefix, keys, size, stored_size) VALUES (?, ?, ?, ?)
+	ON CONFLICT (prefix) DO UPDATE SET keys = certmagic_usage.keys + excluded.keys, size = certmagic_usage.size + excluded.size, stored_size = certmagic_usage.stored_size + excluded.stored_size`,
+		keyOrder: `key COLLATE "C"`,
+	},
+	MySQL: {
+		name:   "mysql",
+		driver: "mysql",
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS certmagic_data (
+	key_hash char(40) NOT NULL,
+	key TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	value LONGBLOB,
+	modified TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (key_hash),
+	INDEX certmagic_data_key (key(255))
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_locks (
+	key_hash char(40) NOT NULL,
+	key TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	expires TIMESTAMP(6) NULL,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_meta (
+	name VARCHAR(255) NOT NULL,
+	value TEXT,
+	PRIMARY KEY (name)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_kv (
+	key_hash char(40) NOT NULL,
+	bucket VARCHAR(255) NOT NULL,
+	key TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	value LONGBLOB,
+	modified TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+	expires TIMESTAMP(6) NULL,
+	PRIMARY KEY (key_hash),
+	INDEX certmagic_kv_key (bucket, key(255))
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_counters (
+	key_hash char(40) NOT NULL,
+	name TEXT NOT NULL,
+	value BIGINT NOT NULL DEFAULT 0,
+	expires TIMESTAMP(6) NULL,
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_domain_policies (
+	key_hash char(40) NOT NULL,
+	pattern VARCHAR(255) NOT NULL,
+	action VARCHAR(16) NOT NULL,
+	created TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (key_hash)
+	)`,
+			`CREATE TABLE IF NOT EXISTS certmagic_usage (
+	prefix VARCHAR(768) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	keys BIGINT NOT NULL DEFAULT 0,
+	size BIGINT NOT NULL DEFAULT 0,
+	stored_size BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (prefix)
+	)`,
+		},
+		columnsQuery: "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?",
+		statQuery:    "select size, modified from certmagic_data where key_hash = ?",
+		sizeQuery:    "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()",
+		prefixExpr:   "substring_index(key, '/', 1)",
+		usageUpsert: `INSERT INTO certmagic_usage (prefix, keys, size, stored_size) VALUES (?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE keys = keys + VALUES(keys), size = size + VALUES(size), stored_size = stored_size + VALUES(stored_size)`,
+		keyOrder: "key",
+	},
+}
+
+// parseDialect maps the dialect option to a Database.
+func parseDialect(name string) (Database, error) {
+	for db, d := range dialects {
+		if d.name == name {
+			return db, nil
+		}
+	}
+	return Sqlite, fmt.Errorf("unsupported dialect: %s", name)
+}
+
+var (
+	keyColumnRE = regexp.MustCompile(`\bkeys?\b`)
+	upsertRE    = regexp.MustCompile(`(?i)ON CONFLICT\s*\(key_hash\)\s*DO UPDATE\s+SET`)
+)
+
+// rebind rewrites a query written for sqlite for the dialect: numbered
+// placeholders for Postgres, quoted key and keys columns and ON DUPLICATE
+// KEY upserts for MySQL. String literals, such as the LIKE patterns of
+// kindExpr, are kept as they are.
+func (d *dialect) rebind(query string) string {
+	switch d.name {
+	case "postgres":
+		n := 0
+		return outsideLiterals(query, func(part string) string {
+			var b strings.Builder
+			for _, r := range part {
+				if r == '?' {
+					n++
+					b.WriteString("$" + strconv.Itoa(n))
+					continue
+				}
+				b.WriteRune(r)
+			}
+			return b.String()
+		})
+	case "mysql":
+		return outsideLiterals(query, func(part string) string {
+			part = upsertRE.ReplaceAllString(part, "ON DUPLICATE KEY UPDATE")
+			return keyColumnRE.ReplaceAllString(part, "`$0`")
+		})
+	}
+	return query
+}
+
+// outsideLiterals applies rewrite to the parts of query outside single
+// quoted string literals. A doubled quote inside a literal ends it and
+// starts the next one, with nothing to rewrite between them.
+func outsideLiterals(query string, rewrite func(string) string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(query, '\'')
+		if start < 0 {
+			b.WriteString(rewrite(query))
+			return b.String()
+		}
+		b.WriteString(rewrite(query[:start]))
+		end := strings.IndexByte(query[start+1:], '\'')
+		if end < 0 {
+			b.WriteString(query[start:])
+			return b.String()
+		}
+		end += start + 2
+		b.WriteString(query[start:end])
+		query = query[end:]
+	}
+}
+
+// prefixRange returns a condition, and its arguments, matching every key
+// starting with prefix as a range scan the key index can serve: keys at
+// least prefix and below the smallest string greater than all of them.
+func (d *dialect) prefixRange(prefix string) (string, []any) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == utf8.MaxRune {
+			continue
+		}
+		next := runes[i] + 1
+		if next >= 0xd800 && next <= 0xdfff {
+			next = 0xe000
+		}
+		upper := string(append(runes[:i:i], next))
+		return d.keyOrder + " >= ? AND " + d.keyOrder + " < ?", []any{prefix, upper}
+	}
+	return d.keyOrder + " >= ?", []any{prefix}
+}
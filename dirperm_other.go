@@ -0,0 +1,6 @@
+//go:build !windows
+
+package storagesqlite
+
+// restrictDir is a no-op where the mode of the new directory restricts it.
+func restrictDir(dir string) error { return nil }
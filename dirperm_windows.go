@@ -0,0 +1,25 @@
+//go:build windows
+
+package storagesqlite
+
+import "golang.org/x/sys/windows"
+
+// restrictDirSDDL grants full access to the owner, SYSTEM and
+// administrators only, inherited by the files created in the directory.
+const restrictDirSDDL = "D:P(A;OICI;FA;;;OW)(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+
+// restrictDir replaces the permissions a new directory inherited from its
+// parent, which file modes don't control on Windows, with an ACL granting
+// access to the owner only.
+func restrictDir(dir string) error {
+	sd, err := windows.SecurityDescriptorFromString(restrictDirSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
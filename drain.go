@@ -0,0 +1,203 @@
+package storagesqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var errClosing = errors.New("storage is shutting down")
+
+// drainer counts the operations in progress and the locks held by a
+// storage, so that Close can wait for them before closing the database,
+// and the database handles can be replaced while none is running.
+type drainer struct {
+	mu      sync.Mutex
+	closing bool
+	ops     int
+	locks   int
+	// closed once closing and no operation or lock is left.
+	idle chan struct{}
+	// Operations waiting for the writer, which don't use the handles yet.
+	parked int
+	// Set while the handles are replaced, new operations wait for resumed.
+	paused  bool
+	resumed *sync.Cond
+	// closed once paused and no operation but the parked ones is left.
+	quiet chan struct{}
+}
+
+func newDrainer() *drainer {
+	d := &drainer{idle: make(chan struct{})}
+	d.resumed = sync.NewCond(&d.mu)
+	return d
+}
+
+// enter registers an operation. Once the storage is closing only unlocks
+// are accepted, so that held locks can still be released. While paused,
+// operations wait until resume.
+func (d *drainer) enter(operation string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.paused && !d.closing {
+		d.resumed.Wait()
+	}
+	if d.closing && operation != "unlock" {
+		return errClosing
+	}
+	d.ops++
+	return nil
+}
+
+func (d *drainer) leave() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ops--
+	d.checkIdle()
+	d.checkQuiet()
+}
+
+// park marks an operation as waiting for the writer, which whoever pauses
+// holds, so that pause doesn't wait for it.
+func (d *drainer) park() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.parked++
+	d.checkQuiet()
+}
+
+func (d *drainer) unpark() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.parked--
+}
+
+func (d *drainer) checkQuiet() {
+	if !d.paused || d.ops > d.parked {
+		return
+	}
+	select {
+	case <-d.quiet:
+	default:
+		close(d.quiet)
+	}
+}
+
+// pause holds new operations and waits until the running ones finished,
+// except those parked, or timeout passed. It returns the operations left.
+// The caller has to hold the writer and must not be an operation itself.
+func (d *drainer) pause(timeout time.Duration) int {
+	d.mu.Lock()
+	for d.paused {
+		d.resumed.Wait()
+	}
+	d.paused = true
+	d.quiet = make(chan struct{})
+	d.checkQuiet()
+	quiet := d.quiet
+	d.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-quiet:
+	case <-timer.C:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ops - d.parked
+}
+
+// resume lets the operations held by pause continue.
+func (d *drainer) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = false
+	d.resumed.Broadcast()
+}
+
+func (d *drainer) acquired() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.locks++
+}
+
+func (d *drainer) released() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.locks > 0 {
+		d.locks--
+	}
+	d.checkIdle()
+}
+
+func (d *drainer) checkIdle() {
+	if !d.closing || d.ops > 0 || d.locks > 0 {
+		return
+	}
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// drain stops accepting operations and waits until the running ones
+// finished and the held locks were released, or timeout passed. It returns
+// the operations and locks left.
+func (d *drainer) drain(timeout time.Duration) (ops, locks int) {
+	d.mu.Lock()
+	d.closing = true
+	d.checkIdle()
+	d.resumed.Broadcast()
+	d.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.idle:
+	case <-timer.C:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ops, d.locks
+}
+
+// pauseOperations holds new operations and waits up to drain_timeout for
+// the running ones, so that the database handles can be replaced. The
+// caller holds the writer, if there is a write queue, so that writes wait
+// for it instead. resume lets the operations continue.
+func (s *SqliteStorage) pauseOperations() (resume func()) {
+	if ops := s.drain.pause(time.Duration(s.DrainTimeout)); ops > 0 {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("replacing the database handles with %d operations running after waiting %s",
+			ops, time.Duration(s.DrainTimeout)))
+	}
+	return s.drain.resume
+}
+
+// shutdown drains the storage and checkpoints the WAL of a sqlite
+// database, so that the next process opening it neither waits for locks
+// of this one nor replays its WAL.
+func (s *SqliteStorage) shutdown() {
+	start := time.Now()
+	ops, locks := s.drain.drain(time.Duration(s.DrainTimeout))
+	if ops > 0 || locks > 0 {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("closing with %d operations running and %d locks held after waiting %s",
+			ops, locks, time.Duration(s.DrainTimeout)))
+	} else {
+		caddy.Log().Named(logStorage).Debug(fmt.Sprintf("drained in %s", time.Since(start)))
+	}
+
+	if s.dialect != dialects[Sqlite] {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.QueryTimeout*time.Second)
+	defer cancel()
+	if _, err := s.exec(ctx, s.writeDB(), "PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("checkpointing the WAL on close: %v", err))
+	}
+}
@@ -0,0 +1,134 @@
+package storagesqlite
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// encodingAESGCM marks values stored encrypted in the encoding column. It
+// is followed by ":" and the ID of the key for values bound to their key
+// name, see sealValue. Values encrypted before key IDs were recorded have
+// no ID and are not bound.
+const encodingAESGCM = "aes-gcm"
+
+// EncryptionConfig configures encryption of stored values.
+type EncryptionConfig struct {
+	// Base64 encoded AES key (16, 24 or 32 bytes), or file:<path> or
+	// env:<name> to read it from a file or environment variable.
+	Key string `json:"key,omitempty"`
+	// ID recorded with every value encrypted with Key. Defaults to the
+	// first 8 hex digits of the SHA-256 of the key.
+	KeyID string `json:"key_id,omitempty"`
+	// Store key names encrypted, and look keys up by their HMAC instead of
+	// their MD5, for when the names of the certificates are confidential.
+	// List and DeletePrefix then read every key, and the stats can't group
+	// keys by prefix in SQL. Turning it on or off rewrites every key on the
+	// next start, and starts the change feed over. The key can't be
+	// changed while it is on.
+	HideKeys bool `json:"hide_keys,omitempty"`
+	// Rules deciding which values are encrypted. The first rule matching a
+	// key applies.
+	Rules []EncryptionRule `json:"rules,omitempty"`
+	// Policy for keys no rule matches, encrypt (default) or plaintext.
+	Default string `json:"default,omitempty"`
+}
+
+// EncryptionRule applies Policy to every key matching Match, a pattern in
+// which * stands for any sequence of characters, including slashes. For
+// example */keys/* matches keys with a keys segment and *.key matches
+// every private key.
+type EncryptionRule struct {
+	Match  string `json:"match,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+const (
+	policyEncrypt   = "encrypt"
+	policyPlaintext = "plaintext"
+)
+
+func validPolicy(policy string) bool {
+	return policy == policyEncrypt || policy == policyPlaintext
+}
+
+// aead checks the configuration and returns the cipher for the key.
+func (e *EncryptionConfig) aead() (cipher.AEAD, error) {
+	if e.Default != "" && !validPolicy(e.Default) {
+		return nil, fmt.Errorf("unknown encryption policy: %s", e.Default)
+	}
+	for _, rule := range e.Rules {
+		if !validPolicy(rule.Policy) {
+			return nil, fmt.Errorf("unknown encryption policy for %s: %s", rule.Match, rule.Policy)
+		}
+	}
+	if strings.ContainsAny(e.KeyID, "+ ") {
+		return nil, fmt.Errorf("invalid key_id %q", e.KeyID)
+	}
+	return newAEAD(e.Key)
+}
+
+// keyID returns the ID recorded with the values encrypted with the key.
+func (e *EncryptionConfig) keyID() string {
+	if e.KeyID != "" {
+		return e.KeyID
+	}
+	key, _ := base64.StdEncoding.DecodeString(e.Key)
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// valueAD is the additional data authenticated with the value of key
+// encrypted with the key keyID, so that a value copied to another key or
+// encrypted with another key fails to decrypt.
+func valueAD(keyID, key string) []byte {
+	ad := append([]byte{}, encryptedMagic...)
+	ad = append(ad, keyID...)
+	ad = append(ad, 0)
+	return append(ad, key...)
+}
+
+// sealValue encrypts the value of key like encryptArchive, binding it to
+// key and keyID.
+func sealValue(aead cipher.AEAD, keyID, key string, plaintext []byte) ([]byte, error) {
+	return seal(aead, plaintext, valueAD(keyID, key))
+}
+
+// openValue reverses sealValue.
+func openValue(aead cipher.AEAD, keyID, key string, stored []byte) ([]byte, error) {
+	return open(aead, stored, valueAD(keyID, key))
+}
+
+// encrypts reports whether the value of key is to be encrypted.
+func (e *EncryptionConfig) encrypts(key string) bool {
+	for _, rule := range e.Rules {
+		if matchPattern(rule.Match, key) {
+			return rule.Policy == policyEncrypt
+		}
+	}
+	return e.Default != policyPlaintext
+}
+
+// matchPattern reports whether key matches pattern, in which * matches any
+// sequence of characters.
+func matchPattern(pattern, key string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == key
+	}
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, part)
+		if i < 0 {
+			return false
+		}
+		key = key[i+len(part):]
+	}
+	return strings.HasSuffix(key, parts[len(parts)-1])
+}
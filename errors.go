@@ -0,0 +1,100 @@
+package storagesqlite
+
+import (
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Kinds of errors storage operations fail with, to test for with
+// errors.Is. Errors of the sqlite driver are matched by their result code,
+// Postgres errors of lib/pq and pgx by their SQLSTATE. Errors of the MySQL
+// driver don't expose their code through an interface and match none of
+// the kinds.
+var (
+	// The key is locked by another owner, or the database by another
+	// connection (SQLITE_BUSY, SQLITE_LOCKED, Postgres lock_not_available
+	// and deadlock_detected).
+	ErrLocked = errors.New("locked")
+	// The database reached its max_page_count or the disk is full
+	// (SQLITE_FULL, Postgres disk_full).
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// A value failed its checksum, or the database file is damaged
+	// (SQLITE_CORRUPT, SQLITE_NOTADB, Postgres data_corrupted and
+	// index_corrupted).
+	ErrCorrupt = errors.New("corrupt")
+	// The write rate limit of the key's prefix is exhausted.
+	ErrThrottled = errors.New("throttled")
+	// The storage is degraded to read-only, or the database can't be
+	// written to (SQLITE_READONLY, Postgres read_only_sql_transaction).
+	ErrReadOnly = errors.New("read-only")
+	// The circuit breaker is open and the database was not queried.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// OpError is returned by storage operations. It names the operation and
+// wraps the error it failed with, such as a driver error.
+type OpError struct {
+	// Operation that failed, such as load, store or lock.
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// postgresKinds maps the SQLSTATE of Postgres errors to the error kinds.
+var postgresKinds = map[string]error{
+	"55P03": ErrLocked,
+	"40P01": ErrLocked,
+	"53100": ErrQuotaExceeded,
+	"XX001": ErrCorrupt,
+	"XX002": ErrCorrupt,
+	"25006": ErrReadOnly,
+}
+
+// sqlStateError is implemented by the errors of lib/pq and pgx.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// Is matches a wrapped sqlite or Postgres driver error against the error
+// kinds.
+func (e *OpError) Is(target error) bool {
+	var stateErr sqlStateError
+	if errors.As(e.Err, &stateErr) {
+		kind, ok := postgresKinds[stateErr.SQLState()]
+		return ok && target == kind
+	}
+	var sqliteErr *sqlite.Error
+	if !errors.As(e.Err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return target == ErrLocked
+	case sqlite3.SQLITE_FULL:
+		return target == ErrQuotaExceeded
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+		return target == ErrCorrupt
+	case sqlite3.SQLITE_READONLY:
+		return target == ErrReadOnly
+	}
+	return false
+}
+
+// wrapError wraps err in an *OpError for operation, unless it is one
+// already.
+func wrapError(operation string, err error) error {
+	var opErr *OpError
+	if err == nil || errors.As(err, &opErr) {
+		return err
+	}
+	return &OpError{Op: operation, Err: err}
+}
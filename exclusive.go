@@ -0,0 +1,19 @@
+package storagesqlite
+
+// exclusiveDSN turns a sqlite DSN into a URI opening the database in
+// exclusive locking mode. Transactions begin with an exclusive lock, so
+// that the first one, setting the schema up, takes the lock the
+// connection then keeps. In-memory databases are returned unchanged.
+func exclusiveDSN(dsn string) string {
+	if dsn == "" || dsn == ":memory:" {
+		return dsn
+	}
+	path, query, err := splitDSN(dsn)
+	if err != nil {
+		return dsn
+	}
+	query.Add("_pragma", "locking_mode(EXCLUSIVE)")
+	query.Add("_pragma", "temp_store(MEMORY)")
+	query.Set("_txlock", "exclusive")
+	return "file:" + path + "?" + query.Encode()
+}
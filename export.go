@@ -0,0 +1,150 @@
+package storagesqlite
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// exportTar writes every key starting with prefix as a file of a gzipped
+// tarball, using the modification time of the key as the file's mtime. The
+// keys are read from a single ReadView, so the archive is consistent even
+// while writes continue.
+func (s *SqliteStorage) exportTar(ctx context.Context, w io.Writer, prefix string) (int, error) {
+	var exported int
+	err := s.View(ctx, func(v *ReadView) error {
+		keys, err := v.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, key := range keys {
+			value, info, err := v.LoadWithInfo(ctx, key)
+			if err != nil {
+				return err
+			}
+			hdr := &tar.Header{
+				Name:    key,
+				Mode:    0o600,
+				Size:    int64(len(value)),
+				ModTime: info.Modified,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(value); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		exported = len(keys)
+		return gz.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return exported, nil
+}
+
+// importTar stores every regular file of a gzipped tarball under its path.
+func (s *SqliteStorage) importTar(ctx context.Context, r io.Reader) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	imported := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("reading archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		value, err := io.ReadAll(tr)
+		if err != nil {
+			return imported, fmt.Errorf("reading archive: %v", err)
+		}
+		if err := s.StoreWithModTime(ctx, hdr.Name, value, hdr.ModTime); err != nil {
+			return imported, fmt.Errorf("storing %s: %v", hdr.Name, err)
+		}
+		imported++
+	}
+}
+
+// jsonEntry is one line of the newline-delimited JSON format.
+type jsonEntry struct {
+	Key         string    `json:"key"`
+	Modified    time.Time `json:"modified"`
+	ValueBase64 string    `json:"value_base64"`
+}
+
+// exportJSON writes one JSON object per key starting with prefix, read
+// from a single ReadView.
+func (s *SqliteStorage) exportJSON(ctx context.Context, w io.Writer, prefix string) (int, error) {
+	var exported int
+	err := s.View(ctx, func(v *ReadView) error {
+		keys, err := v.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		for _, key := range keys {
+			value, info, err := v.LoadWithInfo(ctx, key)
+			if err != nil {
+				return err
+			}
+			entry := jsonEntry{
+				Key:         key,
+				Modified:    info.Modified,
+				ValueBase64: base64.StdEncoding.EncodeToString(value),
+			}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		exported = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return exported, nil
+}
+
+// importJSON stores every entry written by exportJSON.
+func (s *SqliteStorage) importJSON(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	imported := 0
+	for {
+		var entry jsonEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("reading entry %d: %v", imported+1, err)
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.ValueBase64)
+		if err != nil {
+			return imported, fmt.Errorf("decoding %s: %v", entry.Key, err)
+		}
+		if err := s.StoreWithModTime(ctx, entry.Key, value, entry.Modified); err != nil {
+			return imported, fmt.Errorf("storing %s: %v", entry.Key, err)
+		}
+		imported++
+	}
+}
@@ -0,0 +1,46 @@
+package storagesqlite
+
+import (
+	"database/sql"
+	"expvar"
+	"sync"
+)
+
+// expvars holds the counters published under "storage_sqlite" when a
+// storage enables expvar publication.
+var expvars = struct {
+	init       sync.Once
+	operations *expvar.Map
+	errors     *expvar.Map
+}{}
+
+func publishExpvars() {
+	expvars.init.Do(func() {
+		root := expvar.NewMap("storage_sqlite")
+		expvars.operations = new(expvar.Map).Init()
+		expvars.errors = new(expvar.Map).Init()
+		root.Set("operations", expvars.operations)
+		root.Set("errors", expvars.errors)
+		root.Set("pools", expvar.Func(func() any {
+			pools := make(map[string]sql.DBStats)
+			for _, s := range registeredStorages() {
+				if s.Expvar {
+					pools[s.Dsn] = s.writeDB().Stats()
+				}
+			}
+			return pools
+		}))
+	})
+}
+
+// countOperation records the outcome of operation if expvar publication
+// is enabled.
+func (s *SqliteStorage) countOperation(operation string, err error) {
+	if !s.Expvar {
+		return
+	}
+	expvars.operations.Add(operation, 1)
+	if err != nil {
+		expvars.errors.Add(operation, 1)
+	}
+}
@@ -0,0 +1,140 @@
+package storagesqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Names of the Caddy events emitted when the storage switches to read-only
+// and back.
+const (
+	degradedEvent  = "sqlite_storage_degraded"
+	recoveredEvent = "sqlite_storage_recovered"
+)
+
+// metaWriteProbe names the certmagic_meta row a read-only storage writes
+// to find out whether writes succeed again.
+const metaWriteProbe = "write_probe"
+
+// FallbackConfig switches the storage to read-only after writes failed
+// persistently, for example on a read-only file system or a full disk.
+// Loads keep serving the existing certificates while writes fail fast
+// with ErrReadOnly.
+type FallbackConfig struct {
+	// Consecutive failed writes that switch to read-only. Defaults to 3.
+	Failures int `json:"failures,omitempty"`
+	// How often a read-only storage tries to write again. Defaults to 1m.
+	RetryInterval caddy.Duration `json:"retry_interval,omitempty"`
+}
+
+func (c *FallbackConfig) setDefaults() {
+	if c.Failures == 0 {
+		c.Failures = 3
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = caddy.Duration(time.Minute)
+	}
+}
+
+// fallback tracks the failed writes and read-only state of a storage.
+type fallback struct {
+	mu       sync.Mutex
+	failures int
+	// time the storage became read-only, zero while writable.
+	since time.Time
+}
+
+// readOnlySince returns when the storage switched to read-only, or the zero
+// time if it is writable.
+func (s *SqliteStorage) readOnlySince() time.Time {
+	s.fallback.mu.Lock()
+	defer s.fallback.mu.Unlock()
+	return s.fallback.since
+}
+
+// isWriteFailure reports whether err means the database can't be written
+// to at all, as opposed to a failure of a single write.
+func isWriteFailure(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_READONLY, sqlite3.SQLITE_FULL, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_CANTOPEN:
+		return true
+	}
+	return false
+}
+
+// noteWrite counts consecutive write failures and switches to read-only
+// once there were too many.
+func (s *SqliteStorage) noteWrite(err error) {
+	if s.ReadOnlyFallback == nil {
+		return
+	}
+	f := s.fallback
+	f.mu.Lock()
+	if !isWriteFailure(err) {
+		f.failures = 0
+		f.mu.Unlock()
+		return
+	}
+	f.failures++
+	if f.failures < s.ReadOnlyFallback.Failures || !f.since.IsZero() {
+		f.mu.Unlock()
+		return
+	}
+	f.since = time.Now()
+	failures := f.failures
+	f.mu.Unlock()
+
+	sqliteMetrics.readOnly.Set(1)
+	caddy.Log().Named(logStorage).Error(fmt.Sprintf("switching to read-only after %d failed writes: %v", failures, err))
+	s.emit(degradedEvent, map[string]any{
+		"failures": failures,
+		"error":    err.Error(),
+	})
+}
+
+// writeProbeJob tries to write, every retry_interval, while the storage is
+// read-only, and switches back once a write succeeds. It returns 1 if it
+// did. A failed probe is not a failure of the job, the storage being
+// read-only is reported already.
+func (s *SqliteStorage) writeProbeJob(ctx context.Context) (int64, error) {
+	if s.readOnlySince().IsZero() || s.probeWrite(ctx) != nil {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// probeWrite makes a single write past the read-only check and leaves
+// read-only mode if it succeeds.
+func (s *SqliteStorage) probeWrite(ctx context.Context) error {
+	err := s.runWrite(ctx, "write_probe", s.writeMeta(metaWriteProbe, time.Now().UTC().Format(time.RFC3339Nano)))
+	if err != nil {
+		caddy.Log().Named(logStorage).Debug(fmt.Sprintf("storage is still read-only: %v", err))
+		return err
+	}
+
+	f := s.fallback
+	f.mu.Lock()
+	since := f.since
+	f.since, f.failures = time.Time{}, 0
+	f.mu.Unlock()
+	if since.IsZero() {
+		return nil
+	}
+	sqliteMetrics.readOnly.Set(0)
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("writes succeed again after %s read-only", time.Since(since).Round(time.Second)))
+	s.emit(recoveredEvent, map[string]any{
+		"read_only_seconds": time.Since(since).Seconds(),
+	})
+	return nil
+}
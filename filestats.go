@@ -0,0 +1,119 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metaLastVacuum names the certmagic_meta row holding the time of the
+// last successful vacuum.
+const metaLastVacuum = "last_vacuum"
+
+// FileStats describes the files and pages of a sqlite database.
+type FileStats struct {
+	FileSize      int64 `json:"file_size"`
+	WalSize       int64 `json:"wal_size"`
+	PageCount     int64 `json:"page_count"`
+	FreelistPages int64 `json:"freelist_pages"`
+}
+
+// fileStats reads the page counts of a sqlite database and the sizes of
+// its main file and WAL.
+func (s *SqliteStorage) fileStats(ctx context.Context) (FileStats, error) {
+	path := dbFilePath(s.Dsn)
+	stats := FileStats{
+		FileSize: fileSize(path),
+		WalSize:  fileSize(path + "-wal"),
+	}
+	err := s.retry(ctx, "file_stats", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		return s.readDB().QueryRowContext(ctx, "SELECT page_count, freelist_count FROM pragma_page_count(), pragma_freelist_count()").
+			Scan(&stats.PageCount, &stats.FreelistPages)
+	})
+	return stats, err
+}
+
+// lastVacuum returns the time of the last successful vacuum, or nil if
+// there was none.
+func (s *SqliteStorage) lastVacuum() *time.Time {
+	if v := s.background.lastVacuum.Load(); v != 0 {
+		t := time.Unix(0, v)
+		return &t
+	}
+	return nil
+}
+
+// loadLastVacuum restores the time of the last vacuum recorded by an
+// earlier run.
+func (s *SqliteStorage) loadLastVacuum(ctx context.Context) error {
+	value, err := s.meta(ctx, metaLastVacuum)
+	if err != nil || value == "" {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	s.background.lastVacuum.Store(t.UnixNano())
+	return nil
+}
+
+// recordVacuum remembers now as the time of the last vacuum.
+func (s *SqliteStorage) recordVacuum(ctx context.Context) error {
+	now := time.Now()
+	s.background.lastVacuum.Store(now.UnixNano())
+	return s.setMeta(ctx, metaLastVacuum, now.UTC().Format(time.RFC3339Nano))
+}
+
+// fileCollector exports FileStats and the last vacuum of every open sqlite
+// storage, read when the metrics are scraped.
+type fileCollector struct {
+	fileSize, walSize, pages, freelistPages, lastVacuum *prometheus.Desc
+}
+
+func newFileCollector(ns, sub string) *fileCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(ns, sub, name), help, []string{"database"}, nil)
+	}
+	return &fileCollector{
+		fileSize:      desc("file_size_bytes", "Size of the main database file."),
+		walSize:       desc("wal_size_bytes", "Size of the write-ahead log."),
+		pages:         desc("pages", "Number of pages in the database."),
+		freelistPages: desc("freelist_pages", "Number of unused pages a vacuum would reclaim."),
+		lastVacuum:    desc("last_vacuum_timestamp_seconds", "Unix time of the last successful vacuum."),
+	}
+}
+
+func (c *fileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.fileSize
+	ch <- c.walSize
+	ch <- c.pages
+	ch <- c.freelistPages
+	ch <- c.lastVacuum
+}
+
+func (c *fileCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range registeredStorages() {
+		if s.dialect != dialects[Sqlite] {
+			continue
+		}
+		path := dbFilePath(s.Dsn)
+		stats, err := s.fileStats(context.Background())
+		if err != nil {
+			caddy.Log().Named(logStorage).Warn(fmt.Sprintf("collecting file stats of %s: %v", path, err))
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.fileSize, prometheus.GaugeValue, float64(stats.FileSize), path)
+		ch <- prometheus.MustNewConstMetric(c.walSize, prometheus.GaugeValue, float64(stats.WalSize), path)
+		ch <- prometheus.MustNewConstMetric(c.pages, prometheus.GaugeValue, float64(stats.PageCount), path)
+		ch <- prometheus.MustNewConstMetric(c.freelistPages, prometheus.GaugeValue, float64(stats.FreelistPages), path)
+		if t := s.lastVacuum(); t != nil {
+			ch <- prometheus.MustNewConstMetric(c.lastVacuum, prometheus.GaugeValue, float64(t.UnixNano())/1e9, path)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Algorithms naming the key_hash of the rows in the certmagic_meta row
+// metaKeyHash. Databases created before it was recorded use MD5.
+const (
+	keyHashMD5    = "md5"
+	keyHashSHA256 = "sha256"
+)
+
+const metaKeyHash = "key_hash"
+
+// keyHashSalt is appended to keys before hashing them.
+const keyHashSalt = "storage.sqlite.salt"
+
+// keyHash returns the key_hash of key: the MD5 of the salted key, in FIPS
+// mode its SHA-256 truncated to the 40 characters of the column, and the
+// HMAC of hiddenKeyHash if keys are hidden.
+func (s *SqliteStorage) keyHash(key string) string {
+	if s.indexKey != nil {
+		return s.hiddenKeyHash(key)
+	}
+	if !s.FIPS {
+		return getMD5String(key)
+	}
+	sum := sha256.Sum256([]byte(key + keyHashSalt))
+	return hex.EncodeToString(sum[:20])
+}
+
+func (s *SqliteStorage) keyHashAlgorithm() string {
+	if s.indexKey != nil {
+		return keyHashHMAC + ":" + s.Encryption.indexKeyID()
+	}
+	if s.FIPS {
+		return keyHashSHA256
+	}
+	return keyHashMD5
+}
+
+// migrateKeyHashes hashes the keys of the data, lock and conflict rows
+// again when FIPS mode or hide_keys was turned on or off since the
+// database was last opened, encrypting or decrypting the key names for
+// hide_keys. All instances sharing the database have to switch together.
+// Hidden keys can only be read with the encryption key they were hidden
+// with, so it refuses to start with another one.
+func (s *SqliteStorage) migrateKeyHashes(ctx context.Context, tx *sql.Tx) error {
+	var current sql.NullString
+	err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT value FROM certmagic_meta WHERE name = ?"), metaKeyHash).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if current.String == "" {
+		current.String = keyHashMD5
+	}
+	want := s.keyHashAlgorithm()
+	if current.String == want {
+		return nil
+	}
+	hidden := strings.HasPrefix(current.String, keyHashHMAC)
+	if hidden {
+		if err := s.checkIndexKey(ctx, tx, current.String); err != nil {
+			return err
+		}
+		if s.indexKey != nil {
+			// Hidden with this key before its ID was recorded, and the
+			// kind of the keys.
+			if _, err := tx.ExecContext(ctx, "UPDATE certmagic_data SET kind = NULL"); err != nil {
+				return err
+			}
+			return s.replaceMeta(ctx, tx, metaKeyHash, want)
+		}
+	}
+	open := func(stored string) (string, error) {
+		if hidden {
+			return s.openKeyName(stored)
+		}
+		return stored, nil
+	}
+	rehashed := 0
+	for _, table := range []string{"certmagic_data", "certmagic_locks"} {
+		keys, err := queryStrings(ctx, tx, s.dialect.rebind("SELECT key FROM "+table))
+		if err != nil {
+			return err
+		}
+		for _, stored := range keys {
+			key, err := open(stored)
+			if err != nil {
+				return err
+			}
+			update := "UPDATE " + table + " SET key_hash = ?, key = ? WHERE key = ?"
+			args := []any{s.keyHash(key), s.storedKey(key), stored}
+			if table == "certmagic_data" {
+				update = "UPDATE certmagic_data SET key_hash = ?, key = ?, kind = ? WHERE key = ?"
+				args = []any{s.keyHash(key), s.storedKey(key), s.storedKind(key), stored}
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(update), args...); err != nil {
+				return err
+			}
+		}
+		rehashed += len(keys)
+	}
+	if hidden != (s.indexKey != nil) {
+		conflicts, err := queryStrings(ctx, tx, s.dialect.rebind("SELECT DISTINCT key FROM certmagic_conflicts"))
+		if err != nil {
+			return err
+		}
+		for _, stored := range conflicts {
+			if strings.HasPrefix(stored, domainPolicyFeedPrefix) {
+				continue
+			}
+			key, err := open(stored)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE certmagic_conflicts SET key = ? WHERE key = ?"), s.storedKey(key), stored); err != nil {
+				return err
+			}
+		}
+	}
+	if hidden != (s.indexKey != nil) && s.dialect == dialects[Sqlite] {
+		// The triggers recorded the renames as deletions of the previous
+		// names, which readers of the feed could not make sense of. Start
+		// it over with the current keys instead.
+		if _, err := tx.ExecContext(ctx, "DELETE FROM certmagic_changes"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO certmagic_changes (key) SELECT key FROM certmagic_data"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO certmagic_changes (key) SELECT ? || pattern FROM certmagic_domain_policies", domainPolicyFeedPrefix); err != nil {
+			return err
+		}
+	}
+	if err := s.replaceMeta(ctx, tx, metaKeyHash, want); err != nil {
+		return err
+	}
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("hashed %d keys of %s again with %s", rehashed, s.Dsn, want))
+	return nil
+}
+
+// checkIndexKey returns an error unless the keys hidden as recorded by
+// current can be read with the encryption key. Databases hidden before the
+// ID of the key was recorded are checked by decrypting a key name.
+func (s *SqliteStorage) checkIndexKey(ctx context.Context, tx *sql.Tx, current string) error {
+	refuse := func() error {
+		return fmt.Errorf("the key names of %s are hidden with another encryption key, start with that key to turn hide_keys off first", s.Dsn)
+	}
+	if s.aead == nil {
+		return refuse()
+	}
+	_, id, _ := strings.Cut(current, ":")
+	if id != "" {
+		if id != s.Encryption.indexKeyID() {
+			return refuse()
+		}
+		return nil
+	}
+	var stored string
+	err := tx.QueryRowContext(ctx, s.dialect.rebind("SELECT key FROM certmagic_data LIMIT 1")).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.openKeyName(stored); err != nil {
+		return refuse()
+	}
+	return nil
+}
+
+// queryStrings returns the single string column of the rows of query.
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// fipsCipherSuites are the TLS 1.2 cipher suites allowed in FIPS mode.
+// TLS 1.3 suites can't be restricted, and are all AES-GCM but one.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// restrictTLS limits config to FIPS-approved cipher suites and curves.
+func restrictTLS(config *tls.Config) {
+	config.CipherSuites = fipsCipherSuites
+	config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
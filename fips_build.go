@@ -0,0 +1,6 @@
+//go:build fips
+
+package storagesqlite
+
+// fipsBuild turns FIPS mode on for every storage.
+const fipsBuild = true
@@ -0,0 +1,7 @@
+//go:build !fips
+
+package storagesqlite
+
+// fipsBuild is false without the fips build tag; FIPS mode is then
+// configured per storage.
+const fipsBuild = false
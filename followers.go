@@ -0,0 +1,103 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// PushConfig pushes changes to followers as they are committed, instead
+// of waiting for them to pull. Followers apply the changes like a pull
+// replica does, see ReplicationConfig.
+type PushConfig struct {
+	// URLs of the /storage/sqlite/changes admin endpoints of the
+	// followers, with a dsn query parameter if they have more than one
+	// storage.
+	Followers []string `json:"followers,omitempty"`
+	// Changes sent at once. Defaults to 500.
+	BatchSize int `json:"batch_size,omitempty"`
+	// How long to wait before pushing to a follower again after it failed.
+	// Defaults to 5s.
+	RetryInterval caddy.Duration `json:"retry_interval,omitempty"`
+}
+
+func (c *PushConfig) setDefaults() {
+	if c.BatchSize == 0 {
+		c.BatchSize = 500
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = caddy.Duration(5 * time.Second)
+	}
+}
+
+// changeOps are the write operations that add to the change feed.
+var changeOps = map[string]bool{
+	"store":         true,
+	"delete":        true,
+	"delete_prefix": true,
+	"move":          true,
+	"copy":          true,
+}
+
+// follower is the push queue of a single follower. The changes themselves
+// wait in the change feed, so the queue only holds whether there are any:
+// it never grows, and a follower that is down catches up on everything
+// once it is back.
+type follower struct {
+	url string
+	// Host of url, which labels the follower's metrics. The URL itself
+	// may carry credentials, and every dsn would add a time series.
+	host    string
+	pending chan struct{}
+}
+
+func newFollower(endpoint string) *follower {
+	f := &follower{url: endpoint, host: endpoint, pending: make(chan struct{}, 1)}
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		f.host = u.Host
+	}
+	return f
+}
+
+// notifyFollowers queues a push to every follower without waiting for it.
+func (s *SqliteStorage) notifyFollowers() {
+	for _, f := range s.followers {
+		wakeJob(f.pending)
+	}
+}
+
+// registerFollowers registers a job per follower, woken up whenever
+// changes are committed, and run every retry_interval while pushing
+// fails.
+func (s *SqliteStorage) registerFollowers() {
+	for _, f := range s.followers {
+		f := f
+		name := jobPush + ":" + f.host
+		for i := 2; s.background.jobs[name] != nil; i++ {
+			name = fmt.Sprintf("%s:%s#%d", jobPush, f.host, i)
+		}
+		j := s.registerJob(name, 0, nil, func(ctx context.Context) (int64, error) {
+			return s.pushFollower(ctx, f)
+		})
+		j.atStart, j.retry, j.wake = true, time.Duration(s.Push.RetryInterval), f.pending
+	}
+}
+
+// pushFollower pushes the changes f is missing, updates its lag and
+// returns how far it advanced in the change feed.
+func (s *SqliteStorage) pushFollower(ctx context.Context, f *follower) (int64, error) {
+	value, err := s.meta(ctx, syncPushMeta(f.url))
+	if err != nil {
+		return 0, err
+	}
+	since, _ := strconv.ParseInt(value, 10, 64)
+	pushed, err := s.push(ctx, f.url, s.Push.BatchSize)
+	if last, lastErr := s.lastSeq(ctx); lastErr == nil {
+		sqliteMetrics.replicationLag.WithLabelValues(f.host).Set(float64(last - pushed))
+	}
+	return pushed - since, err
+}
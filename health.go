@@ -0,0 +1,148 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// reopenedEvent is the name of the Caddy event emitted after the health
+// check replaced the database handles.
+const reopenedEvent = "sqlite_storage_reopened"
+
+// HealthCheckConfig pings the database periodically and reopens it after
+// repeated failures, for example when the database file was deleted or its
+// volume remounted.
+type HealthCheckConfig struct {
+	// How often the database is pinged. Defaults to 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Consecutive failed pings after which the database is reopened.
+	// Defaults to 3.
+	Failures int `json:"failures,omitempty"`
+}
+
+func (c *HealthCheckConfig) setDefaults() {
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(30 * time.Second)
+	}
+	if c.Failures == 0 {
+		c.Failures = 3
+	}
+}
+
+// writeDB returns the pool to run writes and other queries on.
+func (s *SqliteStorage) writeDB() *sql.DB {
+	s.handles.RLock()
+	defer s.handles.RUnlock()
+	return s.Database
+}
+
+// healthCheckJob returns the job pinging the database, run every health
+// check interval. It counts the consecutive failures across runs, and
+// fails while there are any. Pings are not items, so it reports none.
+func (s *SqliteStorage) healthCheckJob() func(context.Context) (int64, error) {
+	failures := 0
+	return func(ctx context.Context) (int64, error) {
+		failures = s.checkHealth(ctx, failures)
+		if failures > 0 {
+			return 0, fmt.Errorf("%d consecutive failed pings", failures)
+		}
+		return 0, nil
+	}
+}
+
+// checkHealth pings the database and reopens it once the configured number
+// of consecutive pings failed. It returns the number of failures so far.
+func (s *SqliteStorage) checkHealth(ctx context.Context, failures int) int {
+	err := s.ping(ctx)
+	if err == nil {
+		if failures > 0 {
+			caddy.Log().Named(logStorage).Info(fmt.Sprintf("health check of %s recovered after %d failures", s.Dialect, failures))
+		}
+		return 0
+	}
+	failures++
+	caddy.Log().Named(logStorage).Warn(fmt.Sprintf("health check failed (%d of %d): %v", failures, s.HealthCheck.Failures, err))
+	if failures < s.HealthCheck.Failures {
+		return failures
+	}
+	if err := s.reopen(); err != nil {
+		caddy.Log().Named(logStorage).Error(fmt.Sprintf("reopening the database failed: %v", err))
+		return failures
+	}
+	sqliteMetrics.reopens.Inc()
+	s.emit(reopenedEvent, map[string]any{
+		"dialect":  s.Dialect,
+		"failures": failures,
+		"error":    err.Error(),
+	})
+	caddy.Log().Named(logStorage).Warn(fmt.Sprintf("reopened the database after %d failed health checks", failures))
+	return 0
+}
+
+// ping checks that the database answers and, for a sqlite file, that the
+// file still exists. A deleted file stays readable through the open
+// handles, but nothing written to it would survive a restart.
+func (s *SqliteStorage) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+	defer cancel()
+	// readOnlyDSN accepts exactly the DSNs naming a writable file.
+	if _, ok := readOnlyDSN(s.Dsn); ok && s.dialect == dialects[Sqlite] {
+		if _, err := os.Stat(dbFilePath(s.Dsn)); err != nil {
+			return err
+		}
+	}
+	return s.readDB().PingContext(ctx)
+}
+
+// reopen replaces Database and the read-only connections with new handles
+// and sets the schema up again. A sqlite file is opened with mode=rw, so
+// that a missing file fails the reopen rather than being replaced by an
+// empty database.
+func (s *SqliteStorage) reopen() error {
+	dsn := s.connectionString()
+	if s.dialect == dialects[Sqlite] {
+		dsn = existingDSN(dsn)
+	}
+	db, err := sql.Open(s.Driver, dsn)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+	if err := s.replaceHandles(db); err != nil {
+		db.Close()
+		return err
+	}
+	return s.ensureTableSetup()
+}
+
+// replaceHandles makes db the Database and opens new read-only connections
+// for it. The old handles are closed once the operations running on them
+// finished, or drain_timeout passed; new operations wait meanwhile.
+func (s *SqliteStorage) replaceHandles(db *sql.DB) error {
+	if s.writes != nil {
+		release, err := s.writes.hold(context.Background(), time.Duration(s.WriteWaitTimeout))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	defer s.pauseOperations()()
+
+	s.handles.Lock()
+	oldDB, oldReader := s.Database, s.reader
+	s.Database, s.reader = db, nil
+	s.handles.Unlock()
+	oldDB.Close()
+	if oldReader != nil {
+		oldReader.Close()
+	}
+	return s.openReader()
+}
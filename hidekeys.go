@@ -0,0 +1,195 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// keyHashHMAC names the key_hash of hidden keys in the certmagic_meta row
+// metaKeyHash, followed by ":" and indexKeyID.
+const keyHashHMAC = "hmac-sha256"
+
+// keyNameAD is the additional data authenticated with encrypted key names.
+var keyNameAD = []byte("storage.sqlite.key-name")
+
+// indexKey returns the HMAC key of the blind index of hidden keys, derived
+// from the encryption key, or nil if keys are not hidden.
+func (e *EncryptionConfig) indexKey() []byte {
+	if !e.HideKeys {
+		return nil
+	}
+	return e.blindIndexKey()
+}
+
+func (e *EncryptionConfig) blindIndexKey() []byte {
+	key, _ := base64.StdEncoding.DecodeString(e.Key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("storage.sqlite.blind-index"))
+	return mac.Sum(nil)
+}
+
+// indexKeyID identifies the key of the blind index in certmagic_meta, so
+// that a database whose keys were hidden with another encryption key is
+// noticed, whether hide_keys is still on or not. It reveals nothing about
+// the key.
+func (e *EncryptionConfig) indexKeyID() string {
+	mac := hmac.New(sha256.New, e.blindIndexKey())
+	mac.Write([]byte("key_id"))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// storedKind returns the kind column of key, which is left NULL for hidden
+// keys since it tells which values are private keys. Kind computes it
+// from the key name then.
+func (s *SqliteStorage) storedKind(key string) any {
+	if s.indexKey != nil {
+		return nil
+	}
+	return keyKind(key)
+}
+
+// blindIndex returns the HMAC of key, prefixed with domain so that the
+// same key yields independent values for different uses.
+func (s *SqliteStorage) blindIndex(domain, key string) []byte {
+	mac := hmac.New(sha256.New, s.indexKey)
+	mac.Write([]byte(domain + "\x00" + key))
+	return mac.Sum(nil)
+}
+
+// storedKey returns key as it is written to the key columns: the key
+// itself, or encrypted if keys are hidden. The nonce is derived from the
+// key so that a key is always stored the same way, which the change feed
+// triggers and lookups by name rely on.
+func (s *SqliteStorage) storedKey(key string) string {
+	if s.indexKey == nil {
+		return key
+	}
+	nonce := s.blindIndex("nonce", key)[:s.aead.NonceSize()]
+	sealed := s.aead.Seal(append([]byte{}, nonce...), nonce, []byte(key), keyNameAD)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// plainKey reverses storedKey.
+func (s *SqliteStorage) plainKey(stored string) (string, error) {
+	if s.indexKey == nil {
+		return stored, nil
+	}
+	return s.openKeyName(stored)
+}
+
+// openKeyName decrypts a key name encrypted by storedKey.
+func (s *SqliteStorage) openKeyName(stored string) (string, error) {
+	if s.aead == nil {
+		return "", errors.New("key names are encrypted but no encryption key is configured")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted key name %q", stored)
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	key, err := s.aead.Open(nil, nonce, ciphertext, keyNameAD)
+	if err != nil {
+		return "", fmt.Errorf("decrypting key name: %v", err)
+	}
+	return string(key), nil
+}
+
+// prefixCond returns the condition selecting the rows of the keys starting
+// with prefix. Hidden keys can't be compared in SQL, so then it selects
+// every row and the caller filters the names with matchKey.
+func (s *SqliteStorage) prefixCond(prefix string) (string, []any) {
+	if s.indexKey != nil {
+		return "1 = 1", nil
+	}
+	return s.dialect.prefixRange(prefix)
+}
+
+// matchKey returns the key stored as stored, and whether it starts with
+// prefix.
+func (s *SqliteStorage) matchKey(stored, prefix string) (string, bool, error) {
+	key, err := s.plainKey(stored)
+	if err != nil {
+		return "", false, err
+	}
+	return key, strings.HasPrefix(key, prefix), nil
+}
+
+// deleteHiddenPrefix is DeletePrefix for hidden keys, which deletes the
+// matching rows one by one.
+func (s *SqliteStorage) deleteHiddenPrefix(ctx context.Context, tx *sql.Tx, prefix string) (int64, error) {
+	rows, err := s.query(ctx, tx, "SELECT key_hash, key FROM certmagic_data", []string{prefix})
+	if err != nil {
+		return 0, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var keyHash, stored string
+		if err := rows.Scan(&keyHash, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, ok, err := s.matchKey(stored, prefix); err != nil {
+			rows.Close()
+			return 0, err
+		} else if ok {
+			hashes = append(hashes, keyHash)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, keyHash := range hashes {
+		if _, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE key_hash = ?", []string{prefix}, keyHash); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(hashes)), nil
+}
+
+// statHiddenDir is statDir for hidden keys.
+func (s *SqliteStorage) statHiddenDir(ctx context.Context, dir string) (time.Time, error) {
+	var latest time.Time
+	rows, err := s.query(ctx, s.readDB(), "SELECT key, modified FROM certmagic_data", []string{dir})
+	if err != nil {
+		return latest, err
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var stored string
+		var modified time.Time
+		if err := rows.Scan(&stored, &modified); err != nil {
+			return latest, err
+		}
+		if _, ok, err := s.matchKey(stored, dir); err != nil {
+			return latest, err
+		} else if ok {
+			found = true
+			if modified.After(latest) {
+				latest = modified
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return latest, err
+	}
+	if !found {
+		return latest, fs.ErrNotExist
+	}
+	return latest, nil
+}
+
+// hiddenKeyHash returns the key_hash of a hidden key.
+func (s *SqliteStorage) hiddenKeyHash(key string) string {
+	return hex.EncodeToString(s.blindIndex("key_hash", key)[:20])
+}
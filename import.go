@@ -0,0 +1,112 @@
+package storagesqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// ownFile reports whether path is a file the storage writes: the sqlite
+// database with its WAL and journals, the staged snapshots next to it, its
+// archives and its backups.
+func (s *SqliteStorage) ownFile(path string) bool {
+	if s.dialect != dialects[Sqlite] {
+		return false
+	}
+	db := dbFilePath(s.Dsn)
+	if db == "" {
+		return false
+	}
+	path, db = filepath.Clean(path), filepath.Clean(db)
+	if strings.HasPrefix(path, db) {
+		return true
+	}
+	if rel, err := filepath.Rel(filepath.Dir(db), path); err == nil && strings.HasPrefix(rel, ".snapshot-") {
+		return true
+	}
+	if s.Archive != nil {
+		for _, pattern := range []string{s.archivePattern(), s.archivePattern() + ".enc"} {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	if s.Backups != nil && s.Backups.Dir != "" {
+		if rel, err := filepath.Rel(s.Backups.Dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadStorageModule provisions the storage module described by raw, the
+// JSON that would appear in the "storage" field of a Caddy config, e.g.
+// {"module": "redis", "host": "..."}. The module has to be compiled into
+// the running binary.
+func loadStorageModule(ctx caddy.Context, raw json.RawMessage) (certmagic.Storage, error) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding storage config: %v", err)
+	}
+	var name string
+	if err := json.Unmarshal(cfg["module"], &name); err != nil || name == "" {
+		return nil, fmt.Errorf("storage config must name its module")
+	}
+	delete(cfg, "module")
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := ctx.LoadModuleByID("caddy.storage."+name, raw)
+	if err != nil {
+		return nil, fmt.Errorf("loading storage module: %v", err)
+	}
+	converter, ok := val.(caddy.StorageConverter)
+	if !ok {
+		return nil, fmt.Errorf("module %s is not a storage module", name)
+	}
+	return converter.CertMagicStorage()
+}
+
+// importFrom copies every terminal key of src into s and returns the
+// number of keys copied. A file system storage may hold the database
+// itself, such as Caddy's data directory with the default dsn, whose files
+// are skipped.
+func (s *SqliteStorage) importFrom(ctx context.Context, src certmagic.Storage) (int, error) {
+	keys, err := src.List(ctx, "", true)
+	if err != nil {
+		return 0, fmt.Errorf("listing source keys: %v", err)
+	}
+	var root string
+	if fs, ok := src.(*certmagic.FileStorage); ok {
+		root = fs.Path
+	}
+	imported := 0
+	for _, key := range keys {
+		if root != "" && s.ownFile(filepath.Join(root, filepath.FromSlash(key))) {
+			continue
+		}
+		info, err := src.Stat(ctx, key)
+		if err != nil {
+			return imported, fmt.Errorf("stat %s: %v", key, err)
+		}
+		if !info.IsTerminal {
+			continue
+		}
+		value, err := src.Load(ctx, key)
+		if err != nil {
+			return imported, fmt.Errorf("loading %s: %v", key, err)
+		}
+		if err := s.StoreWithModTime(ctx, key, value, info.Modified); err != nil {
+			return imported, fmt.Errorf("storing %s: %v", key, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
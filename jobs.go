@@ -0,0 +1,310 @@
+package storagesqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Names of the background jobs besides the scheduled maintenance
+// operations and jobBackup. The push jobs are named by jobPush and the
+// host of the follower.
+const (
+	jobCompaction       = "compaction"
+	jobEncryptMigration = "encrypt_migration"
+	jobHealthCheck      = "health_check"
+	jobLockWatchdog     = "lock_watchdog"
+	jobPush             = "push"
+	jobReplication      = "replication"
+	jobSignalBackup     = "signal_backup"
+	jobSync             = "sync"
+	jobVacuumBudget     = "vacuum_budget"
+	jobWALLimit         = "wal_limit"
+	jobWriteProbe       = "write_probe"
+)
+
+// Jobs that run on one instance at a time among all sharing the
+// database, under a lease in the lock table.
+var exclusiveJobs = map[string]bool{
+	jobBackup:                 true,
+	jobArchive:                true,
+	jobCompaction:             true,
+	jobKVExpire:               true,
+	MaintenanceVacuum:         true,
+	MaintenanceIntegrityCheck: true,
+	MaintenanceLockGC:         true,
+}
+
+// jobLeaseTTL is how long the lease of an exclusive job lasts without
+// renewal, and so how long a crashed instance blocks the job.
+const jobLeaseTTL = time.Minute
+
+var (
+	// errJobRunning is returned when a job is started while it still runs.
+	errJobRunning = errors.New("job is already running")
+	// errJobLeased is returned when an exclusive job is started while it
+	// runs on another instance.
+	errJobLeased = errors.New("job is running on another instance")
+)
+
+// JobStatus describes a background job and its last run.
+type JobStatus struct {
+	Name string `json:"name"`
+	// Time between runs, and the cron expression of the schedule.
+	Interval string `json:"interval,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	Running  bool   `json:"running"`
+	// When the last run started, how long it took and the error it failed
+	// with, empty if it succeeded.
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	// Items the last run processed, such as removed locks or pulled
+	// changes.
+	Items    int64      `json:"items"`
+	Runs     int64      `json:"runs"`
+	Failures int64      `json:"failures"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+// job is a background task, run by the job runner every interval, at the
+// times of a cron schedule, whenever it is woken up or receives one of its
+// signals, or any of these. run returns the number of items it processed.
+type job struct {
+	name     string
+	interval time.Duration
+	schedule *cronSchedule
+	// Run once right away when the storage starts.
+	atStart bool
+	// Run under a lease, see exclusiveJobs.
+	exclusive bool
+	// Run again after retry once a run failed, without waiting for the
+	// next interval or wakeup.
+	retry time.Duration
+	// Runs the job soon when sent to, without blocking the sender. A
+	// wakeup while the job runs makes it run once more afterwards.
+	wake    chan struct{}
+	signals []os.Signal
+	run     func(context.Context) (int64, error)
+
+	// Held while the job runs, so that runs never overlap.
+	running sync.Mutex
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Status returns the status of the job.
+func (j *job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// next returns the time of the run after now, or the zero time if there
+// is none.
+func (j *job) next(now time.Time) time.Time {
+	var next time.Time
+	if j.interval > 0 {
+		next = now.Add(j.interval)
+	}
+	if j.schedule != nil {
+		if t := j.schedule.next(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// registerJob adds a job to be started by startJobs. Registering a name
+// again adds the interval or schedule to the existing job.
+func (s *SqliteStorage) registerJob(name string, interval time.Duration, schedule *cronSchedule, run func(context.Context) (int64, error)) *job {
+	j := s.background.jobs[name]
+	if j == nil {
+		j = &job{name: name, run: run, exclusive: exclusiveJobs[name], wake: make(chan struct{}, 1), status: JobStatus{Name: name}}
+		s.background.jobs[name] = j
+	}
+	if interval > 0 {
+		j.interval = interval
+		j.status.Interval = interval.String()
+	}
+	if schedule != nil {
+		j.schedule = schedule
+		j.status.Schedule = schedule.expr
+	}
+	return j
+}
+
+// jobStatuses returns the status of every registered job by name.
+func (s *SqliteStorage) jobStatuses() []JobStatus {
+	var statuses []JobStatus
+	for _, name := range s.jobNames() {
+		statuses = append(statuses, s.background.jobs[name].Status())
+	}
+	return statuses
+}
+
+// jobNames returns the names of the registered jobs in order.
+func (s *SqliteStorage) jobNames() []string {
+	names := make([]string, 0, len(s.background.jobs))
+	for name := range s.background.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wakeJob runs the job of wake soon, without waiting for it.
+func wakeJob(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobs runs every registered job in the background until the storage
+// is closed.
+func (s *SqliteStorage) startJobs() {
+	for _, j := range s.background.jobs {
+		s.startJob(j)
+	}
+}
+
+// startJob runs j in the background until the storage is closed.
+func (s *SqliteStorage) startJob(j *job) {
+	s.goBackground(func(ctx context.Context) {
+		var signals chan os.Signal
+		if len(j.signals) > 0 {
+			signals = make(chan os.Signal, 1)
+			signal.Notify(signals, j.signals...)
+			defer signal.Stop(signals)
+		}
+		var err error
+		if j.atStart {
+			err = s.runJob(ctx, j)
+		}
+		for {
+			now := time.Now()
+			next := j.next(now)
+			if err != nil && j.retry > 0 {
+				if retry := now.Add(j.retry); next.IsZero() || retry.Before(next) {
+					next = retry
+				}
+			}
+			j.mu.Lock()
+			j.status.NextRun = nil
+			if !next.IsZero() {
+				j.status.NextRun = &next
+			}
+			j.mu.Unlock()
+			var timer *time.Timer
+			var due <-chan time.Time
+			if !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				due = timer.C
+			}
+			select {
+			case <-ctx.Done():
+			case <-due:
+			case <-j.wake:
+			case <-signals:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			err = s.runJob(ctx, j)
+		}
+	})
+}
+
+// runJob runs j unless it is already running, here or for an exclusive
+// job on another instance, and records and reports its outcome.
+func (s *SqliteStorage) runJob(ctx context.Context, j *job) error {
+	if !j.running.TryLock() {
+		return errJobRunning
+	}
+	defer j.running.Unlock()
+	runCtx := ctx
+	if j.exclusive {
+		lease, err := s.TryLeadership(ctx, "job/"+j.name, jobLeaseTTL)
+		if errors.Is(err, ErrLocked) {
+			caddy.Log().Named(logMaintenance).Debug(fmt.Sprintf("skipping %s, it runs on another instance", j.name))
+			sqliteMetrics.jobRuns.WithLabelValues(redactDSN(s.Dsn), j.name, "skipped").Inc()
+			return errJobLeased
+		}
+		if err != nil {
+			return fmt.Errorf("taking the lease of %s: %v", j.name, err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), s.QueryTimeout*time.Second)
+			defer cancel()
+			if err := lease.Release(ctx); err != nil {
+				caddy.Log().Named(logMaintenance).Warn(fmt.Sprintf("releasing the lease of %s: %v", j.name, err))
+			}
+		}()
+		// Stop the job if another instance took the lease over.
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-lease.Lost():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+	}
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+	start := time.Now()
+	items, err := j.run(runCtx)
+	duration := time.Since(start)
+
+	j.mu.Lock()
+	j.status.Running = false
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by Close.
+		j.mu.Unlock()
+		return err
+	}
+	j.status.LastRun = &start
+	j.status.LastDuration = duration.String()
+	j.status.Items = items
+	j.status.Runs++
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		j.status.Failures++
+	} else {
+		j.status.LastSuccess = &start
+	}
+	j.mu.Unlock()
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		caddy.Log().Named(logMaintenance).Error(fmt.Sprintf("%s failed after %s: %v", j.name, duration.Round(time.Millisecond), err))
+	}
+	// Label by storage, several storages run jobs of the same name.
+	storage := redactDSN(s.Dsn)
+	sqliteMetrics.jobRuns.WithLabelValues(storage, j.name, result).Inc()
+	sqliteMetrics.jobDuration.WithLabelValues(storage, j.name).Set(duration.Seconds())
+	sqliteMetrics.jobItems.WithLabelValues(storage, j.name).Add(float64(items))
+	sqliteMetrics.jobLastRun.WithLabelValues(storage, j.name).Set(float64(start.UnixNano()) / 1e9)
+	if err == nil {
+		sqliteMetrics.jobLastSuccess.WithLabelValues(storage, j.name).Set(float64(start.UnixNano()) / 1e9)
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Content kinds recorded in the kind column.
+const (
+	KindCertificate = "certificate"
+	KindPrivateKey  = "private_key"
+	KindMetadata    = "metadata"
+	KindOCSP        = "ocsp"
+	KindOther       = "other"
+)
+
+// kindRule assigns kind to keys starting with prefix and ending in suffix.
+type kindRule struct {
+	prefix, suffix, kind string
+}
+
+// kindRules are checked in order, the first match decides the kind of a
+// key. They follow the layout certmagic uses for its files.
+var kindRules = []kindRule{
+	{prefix: "ocsp/", kind: KindOCSP},
+	{suffix: ".crt", kind: KindCertificate},
+	{suffix: ".key", kind: KindPrivateKey},
+	{suffix: ".json", kind: KindMetadata},
+}
+
+// keyKind returns the best-effort content kind of key based on its path.
+func keyKind(key string) string {
+	for _, rule := range kindRules {
+		if strings.HasPrefix(key, rule.prefix) && strings.HasSuffix(key, rule.suffix) {
+			return rule.kind
+		}
+	}
+	return KindOther
+}
+
+// kindExpr returns a SQL expression computing the kind of the key column
+// by rules, used with kindRules to fill the kind of rows written before the
+// column existed.
+func kindExpr(rules []kindRule) string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, rule := range rules {
+		fmt.Fprintf(&b, " WHEN key LIKE '%s%%%s' ESCAPE '!' THEN '%s'", likeEscape(rule.prefix), likeEscape(rule.suffix), rule.kind)
+	}
+	fmt.Fprintf(&b, " ELSE '%s' END", KindOther)
+	return b.String()
+}
+
+// likeEscaper escapes the LIKE wildcards with !, which unlike a backslash
+// needs no escaping in MySQL string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// likeEscape returns s as a LIKE pattern matching s literally.
+func likeEscape(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// Kind returns the content kind recorded for key: certificate,
+// private_key, metadata, ocsp or other.
+func (s *SqliteStorage) Kind(ctx context.Context, key string) (string, error) {
+	var kind sql.NullString
+	err := s.retry(ctx, "kind", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		err := s.queryRow(ctx, s.readDB(), "select kind from certmagic_data where key_hash = ?", []string{key}, key_hash).Scan(&kind)
+		if err == sql.ErrNoRows {
+			return fs.ErrNotExist
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if !kind.Valid {
+		return keyKind(key), nil
+	}
+	return kind.String, nil
+}
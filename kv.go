@@ -0,0 +1,196 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// jobKVExpire removes expired keys of the KV buckets and counters whose
+// window ended.
+const jobKVExpire = "kv_expire"
+
+// kvExpireInterval is how often expired keys are removed. Until then they
+// are only skipped by reads.
+const kvExpireInterval = 10 * time.Minute
+
+// KV is a namespace of keys and values other modules keep in the storage
+// database, in a table of their own apart from the certmagic data. Values
+// are stored as given, without compression or encryption. Missing and
+// expired keys fail with fs.ErrNotExist.
+type KV interface {
+	// Get returns the value of key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value of key. It expires after ttl unless ttl is zero.
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix in order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Lock and Unlock take and release a lock on key like the storage's
+	// Lock and Unlock, shared by all instances using the database.
+	Lock(ctx context.Context, key string) error
+	Unlock(ctx context.Context, key string) error
+}
+
+// kvBucket is the KV of one bucket name.
+type kvBucket struct {
+	s    *SqliteStorage
+	name string
+}
+
+// Bucket returns the KV namespace name. Buckets are created on first use.
+func (s *SqliteStorage) Bucket(name string) KV {
+	return &kvBucket{s: s, name: name}
+}
+
+// kvKeyHash identifies key in bucket. Unlike keyHash it doesn't depend on
+// the storage options, so that changing them keeps the buckets readable.
+func kvKeyHash(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "\x00" + key))
+	return hex.EncodeToString(sum[:20])
+}
+
+func (b *kvBucket) check() error {
+	if b.name == "" {
+		return errors.New("bucket name is required")
+	}
+	return nil
+}
+
+func (b *kvBucket) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := b.s.retry(ctx, "kv_get", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, b.s.QueryTimeout*time.Second)
+		defer cancel()
+		err := b.s.queryRow(ctx, b.s.readDB(), "SELECT value FROM certmagic_kv WHERE key_hash = ? AND (expires IS NULL OR expires > ?)", []string{key},
+			kvKeyHash(b.name, key), time.Now()).Scan(&value)
+		if err == sql.ErrNoRows {
+			return fs.ErrNotExist
+		}
+		return err
+	})
+	return value, err
+}
+
+func (b *kvBucket) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return fmt.Errorf("negative ttl %s", ttl)
+	}
+	now := time.Now()
+	var expires sql.NullTime
+	if ttl > 0 {
+		expires = sql.NullTime{Time: now.Add(ttl), Valid: true}
+	}
+	return b.s.retryWrite(ctx, "kv_put", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, b.s.QueryTimeout*time.Second)
+		defer cancel()
+		_, err := b.s.exec(ctx, b.s.writeDB(), `INSERT INTO certmagic_kv (key_hash, bucket, key, value, modified, expires) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(key_hash) DO UPDATE SET value = ?, modified = ?, expires = ?`, []string{key},
+			kvKeyHash(b.name, key), b.name, key, value, now, expires,
+			value, now, expires)
+		return err
+	})
+}
+
+func (b *kvBucket) Delete(ctx context.Context, key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.s.retryWrite(ctx, "kv_delete", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, b.s.QueryTimeout*time.Second)
+		defer cancel()
+		res, err := b.s.exec(ctx, b.s.writeDB(), "DELETE FROM certmagic_kv WHERE key_hash = ? AND (expires IS NULL OR expires > ?)", []string{key},
+			kvKeyHash(b.name, key), time.Now())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fs.ErrNotExist
+		}
+		return err
+	})
+}
+
+func (b *kvBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	err := b.s.retry(ctx, "kv_list", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, b.s.QueryTimeout*time.Second)
+		defer cancel()
+		cond, args := b.s.dialect.prefixRange(prefix)
+		args = append([]any{b.name, time.Now()}, args...)
+		rows, err := b.s.query(ctx, b.s.readDB(), "SELECT key FROM certmagic_kv WHERE bucket = ? AND (expires IS NULL OR expires > ?) AND "+cond+" ORDER BY "+b.s.dialect.keyOrder, []string{prefix}, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys = keys[:0]
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	return keys, err
+}
+
+// lockName is the name of the lock on key in the lock table, apart from
+// the names certmagic uses.
+func (b *kvBucket) lockName(key string) string {
+	return "kv:" + b.name + "/" + key
+}
+
+func (b *kvBucket) Lock(ctx context.Context, key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.s.Lock(ctx, b.lockName(key))
+}
+
+func (b *kvBucket) Unlock(ctx context.Context, key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.s.Unlock(ctx, b.lockName(key))
+}
+
+// expireKV removes the expired keys of every bucket and the counters whose
+// window ended, and returns how many it removed.
+func (s *SqliteStorage) expireKV(ctx context.Context) (int64, error) {
+	var removed int64
+	err := s.retryWrite(ctx, jobKVExpire, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		removed = 0
+		for _, table := range []string{"certmagic_kv", "certmagic_counters"} {
+			res, err := s.exec(ctx, s.writeDB(), "DELETE FROM "+table+" WHERE expires <= ?", nil, time.Now())
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			removed += n
+		}
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,278 @@
+package storagesqlite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(KVHandler{})
+	httpcaddyfile.RegisterHandlerDirective("sqlite_kv", parseKVHandler)
+}
+
+// defaultKVMaxSize is the default limit of the values written through
+// KVHandler.
+const defaultKVMaxSize = 1 << 20
+
+// KVHandler serves a bucket of the database opened by the sqlite_storage
+// app over HTTP, for small dynamic config and feature flags. The key is the
+// request path without strip_prefix:
+//
+//	GET    /<key>           the value
+//	GET    /<prefix>/ or /  the keys starting with prefix, as a JSON array
+//	PUT    /<key>?ttl=1h    sets the value to the body, optionally expiring
+//	DELETE /<key>           removes the key
+//
+// Reads need a token of the read scope when auth is set. Writes need one
+// of the admin scope, and are refused without auth. Paths outside
+// strip_prefix are not found. The certificates are never reachable
+// through it.
+type KVHandler struct {
+	// The bucket served, see SqliteStorage.Bucket.
+	Bucket string `json:"bucket,omitempty"`
+	// Removed from the request path to get the key, such as /flags. It
+	// matches whole path segments, so /flags doesn't serve /flagship.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	// Largest value accepted by PUT in bytes. Defaults to 1 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// The tokens requests must be made with. Without it the bucket can be
+	// read by every client reaching the route, and not written.
+	Auth *AuthConfig `json:"auth,omitempty"`
+
+	kv KV
+}
+
+func (KVHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sqlite_kv",
+		New: func() caddy.Module { return new(KVHandler) },
+	}
+}
+
+// Provision takes the bucket from the sqlite_storage app.
+func (h *KVHandler) Provision(ctx caddy.Context) error {
+	if h.MaxSize == 0 {
+		h.MaxSize = defaultKVMaxSize
+	}
+	if h.Auth != nil {
+		repl := caddy.NewReplacer()
+		for i := range h.Auth.Tokens {
+			t := &h.Auth.Tokens[i]
+			t.setDefaults()
+			secret, err := resolveSecret(repl.ReplaceAll(t.Secret, ""))
+			if err != nil {
+				return fmt.Errorf("auth: token %s: %v", t.ID, err)
+			}
+			t.Secret = secret
+		}
+	}
+	app, err := ctx.App("sqlite_storage")
+	if err != nil {
+		return fmt.Errorf("loading the sqlite_storage app: %v", err)
+	}
+	h.kv = app.(DatabaseProvider).Bucket(h.Bucket)
+	return nil
+}
+
+func (h *KVHandler) Validate() error {
+	if h.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if h.MaxSize < 0 {
+		return errors.New("max_size must not be negative")
+	}
+	if h.Auth != nil {
+		if err := h.Auth.validate(); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	return nil
+}
+
+func (h *KVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	key, ok := h.key(r.URL.Path)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s is outside %s", r.URL.Path, h.StripPrefix))
+	}
+	// Limit the body before authorize reads it to check a signature.
+	r.Body = http.MaxBytesReader(w, r.Body, h.MaxSize)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if err := h.authorize(r, ScopeRead); err != nil {
+			return err
+		}
+		if key == "" || strings.HasSuffix(key, "/") {
+			keys, err := h.kv.List(r.Context(), key)
+			if err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("listing %s: %v", key, err))
+			}
+			if keys == nil {
+				keys = []string{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(keys)
+		}
+		value, err := h.kv.Get(r.Context(), key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("loading %s: %v", key, err))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(value)
+		return err
+	case http.MethodPut:
+		if err := h.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		if key == "" || strings.HasSuffix(key, "/") {
+			return caddyhttp.Error(http.StatusBadRequest, errors.New("key is required"))
+		}
+		var ttl time.Duration
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			var err error
+			if ttl, err = caddy.ParseDuration(v); err != nil || ttl < 0 {
+				return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v))
+			}
+		}
+		value, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if err := h.kv.Put(r.Context(), key, value, ttl); err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("storing %s: %v", key, err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodDelete:
+		if err := h.authorize(r, ScopeAdmin); err != nil {
+			return err
+		}
+		err := h.kv.Delete(r.Context(), key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("deleting %s: %v", key, err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %v", r.Method))
+	}
+}
+
+// key returns the key of the request path, and false if the path is
+// outside StripPrefix.
+func (h *KVHandler) key(path string) (string, bool) {
+	prefix := strings.TrimSuffix(h.StripPrefix, "/")
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return strings.TrimPrefix(rest, "/"), true
+}
+
+// authorize checks that r may act on the bucket with scope, like
+// SqliteStorage.authorize does for the admin endpoints. Without auth only
+// reads are allowed.
+func (h *KVHandler) authorize(r *http.Request, scope string) error {
+	if h.Auth == nil {
+		if scope == ScopeAdmin {
+			caddy.Log().Named(logStorage).Warn(fmt.Sprintf("refused request %s %s from %s: writes require auth", r.Method, r.URL.Path, r.RemoteAddr))
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("writes to bucket %s require auth", h.Bucket))
+		}
+		return nil
+	}
+	t, err := h.Auth.authenticate(r)
+	if err != nil {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("refused request %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err))
+		status := http.StatusUnauthorized
+		if errors.Is(err, errBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		return caddyhttp.Error(status, fmt.Errorf("authenticating for bucket %s: %v", h.Bucket, err))
+	}
+	if scope == ScopeAdmin && t.Scope != ScopeAdmin {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("refused request %s %s from %s: token %s lacks the %s scope", r.Method, r.URL.Path, r.RemoteAddr, t.ID, scope))
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("token %s lacks the %s scope for bucket %s", t.ID, scope, h.Bucket))
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Like other
+// third-party handlers it needs an order, such as
+// "order sqlite_kv before respond" in the global options, unless used in a
+// route block:
+//
+//	sqlite_kv [<bucket>] {
+//		bucket <name>
+//		strip_prefix <prefix>
+//		max_size <bytes>
+//		auth {
+//			bearer <id> <secret> [read|admin]
+//			hmac <id> <secret> [read|admin]
+//		}
+//	}
+func (h *KVHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			h.Bucket = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var err error
+			switch key := d.Val(); key {
+			case "bucket":
+				h.Bucket, err = stringArg(d)
+			case "strip_prefix":
+				h.StripPrefix, err = stringArg(d)
+			case "max_size":
+				var size int
+				size, err = intArg(d)
+				h.MaxSize = int64(size)
+			case "auth":
+				h.Auth = new(AuthConfig)
+				err = unmarshalAuth(d, h.Auth)
+			default:
+				return d.Errf("unrecognized sqlite_kv subdirective %s", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseKVHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(KVHandler)
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return handler, err
+}
+
+var (
+	_ caddy.Provisioner           = (*KVHandler)(nil)
+	_ caddy.Validator             = (*KVHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*KVHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*KVHandler)(nil)
+)
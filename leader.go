@@ -0,0 +1,137 @@
+package storagesqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Leadership is held by the one instance that won AcquireLeadership for a
+// name. It is renewed in the background until Release is called or a
+// renewal fails, in which case Lost is closed.
+type Leadership struct {
+	Name string
+
+	s      *SqliteStorage
+	key    string
+	ttl    time.Duration
+	cancel context.CancelFunc
+	done   chan struct{}
+	lost   chan struct{}
+	once   sync.Once
+}
+
+// AcquireLeadership blocks until this instance becomes the leader for name
+// among all instances sharing the database, or ctx is done. Leadership is
+// kept in the lock table and expires ttl after the last renewal, so a
+// crashed leader is replaced after at most ttl.
+func (s *SqliteStorage) AcquireLeadership(ctx context.Context, name string, ttl time.Duration) (*Leadership, error) {
+	if ttl <= 0 {
+		return nil, errors.New("leadership ttl must be positive")
+	}
+	key := "leader/" + name
+	if err := s.lock(ctx, key, ttl); err != nil {
+		return nil, err
+	}
+	return s.lead(name, key, ttl), nil
+}
+
+// TryLeadership is AcquireLeadership without waiting: it fails with
+// ErrLocked if another instance is the leader for name.
+func (s *SqliteStorage) TryLeadership(ctx context.Context, name string, ttl time.Duration) (*Leadership, error) {
+	if ttl <= 0 {
+		return nil, errors.New("leadership ttl must be positive")
+	}
+	key := "leader/" + name
+	if err := s.tryLock(ctx, key, ttl); err != nil {
+		return nil, err
+	}
+	s.drain.acquired()
+	return s.lead(name, key, ttl), nil
+}
+
+// lead renews the leadership lock for key, which was just taken.
+func (s *SqliteStorage) lead(name, key string, ttl time.Duration) *Leadership {
+	renewCtx, cancel := context.WithCancel(context.Background())
+	l := &Leadership{
+		Name:   name,
+		s:      s,
+		key:    key,
+		ttl:    ttl,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+	go l.renew(renewCtx)
+	return l
+}
+
+// Lost is closed when leadership could not be renewed.
+func (l *Leadership) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops renewing and gives up leadership.
+func (l *Leadership) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+	return l.s.retryWrite(ctx, "unlock", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, l.s.QueryTimeout*time.Second)
+		defer cancel()
+		res, err := l.s.exec(ctx, l.s.writeDB(), "DELETE FROM certmagic_locks WHERE key_hash = ? AND owner = ?", []string{l.key}, l.s.keyHash(l.key), l.s.InstanceID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			l.s.drain.released()
+		}
+		return nil
+	})
+}
+
+func (l *Leadership) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.extend(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			caddy.Log().Named(logLocks).Warn(fmt.Sprintf("lost leadership %s: %v", l.Name, err))
+			l.once.Do(func() { close(l.lost) })
+			return
+		}
+	}
+}
+
+// extend pushes the expiry of the leadership lock out by ttl, failing if
+// another instance took it over.
+func (l *Leadership) extend(ctx context.Context) error {
+	return l.s.retryWrite(ctx, "renew", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, l.s.QueryTimeout*time.Second)
+		defer cancel()
+		res, err := l.s.exec(ctx, l.s.writeDB(), "UPDATE certmagic_locks SET expires = ? WHERE key_hash = ? AND owner = ?", []string{l.key},
+			time.Now().Add(l.ttl), l.s.keyHash(l.key), l.s.InstanceID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("lock was taken over by another instance")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+package storagesqlite
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// background tracks the goroutines a storage runs until it is closed.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// Periodic jobs by name, registered before the storage starts.
+	jobs map[string]*job
+
+	// Unix nanoseconds of the last successful backup.
+	lastBackup atomic.Int64
+	// Unix nanoseconds of the last successful vacuum.
+	lastVacuum atomic.Int64
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel, jobs: map[string]*job{}}
+}
+
+// goBackground runs fn in a goroutine until the storage is closed.
+func (s *SqliteStorage) goBackground(fn func(context.Context)) {
+	s.background.wg.Add(1)
+	go func() {
+		defer s.background.wg.Done()
+		fn(s.background.ctx)
+	}()
+}
+
+// Close stops background work, waits up to drain_timeout for running
+// operations and held locks and closes the database.
+func (s *SqliteStorage) Close() error {
+	s.background.cancel()
+	s.background.wg.Wait()
+	unregisterStorage(s)
+	s.shutdown()
+	s.handles.Lock()
+	defer s.handles.Unlock()
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	return s.Database.Close()
+}
@@ -0,0 +1,70 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// changesPath is the path of the change feed, on the admin API and on the
+// replication listener alike.
+const changesPath = "/storage/sqlite/changes"
+
+// errPlaintextListener refuses a listener without a certificate: the
+// change feed holds private keys, which auth alone doesn't keep from
+// travelling in plaintext.
+var errPlaintextListener = errors.New("listen: requires tls with cert_file, the change feed holds private keys")
+
+// listen opens the replication listener, which serves the change feed of
+// this storage outside of Caddy's admin API over TLS, mutual if tls has a
+// CA. Like Validate, it refuses to serve the feed in plaintext, also when
+// the storage wasn't validated by Caddy.
+func (s *SqliteStorage) listen() error {
+	if s.tlsFiles == nil || s.TLS.CertFile == "" {
+		return errPlaintextListener
+	}
+	ln, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return fmt.Errorf("opening replication listener: %v", err)
+	}
+	ln = tls.NewListener(ln, s.tlsFiles.serverConfig())
+	s.listener = ln
+	caddy.Log().Named(logReplication).Info(fmt.Sprintf("serving the change feed of %s on %s", s.Dsn, ln.Addr()))
+
+	server := &http.Server{
+		Handler:           http.HandlerFunc(s.serveReplication),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.goBackground(func(ctx context.Context) {
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			caddy.Log().Named(logReplication).Error(fmt.Sprintf("replication listener of %s: %v", s.Dsn, err))
+		}
+	})
+	return nil
+}
+
+// serveReplication handles the requests of the replication listener.
+func (s *SqliteStorage) serveReplication(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != changesPath {
+		http.NotFound(w, r)
+		return
+	}
+	if err := serveChanges(w, r, s); err != nil {
+		status := http.StatusInternalServerError
+		var apiErr caddy.APIError
+		if errors.As(err, &apiErr) && apiErr.HTTPStatus != 0 {
+			status = apiErr.HTTPStatus
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
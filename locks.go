@@ -0,0 +1,118 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// LockInfo describes a lock currently held in the database.
+type LockInfo struct {
+	Key        string    `json:"key"`
+	Owner      string    `json:"owner,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Pid        int64     `json:"pid,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at,omitempty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Locks returns every lock that has not expired yet.
+func (s *SqliteStorage) Locks(ctx context.Context) ([]LockInfo, error) {
+	var locks []LockInfo
+	err := s.retry(ctx, "locks", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		rows, err := s.writeDB().QueryContext(ctx, s.dialect.rebind(`SELECT key, owner, owner_host, owner_pid, acquired_at, expires
+	FROM certmagic_locks WHERE expires > ? ORDER BY key`), time.Now())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		locks = nil
+		for rows.Next() {
+			var lock LockInfo
+			var owner, host sql.NullString
+			var pid sql.NullInt64
+			var acquiredAt sql.NullTime
+			if err := rows.Scan(&lock.Key, &owner, &host, &pid, &acquiredAt, &lock.Expires); err != nil {
+				return err
+			}
+			if lock.Key, err = s.plainKey(lock.Key); err != nil {
+				return err
+			}
+			lock.Owner, lock.Host, lock.Pid, lock.AcquiredAt = owner.String, host.String, pid.Int64, acquiredAt.Time
+			locks = append(locks, lock)
+		}
+		return rows.Err()
+	})
+	return locks, err
+}
+
+// heldLocks returns the number of unexpired locks owned by the storage.
+func (s *SqliteStorage) heldLocks(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+	defer cancel()
+	var n int64
+	err := s.queryRow(ctx, s.readDB(), "SELECT count(*) FROM certmagic_locks WHERE owner = ? AND expires > ?", nil, s.InstanceID, time.Now()).Scan(&n)
+	return n, err
+}
+
+// countHeldLocks returns the locks held by every open storage for the
+// locks_held gauge. It reads them from the lock table when scraped, so
+// that locks which expired or were taken over by another instance without
+// being unlocked aren't counted.
+func countHeldLocks() float64 {
+	var total int64
+	for _, s := range registeredStorages() {
+		n, err := s.heldLocks(context.Background())
+		if err != nil {
+			caddy.Log().Named(logLocks).Warn(fmt.Sprintf("counting the locks held in %s: %v", s.Dsn, err))
+			continue
+		}
+		total += n
+	}
+	return float64(total)
+}
+
+// minLockWatchInterval keeps a tiny LockWarnAfter from running watchLocks
+// continuously, or with an interval of zero.
+const minLockWatchInterval = time.Second
+
+// lockWatchInterval is how often watchLocks runs: twice per
+// LockWarnAfter, at least once a minute and at most once a second.
+func (s *SqliteStorage) lockWatchInterval() time.Duration {
+	interval := time.Duration(s.LockWarnAfter) / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < minLockWatchInterval {
+		interval = minLockWatchInterval
+	}
+	return interval
+}
+
+// watchLocks reports locks held longer than LockWarnAfter, and returns the
+// number of locks it checked.
+func (s *SqliteStorage) watchLocks(ctx context.Context) (int64, error) {
+	locks, err := s.Locks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	long := 0
+	for _, l := range locks {
+		if l.AcquiredAt.IsZero() {
+			continue
+		}
+		if held := time.Since(l.AcquiredAt); held > time.Duration(s.LockWarnAfter) {
+			long++
+			caddy.Log().Named(logLocks).Warn(fmt.Sprintf("lock %s held for %s by %s (host %s, pid %d)",
+				l.Key, held.Round(time.Second), l.Owner, l.Host, l.Pid))
+		}
+	}
+	sqliteMetrics.longHeldLocks.Set(float64(long))
+	return int64(len(locks)), nil
+}
@@ -0,0 +1,22 @@
+package storagesqlite
+
+// Names of the loggers of the storage's subsystems. Each can be selected
+// in the include and exclude lists of Caddy's log config, for example to
+// debug SQL without the lock polling:
+//
+//	log {
+//		level DEBUG
+//		include storage.sqlite.sql
+//	}
+const (
+	// Configuration, retries and write conflicts.
+	logStorage = "storage.sqlite"
+	// Statements logged with log_queries.
+	logSQL = "storage.sqlite.sql"
+	// Lock polling, waits, the lock watchdog and leadership.
+	logLocks = "storage.sqlite.locks"
+	// Maintenance operations, backups and auto_import.
+	logMaintenance = "storage.sqlite.maintenance"
+	// Replication and its conflicts.
+	logReplication = "storage.sqlite.replication"
+)
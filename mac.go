@@ -0,0 +1,128 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// IntegrityError is returned by Load when the MAC of a row does not match
+// its key, value, modification time and version, or is missing, because the row was
+// changed without the MAC key, such as by editing the database file.
+type IntegrityError struct {
+	Key string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("MAC mismatch for key: %s", e.Key)
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// rowMAC returns the HMAC-SHA256 of the key, the decoded value, the
+// modification time and the version of a row, each prefixed with its
+// length. The version tells an older copy of the row apart.
+func (s *SqliteStorage) rowMAC(key string, value []byte, modified time.Time, version int64) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	for _, field := range [][]byte{[]byte(key), value, []byte(modified.UTC().Format(time.RFC3339Nano)), []byte(strconv.FormatInt(version, 10))} {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(field)))
+		mac.Write(size[:])
+		mac.Write(field)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMAC returns an *IntegrityError if the MAC of a row is missing or
+// does not match, when a MAC key is configured.
+func (s *SqliteStorage) verifyMAC(key string, value []byte, modified time.Time, version int64, mac sql.NullString) error {
+	if s.macKey == nil {
+		return nil
+	}
+	if mac.Valid && hmac.Equal([]byte(mac.String), []byte(s.rowMAC(key, value, modified, version))) {
+		return nil
+	}
+	sqliteMetrics.corruptions.Inc()
+	return &IntegrityError{Key: key}
+}
+
+// signRow records the MAC of the row of key in tx.
+func (s *SqliteStorage) signRow(ctx context.Context, tx *sql.Tx, key string) error {
+	keyHash := s.keyHash(key)
+	var stored []byte
+	var encoding sql.NullString
+	var modified time.Time
+	var version int64
+	err := s.queryRow(ctx, tx, "SELECT value, encoding, modified, version FROM certmagic_data WHERE key_hash = ?", []string{key}, keyHash).Scan(&stored, &encoding, &modified, &version)
+	if err != nil {
+		return err
+	}
+	value, err := s.decodeValue(key, newSecret(stored), encoding)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, tx, "UPDATE certmagic_data SET mac = ? WHERE key_hash = ?", []string{key}, s.rowMAC(key, value.reveal(), modified, version), keyHash)
+	return err
+}
+
+// signRows records the MAC of the rows written before the MAC key was
+// configured. Rows written by instances without the MAC key afterwards
+// fail to load.
+func (s *SqliteStorage) signRows(ctx context.Context) error {
+	var keys []string
+	err := s.retry(ctx, "sign_scan", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		rows, err := s.query(ctx, s.writeDB(), "SELECT key FROM certmagic_data WHERE mac IS NULL", nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys = keys[:0]
+		for rows.Next() {
+			var stored string
+			if err := rows.Scan(&stored); err != nil {
+				return err
+			}
+			key, err := s.plainKey(stored)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	err = s.retryWrite(ctx, "sign", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, key := range keys {
+			if err := s.signRow(ctx, tx, key); err != nil {
+				return fmt.Errorf("signing %s: %v", key, err)
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("recorded the MAC of %d rows of %s", len(keys), s.Dsn))
+	return nil
+}
@@ -0,0 +1,177 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Maintenance operations run by Maintain.
+const (
+	MaintenanceVacuum     = "vacuum"
+	MaintenanceCheckpoint = "checkpoint"
+	MaintenanceAnalyze    = "analyze"
+	MaintenanceLockGC     = "lock_gc"
+	// Frees unused pages of a sqlite database in incremental auto_vacuum
+	// mode without rewriting it.
+	MaintenanceIncrementalVacuum = "incremental_vacuum"
+	// Checks the consistency of a sqlite database and fails if it finds
+	// problems.
+	MaintenanceIntegrityCheck = "integrity_check"
+	// Rewrites a sqlite database into a new file and swaps it in, pausing
+	// writes only for the swap rather than for the whole VACUUM.
+	MaintenanceRebuild = "rebuild"
+)
+
+// autoVacuumIncremental is the value of PRAGMA auto_vacuum in incremental
+// mode.
+const autoVacuumIncremental = 2
+
+// MaintenanceResult describes a finished maintenance operation.
+type MaintenanceResult struct {
+	Operation string `json:"operation"`
+	Duration  string `json:"duration"`
+	// Bytes the database and its WAL shrank by.
+	Reclaimed int64 `json:"reclaimed_bytes"`
+	// Expired locks removed by lock_gc.
+	RemovedLocks int64 `json:"removed_locks,omitempty"`
+}
+
+// integrityProblems returns the problems reported by an integrity check.
+func integrityProblems(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return nil, err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// maintenanceStatement returns the statement running op for the dialect.
+func (d *dialect) maintenanceStatement(op string) (string, error) {
+	switch {
+	case op == MaintenanceVacuum && d.name == "mysql":
+		return "OPTIMIZE TABLE certmagic_data, certmagic_locks", nil
+	case op == MaintenanceVacuum:
+		return "VACUUM", nil
+	case op == MaintenanceIncrementalVacuum && d.name == "sqlite":
+		return "PRAGMA incremental_vacuum", nil
+	case op == MaintenanceCheckpoint && d.name == "sqlite":
+		return "PRAGMA wal_checkpoint(TRUNCATE)", nil
+	case op == MaintenanceIntegrityCheck && d.name == "sqlite":
+		return "PRAGMA integrity_check", nil
+	case op == MaintenanceRebuild && d.name == "sqlite":
+		return "VACUUM INTO ?", nil
+	case op == MaintenanceAnalyze && d.name == "mysql":
+		return "ANALYZE TABLE certmagic_data, certmagic_locks", nil
+	case op == MaintenanceAnalyze:
+		return "ANALYZE", nil
+	case op == MaintenanceLockGC:
+		return "DELETE FROM certmagic_locks WHERE expires < ?", nil
+	case op == MaintenanceCheckpoint, op == MaintenanceIncrementalVacuum, op == MaintenanceIntegrityCheck, op == MaintenanceRebuild:
+		return "", fmt.Errorf("%s is not supported for %s", op, d.name)
+	}
+	return "", fmt.Errorf("unknown maintenance operation: %s", op)
+}
+
+// diskSize returns the size of the database including its WAL.
+func (s *SqliteStorage) diskSize(ctx context.Context) (int64, error) {
+	var size int64
+	if err := s.writeDB().QueryRowContext(ctx, s.dialect.sizeQuery).Scan(&size); err != nil {
+		return 0, err
+	}
+	if s.dialect == dialects[Sqlite] {
+		size += fileSize(dbFilePath(s.Dsn) + "-wal")
+	}
+	return size, nil
+}
+
+// Maintain runs the maintenance operation op: vacuum, incremental_vacuum,
+// checkpoint, integrity_check and rebuild (sqlite only), analyze or
+// lock_gc, which removes expired locks.
+func (s *SqliteStorage) Maintain(ctx context.Context, op string) (MaintenanceResult, error) {
+	statement, err := s.dialect.maintenanceStatement(op)
+	if err != nil {
+		return MaintenanceResult{}, err
+	}
+	before, err := s.diskSize(ctx)
+	if err != nil {
+		return MaintenanceResult{}, err
+	}
+
+	result := MaintenanceResult{Operation: op}
+	start := time.Now()
+	if op == MaintenanceRebuild {
+		err = s.rebuild(ctx, statement)
+	} else {
+		err = s.retryWrite(ctx, op, s.maintenanceFunc(op, statement, &result))
+	}
+	if err != nil {
+		return MaintenanceResult{}, fmt.Errorf("%s: %v", op, err)
+	}
+	result.Duration = time.Since(start).String()
+
+	after, err := s.diskSize(ctx)
+	if err != nil {
+		return MaintenanceResult{}, err
+	}
+	result.Reclaimed = before - after
+	if op == MaintenanceVacuum || op == MaintenanceIncrementalVacuum || op == MaintenanceRebuild {
+		if err := s.recordVacuum(ctx); err != nil {
+			caddy.Log().Named(logMaintenance).Warn(fmt.Sprintf("recording vacuum: %v", err))
+		}
+	}
+	caddy.Log().Named(logMaintenance).Info(fmt.Sprintf("%s took %s and reclaimed %d bytes", op, result.Duration, result.Reclaimed))
+	return result, nil
+}
+
+// maintenanceFunc returns the write running the statement of op.
+func (s *SqliteStorage) maintenanceFunc(op, statement string, result *MaintenanceResult) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if op == MaintenanceIncrementalVacuum {
+			// Every step frees one page, Exec would only run the first.
+			rows, err := s.query(ctx, s.writeDB(), statement, nil)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+			}
+			return rows.Err()
+		}
+		if op == MaintenanceIntegrityCheck {
+			rows, err := s.query(ctx, s.writeDB(), statement, nil)
+			if err != nil {
+				return err
+			}
+			problems, err := integrityProblems(rows)
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+			}
+			return nil
+		}
+		if op != MaintenanceLockGC {
+			_, err := s.exec(ctx, s.writeDB(), statement, nil)
+			return err
+		}
+		res, err := s.exec(ctx, s.writeDB(), statement, nil, time.Now())
+		if err != nil {
+			return err
+		}
+		result.RemovedLocks, err = res.RowsAffected()
+		return err
+	}
+}
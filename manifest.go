@@ -0,0 +1,180 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Manifest lists the SHA-256 of the value of every key of a storage at one
+// point in time, signed with an Ed25519 key, to attest later that the
+// storage did not drift or was not tampered with.
+type Manifest struct {
+	// The dsn of the storage, without credentials.
+	Dsn     string    `json:"dsn"`
+	Created time.Time `json:"created"`
+	// Hex encoded SHA-256 of the value of every key.
+	Keys map[string]string `json:"keys"`
+	// Base64 encoded Ed25519 signature of the manifest without it.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Manifest returns the unsigned manifest of the keys of the database, read
+// in a single transaction.
+func (s *SqliteStorage) Manifest(ctx context.Context) (*Manifest, error) {
+	m := &Manifest{Dsn: redactDSN(s.Dsn), Created: time.Now().UTC(), Keys: map[string]string{}}
+	err := s.View(ctx, func(v *ReadView) error {
+		keys, err := v.List(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			value, err := v.Load(ctx, key)
+			if err != nil {
+				return fmt.Errorf("loading %s: %v", key, err)
+			}
+			m.Keys[key] = valueChecksum(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var (
+	// dsnUserinfoRE matches the password of user:password@ in URLs and
+	// MySQL DSNs.
+	dsnUserinfoRE = regexp.MustCompile(`^([a-zA-Z][\w+.-]*://)?([^:@/?\s]+):([^@/?\s]*)@`)
+	// dsnSecretParamRE matches the values of query or key=value parameters
+	// naming passwords, secrets or tokens.
+	dsnSecretParamRE = regexp.MustCompile(`(?i)((?:^|[?&\s])[\w.]*(?:pass|pwd|secret|token|key)[\w.]*=)('[^']*'|[^&\s]*)`)
+)
+
+// redactDSN returns dsn with its passwords and secret parameters replaced,
+// for writing it where the credentials don't belong.
+func redactDSN(dsn string) string {
+	dsn = dsnUserinfoRE.ReplaceAllString(dsn, "${1}${2}:"+redacted+"@")
+	return dsnSecretParamRE.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// signedBytes returns the JSON of the manifest without its signature,
+// which encoding/json writes with sorted keys.
+func (m *Manifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign signs the manifest with key.
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return nil
+}
+
+// VerifySignature checks that the manifest was signed with the private key
+// of key and not changed since.
+func (m *Manifest) VerifySignature(key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || m.Signature == "" {
+		return errors.New("the manifest is not signed")
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return errors.New("invalid manifest signature")
+	}
+	return nil
+}
+
+// verifyManifest compares the database with a manifest, reporting keys
+// present on only one side and keys whose values changed.
+func (s *SqliteStorage) verifyManifest(ctx context.Context, m *Manifest) ([]Difference, error) {
+	current, err := s.Manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []Difference
+	for key, sum := range m.Keys {
+		now, ok := current.Keys[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Key: key, Reason: "missing from database"})
+		case now != sum:
+			diffs = append(diffs, Difference{Key: key, Reason: "value changed"})
+		}
+	}
+	for key := range current.Keys {
+		if _, ok := m.Keys[key]; !ok {
+			diffs = append(diffs, Difference{Key: key, Reason: "missing from manifest"})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// readPEMBlock returns the DER bytes of the first PEM block of the file
+// name.
+func readPEMBlock(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", name)
+	}
+	return block.Bytes, nil
+}
+
+// loadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file, as
+// written by openssl genpkey -algorithm ed25519.
+func loadSigningKey(name string) (ed25519.PrivateKey, error) {
+	der, err := readPEMBlock(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", name)
+	}
+	return private, nil
+}
+
+// loadVerifyKey reads an Ed25519 public key from a PKIX PEM file, as
+// written by openssl pkey -pubout.
+func loadVerifyKey(name string) (ed25519.PublicKey, error) {
+	der, err := readPEMBlock(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", name)
+	}
+	return public, nil
+}
@@ -0,0 +1,238 @@
+package storagesqlite
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sqliteMetrics = struct {
+	init         sync.Once
+	retries      *prometheus.CounterVec
+	lockWait     prometheus.Histogram
+	lockFailures prometheus.Counter
+	locksHeld    prometheus.GaugeFunc
+	corruptions  prometheus.Counter
+
+	longHeldLocks prometheus.Gauge
+	longLockWaits prometheus.Counter
+
+	writeConflicts  prometheus.Counter
+	throttledWrites *prometheus.CounterVec
+	cacheRequests   *prometheus.CounterVec
+	skippedWrites   prometheus.Counter
+	writeQueue      prometheus.Gauge
+	files           *fileCollector
+	startupPhases   *prometheus.GaugeVec
+	reopens         prometheus.Counter
+	walCheckpoints  prometheus.Counter
+	readOnly        prometheus.Gauge
+
+	breakerState       prometheus.Gauge
+	breakerTransitions *prometheus.CounterVec
+
+	replicatedChanges *prometheus.CounterVec
+	replicationLag    *prometheus.GaugeVec
+
+	latency *prometheus.HistogramVec
+
+	jobRuns        *prometheus.CounterVec
+	jobDuration    *prometheus.GaugeVec
+	jobItems       *prometheus.CounterVec
+	jobLastRun     *prometheus.GaugeVec
+	jobLastSuccess *prometheus.GaugeVec
+}{}
+
+func initSqliteMetrics() {
+	sqliteMetrics.init.Do(func() {
+		const ns, sub = "caddy", "storage_sqlite"
+
+		sqliteMetrics.retries = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "retries_total",
+			Help:      "Number of storage operations retried after a transient sqlite error.",
+		}, []string{"operation"})
+		sqliteMetrics.lockWait = promauto.NewHistogram(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent in Lock until the lock was acquired or acquisition failed.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		})
+		sqliteMetrics.lockFailures = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "lock_failures_total",
+			Help:      "Number of Lock calls that failed to acquire the lock.",
+		})
+		sqliteMetrics.locksHeld = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "locks_held",
+			Help:      "Number of unexpired locks held by this process.",
+		}, countHeldLocks)
+		sqliteMetrics.corruptions = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "checksum_mismatches_total",
+			Help:      "Number of loaded values that did not match their stored checksum.",
+		})
+		sqliteMetrics.longHeldLocks = promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "long_held_locks",
+			Help:      "Number of locks held longer than lock_warn_after at the last watchdog check.",
+		})
+		sqliteMetrics.longLockWaits = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "long_lock_waits_total",
+			Help:      "Number of Lock calls that waited longer than lock_warn_after.",
+		})
+		sqliteMetrics.writeConflicts = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "write_conflicts_total",
+			Help:      "Number of writes that overwrote an update from another instance this instance had not seen.",
+		})
+		sqliteMetrics.throttledWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "throttled_writes_total",
+			Help:      "Number of Store calls rejected by the write rate limit.",
+		}, []string{"prefix"})
+		sqliteMetrics.cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "cache_requests_total",
+			Help:      "Number of read cache lookups by result (hit, miss or stale).",
+		}, []string{"result"})
+		sqliteMetrics.skippedWrites = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "unchanged_writes_skipped_total",
+			Help:      "Number of Store calls skipped because the value was unchanged.",
+		})
+		sqliteMetrics.writeQueue = promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "write_queue_depth",
+			Help:      "Number of writes waiting for or holding the sqlite writer connection.",
+		})
+		sqliteMetrics.startupPhases = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "startup_phase_seconds",
+			Help:      "Time the phases of the last storage startup took.",
+		}, []string{"phase"})
+		sqliteMetrics.reopens = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "reopens_total",
+			Help:      "Number of times the health check reopened the database.",
+		})
+		sqliteMetrics.walCheckpoints = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wal_checkpoints_forced_total",
+			Help:      "Number of checkpoints forced by the WAL growing past max_wal_size.",
+		})
+		sqliteMetrics.readOnly = promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "read_only",
+			Help:      "1 while the storage is degraded to read-only after failed writes.",
+		})
+		sqliteMetrics.breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker: 0 closed, 1 open, 2 half open.",
+		})
+		sqliteMetrics.breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "circuit_breaker_transitions_total",
+			Help:      "Number of times the circuit breaker changed to a state.",
+		}, []string{"state"})
+		sqliteMetrics.replicatedChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "replication_changes_total",
+			Help:      "Number of remote changes pulled by replication, by whether they were applied, skipped or lost a conflict.",
+		}, []string{"result"})
+		sqliteMetrics.replicationLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "replication_lag",
+			Help:      "Number of change feed sequence numbers not yet pushed to a follower, by host of the follower.",
+		}, []string{"follower"})
+		sqliteMetrics.latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "operation_duration_seconds",
+			Help:      "Time storage operations took, by operation and key category (certificates, acme, ocsp, locks or other).",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"operation", "category"})
+		sqliteMetrics.jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "job_runs_total",
+			Help:      "Number of background job runs by storage, job and result (success, failure, or skipped while running on another instance).",
+		}, []string{"storage", "job", "result"})
+		sqliteMetrics.jobDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "job_last_duration_seconds",
+			Help:      "Time the last run of a background job took.",
+		}, []string{"storage", "job"})
+		sqliteMetrics.jobItems = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "job_items_total",
+			Help:      "Number of items, such as removed locks or pulled changes, processed by background jobs.",
+		}, []string{"storage", "job"})
+		sqliteMetrics.jobLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "job_last_run_timestamp_seconds",
+			Help:      "Unix time the last run of a background job started.",
+		}, []string{"storage", "job"})
+		sqliteMetrics.jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "job_last_success_timestamp_seconds",
+			Help:      "Unix time the last successful run of a background job started.",
+		}, []string{"storage", "job"})
+		sqliteMetrics.files = newFileCollector(ns, sub)
+		prometheus.MustRegister(sqliteMetrics.files)
+	})
+}
+
+// keyCategories are the top-level key prefixes operation latency is
+// labeled by, other keys are labeled other.
+var keyCategories = map[string]bool{
+	"certificates": true,
+	"acme":         true,
+	"ocsp":         true,
+}
+
+// keyCategory returns the latency label of key for operation.
+func keyCategory(operation, key string) string {
+	if operation == "lock" || operation == "unlock" {
+		return "locks"
+	}
+	if prefix := keyPrefix(key); keyCategories[prefix] {
+		return prefix
+	}
+	return "other"
+}
+
+// observeLatency records the time since start of operation on key, or on
+// the prefix of a list.
+func observeLatency(operation, key string, start time.Time) {
+	sqliteMetrics.latency.WithLabelValues(operation, keyCategory(operation, key)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,256 @@
+package storagesqlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+// StorageMiddleware wraps the operations of the storage, so that plugins
+// add behavior such as auditing, extra caching or key rewriting around
+// them without changing the storage itself. Wrap returns the storage that
+// handles the calls in place of next, usually a struct embedding next that
+// overrides the methods it is interested in and calls next from them.
+//
+// Middlewares are Caddy modules in the caddy.storage.sqlite.middleware
+// namespace, listed in the middleware option in order: the first one is
+// the outermost and sees every call first.
+type StorageMiddleware interface {
+	Wrap(next certmagic.Storage) certmagic.Storage
+}
+
+// Chain wraps storage in middlewares, the first one outermost. A wrapped
+// *SqliteStorage keeps its other methods, see chain.
+func Chain(storage certmagic.Storage, middlewares ...StorageMiddleware) certmagic.Storage {
+	inner := storage
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		storage = middlewares[i].Wrap(storage)
+	}
+	if s, ok := inner.(*SqliteStorage); ok && len(middlewares) > 0 {
+		return &chain{SqliteStorage: s, outer: storage}
+	}
+	return storage
+}
+
+// chain is a *SqliteStorage wrapped in middlewares. Its certmagic.Storage
+// methods go through the middlewares. So do the other methods addressing
+// keys, such as LoadMany and Move: they call the outermost middleware if
+// it has them, and are made of its certmagic.Storage methods otherwise.
+// The methods acting on the whole storage, such as Stats, Backup or View,
+// go to the storage directly.
+type chain struct {
+	*SqliteStorage
+	outer certmagic.Storage
+}
+
+func (c *chain) Lock(ctx context.Context, key string) error   { return c.outer.Lock(ctx, key) }
+func (c *chain) Unlock(ctx context.Context, key string) error { return c.outer.Unlock(ctx, key) }
+func (c *chain) Store(ctx context.Context, key string, value []byte) error {
+	return c.outer.Store(ctx, key, value)
+}
+func (c *chain) Load(ctx context.Context, key string) ([]byte, error) { return c.outer.Load(ctx, key) }
+func (c *chain) Delete(ctx context.Context, key string) error         { return c.outer.Delete(ctx, key) }
+func (c *chain) Exists(ctx context.Context, key string) bool          { return c.outer.Exists(ctx, key) }
+func (c *chain) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	return c.outer.List(ctx, prefix, recursive)
+}
+func (c *chain) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	return c.outer.Stat(ctx, key)
+}
+
+func (c *chain) LoadWithInfo(ctx context.Context, key string) ([]byte, certmagic.KeyInfo, error) {
+	if o, ok := c.outer.(interface {
+		LoadWithInfo(context.Context, string) ([]byte, certmagic.KeyInfo, error)
+	}); ok {
+		return o.LoadWithInfo(ctx, key)
+	}
+	value, err := c.outer.Load(ctx, key)
+	if err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+	info, err := c.outer.Stat(ctx, key)
+	return value, info, err
+}
+
+// StoreWithModTime fails unless the outermost middleware has it, as Store
+// can't keep the modification time.
+func (c *chain) StoreWithModTime(ctx context.Context, key string, value []byte, modified time.Time) error {
+	if o, ok := c.outer.(interface {
+		StoreWithModTime(context.Context, string, []byte, time.Time) error
+	}); ok {
+		return o.StoreWithModTime(ctx, key, value, modified)
+	}
+	if modified.IsZero() {
+		return c.outer.Store(ctx, key, value)
+	}
+	return fmt.Errorf("storing %s with a modification time: %w by the storage middleware", key, errors.ErrUnsupported)
+}
+
+func (c *chain) LoadMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	if o, ok := c.outer.(interface {
+		LoadMany(context.Context, []string) (map[string][]byte, error)
+	}); ok {
+		return o.LoadMany(ctx, keys)
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, err := c.outer.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (c *chain) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	if o, ok := c.outer.(interface {
+		DeletePrefix(context.Context, string) (int64, error)
+	}); ok {
+		return o.DeletePrefix(ctx, prefix)
+	}
+	// List the directory of prefix, and delete what starts with it.
+	dir := strings.TrimSuffix(prefix[:strings.LastIndex(prefix, "/")+1], "/")
+	var deleted int64
+	err := c.ListFunc(ctx, dir, true, func(key string) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		if err := c.outer.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return deleted, err
+}
+
+func (c *chain) Move(ctx context.Context, oldKey, newKey string) error {
+	if o, ok := c.outer.(interface {
+		Move(context.Context, string, string) error
+	}); ok {
+		return o.Move(ctx, oldKey, newKey)
+	}
+	if err := c.Copy(ctx, oldKey, newKey); err != nil {
+		return err
+	}
+	return c.outer.Delete(ctx, oldKey)
+}
+
+func (c *chain) Copy(ctx context.Context, srcKey, dstKey string) error {
+	if o, ok := c.outer.(interface {
+		Copy(context.Context, string, string) error
+	}); ok {
+		return o.Copy(ctx, srcKey, dstKey)
+	}
+	value, err := c.outer.Load(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	return c.outer.Store(ctx, dstKey, value)
+}
+
+func (c *chain) ListFunc(ctx context.Context, prefix string, recursive bool, fn func(key string) error) error {
+	if o, ok := c.outer.(interface {
+		ListFunc(context.Context, string, bool, func(string) error) error
+	}); ok {
+		return o.ListFunc(ctx, prefix, recursive, fn)
+	}
+	keys, err := c.outer.List(ctx, prefix, recursive)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Kind falls back to the kind of the key name, which is the recorded kind
+// unless keys are hidden.
+func (c *chain) Kind(ctx context.Context, key string) (string, error) {
+	if o, ok := c.outer.(interface {
+		Kind(context.Context, string) (string, error)
+	}); ok {
+		return o.Kind(ctx, key)
+	}
+	if _, err := c.outer.Stat(ctx, key); err != nil {
+		return "", err
+	}
+	return keyKind(key), nil
+}
+
+// loadMiddleware loads the middleware modules of the config. They are
+// loaded by ID rather than with ctx.LoadModule, which doesn't recognize
+// json.RawMessage where it is an alias of jsontext.Value.
+func (c *SqliteStorage) loadMiddleware(ctx caddy.Context) error {
+	c.middleware = nil
+	for i, raw := range c.MiddlewareRaw {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return fmt.Errorf("middleware %d: %v", i, err)
+		}
+		var name string
+		if err := json.Unmarshal(fields["middleware"], &name); err != nil || name == "" {
+			return fmt.Errorf("middleware %d: missing module name", i)
+		}
+		delete(fields, "middleware")
+		config, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		mod, err := ctx.LoadModuleByID("caddy.storage.sqlite.middleware."+name, config)
+		if err != nil {
+			return fmt.Errorf("middleware %d: %v", i, err)
+		}
+		m, ok := mod.(StorageMiddleware)
+		if !ok {
+			return fmt.Errorf("middleware %d: module %s is not a storage middleware", i, name)
+		}
+		c.middleware = append(c.middleware, m)
+	}
+	return nil
+}
+
+// unmarshalMiddleware parses a middleware subdirective, whose first
+// argument names the module and whose remaining tokens configure it:
+//
+//	middleware <name> [<args...>] {
+//		...
+//	}
+func (c *SqliteStorage) unmarshalMiddleware(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	mod, err := caddyfile.UnmarshalModule(d, "caddy.storage.sqlite.middleware."+name)
+	if err != nil {
+		return err
+	}
+	if _, ok := mod.(StorageMiddleware); !ok {
+		return d.Errf("module %s is not a storage middleware", name)
+	}
+	var warnings []caddyconfig.Warning
+	c.MiddlewareRaw = append(c.MiddlewareRaw, caddyconfig.JSONModuleObject(mod, "middleware", name, &warnings))
+	if len(warnings) > 0 {
+		return d.Errf("middleware %s: %s", name, warnings[0].Message)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package storagesqlite
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// certificateUpdatedEvent is the name of the Caddy event emitted after a
+// certificate was written.
+const certificateUpdatedEvent = "certificate_updated"
+
+// CertificateInfo describes a stored certificate, so that a cache can be
+// primed without walking the storage with List and Load.
+type CertificateInfo struct {
+	// The key of the certificate, and of its private key and metadata,
+	// empty if missing.
+	Key        string `json:"key"`
+	PrivateKey string `json:"private_key,omitempty"`
+	Metadata   string `json:"metadata,omitempty"`
+	// The issuer directory, such as acme-v02.api.letsencrypt.org-directory.
+	Issuer string `json:"issuer,omitempty"`
+	// The DNS names and IP addresses of the leaf certificate.
+	Domains   []string  `json:"domains"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// certInfos caches the parsed certificates by key with the version they
+// were parsed from.
+type certInfos struct {
+	mu    sync.Mutex
+	byKey map[string]cachedCertInfo
+}
+
+type cachedCertInfo struct {
+	version int64
+	info    CertificateInfo
+	// The certificate failed to parse and is skipped until it changes.
+	invalid bool
+}
+
+func newCertInfos() *certInfos {
+	return &certInfos{byKey: map[string]cachedCertInfo{}}
+}
+
+// PreloadCertificates returns the certificates stored in the certmagic
+// layout with their domains and expiry, sorted by key. Certificates are
+// parsed once and only loaded again after they changed, so that calling
+// it repeatedly is cheap. Certificates that fail to parse are skipped.
+func (s *SqliteStorage) PreloadCertificates(ctx context.Context) ([]CertificateInfo, error) {
+	const prefix = "certificates/"
+	versions := map[string]int64{}
+	err := s.retry(ctx, "preload", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		cond, args := s.prefixCond(prefix)
+		rows, err := s.query(ctx, s.readDB(), "SELECT key, version FROM certmagic_data WHERE "+cond, []string{prefix}, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(versions)
+		for rows.Next() {
+			var stored string
+			var version int64
+			if err := rows.Scan(&stored, &version); err != nil {
+				return err
+			}
+			key, ok, err := s.matchKey(stored, prefix)
+			if err != nil {
+				return err
+			}
+			if ok {
+				versions[key] = version
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.certInfos.mu.Lock()
+	defer s.certInfos.mu.Unlock()
+	var changed []string
+	for key, version := range versions {
+		if keyKind(key) != KindCertificate {
+			continue
+		}
+		if cached, ok := s.certInfos.byKey[key]; !ok || cached.version != version {
+			changed = append(changed, key)
+		}
+	}
+	values, err := s.LoadMany(ctx, changed)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range changed {
+		info, err := parseCertificateInfo(key, values[key])
+		if err != nil {
+			caddy.Log().Named(logStorage).Warn(fmt.Sprintf("not preloading %s: %v", key, err))
+			s.certInfos.byKey[key] = cachedCertInfo{version: versions[key], invalid: true}
+			continue
+		}
+		s.certInfos.byKey[key] = cachedCertInfo{version: versions[key], info: info}
+	}
+
+	var infos []CertificateInfo
+	for key, cached := range s.certInfos.byKey {
+		if _, ok := versions[key]; !ok {
+			delete(s.certInfos.byKey, key)
+			continue
+		}
+		if cached.invalid {
+			continue
+		}
+		info := cached.info
+		base := strings.TrimSuffix(key, ".crt")
+		if _, ok := versions[base+".key"]; ok {
+			info.PrivateKey = base + ".key"
+		}
+		if _, ok := versions[base+".json"]; ok {
+			info.Metadata = base + ".json"
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// parseCertificateInfo parses the leaf of the PEM certificate chain stored
+// at key, certificates/<issuer>/<name>/<name>.crt.
+func parseCertificateInfo(key string, value []byte) (CertificateInfo, error) {
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return CertificateInfo{}, fmt.Errorf("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	info := CertificateInfo{
+		Key:       key,
+		Domains:   append([]string{}, cert.DNSNames...),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		info.Domains = append(info.Domains, ip.String())
+	}
+	if parts := strings.Split(key, "/"); len(parts) == 4 {
+		info.Issuer = parts[1]
+	}
+	return info, nil
+}
+
+// certificateUpdated emits certificateUpdatedEvent for the certificate
+// just stored at key, so that it can be deployed elsewhere without
+// polling the storage.
+func (s *SqliteStorage) certificateUpdated(key string, value []byte) {
+	if s.events == nil {
+		return
+	}
+	data, err := certificateEventData(key, value)
+	if err != nil {
+		caddy.Log().Named(logStorage).Warn(fmt.Sprintf("not emitting %s for %s: %v", certificateUpdatedEvent, key, err))
+		return
+	}
+	s.emit(certificateUpdatedEvent, data)
+}
+
+// certificateEventData returns the data of certificateUpdatedEvent: the
+// key, issuer and domain the certificate is stored under, the names it is
+// valid for and when it expires.
+func certificateEventData(key string, value []byte) (map[string]any, error) {
+	info, err := parseCertificateInfo(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"key":       key,
+		"issuer":    info.Issuer,
+		"domain":    strings.TrimSuffix(path.Base(key), ".crt"),
+		"names":     info.Domains,
+		"not_after": info.NotAfter,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type rowsQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// exec rebinds and runs a statement on e, logging it with log_queries.
+// keys are the key names or prefixes the statement is about; args are
+// never logged, they may hold values.
+func (s *SqliteStorage) exec(ctx context.Context, e execer, query string, keys []string, args ...interface{}) (sql.Result, error) {
+	if s.explained != nil {
+		s.explain(ctx, e, query, args)
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, s.dialect.rebind(query), args...)
+	if s.queryLog != nil {
+		var rows int64 = -1
+		if err == nil {
+			rows, _ = res.RowsAffected()
+		}
+		s.logQuery(query, keys, rows, start, err)
+	}
+	return res, err
+}
+
+// query rebinds and runs a query on q like exec. The duration logged is
+// the time until the first row is available.
+func (s *SqliteStorage) query(ctx context.Context, q rowsQueryer, query string, keys []string, args ...interface{}) (*sql.Rows, error) {
+	if s.explained != nil {
+		s.explain(ctx, q, query, args)
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if s.queryLog != nil {
+		s.logQuery(query, keys, -1, start, err)
+	}
+	return rows, err
+}
+
+// queryRow rebinds and runs a single row query on q like exec. Errors
+// are reported by Scan and not logged.
+func (s *SqliteStorage) queryRow(ctx context.Context, q queryer, query string, keys []string, args ...interface{}) *sql.Row {
+	if s.explained != nil {
+		s.explain(ctx, q, query, args)
+	}
+	start := time.Now()
+	row := q.QueryRowContext(ctx, s.dialect.rebind(query), args...)
+	if s.queryLog != nil {
+		s.logQuery(query, keys, -1, start, nil)
+	}
+	return row
+}
+
+// logQuery writes one debug entry per statement. rows is -1 if the
+// number of affected rows is unknown.
+func (s *SqliteStorage) logQuery(query string, keys []string, rows int64, start time.Time, err error) {
+	fields := []zap.Field{
+		zap.String("query", query),
+		zap.Strings("keys", keys),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if rows >= 0 {
+		fields = append(fields, zap.Int64("rows", rows))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	s.queryLog.Debug("query", fields...)
+}
+
+// queryPlans logs the plans of the statements run with explain_queries.
+type queryPlans struct {
+	log *zap.Logger
+	// statements whose plan was logged.
+	seen sync.Map
+}
+
+// explain logs the query plan of query the first time it runs with
+// explain_queries, and warns if it scans a whole table. The plan is read
+// on the connection or transaction the query runs on, before it runs.
+func (s *SqliteStorage) explain(ctx context.Context, db any, query string, args []interface{}) {
+	q, ok := db.(rowsQueryer)
+	if !ok {
+		return
+	}
+	verb, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	switch strings.ToUpper(verb) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH":
+	default:
+		return
+	}
+	if _, seen := s.explained.seen.LoadOrStore(query, true); seen {
+		return
+	}
+
+	log := s.explained.log
+	rows, err := q.QueryContext(ctx, "EXPLAIN QUERY PLAN "+s.dialect.rebind(query), args...)
+	if err != nil {
+		log.Warn("explaining query", zap.String("query", query), zap.Error(err))
+		return
+	}
+	defer rows.Close()
+	var plan, scans []string
+	for rows.Next() {
+		var id, parent, notUsed int64
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			log.Warn("explaining query", zap.String("query", query), zap.Error(err))
+			return
+		}
+		plan = append(plan, detail)
+		if isTableScan(detail) {
+			scans = append(scans, detail)
+		}
+	}
+	log.Info("query plan", zap.String("query", query), zap.Strings("plan", plan))
+	if len(scans) > 0 {
+		log.Warn("query scans a whole table, an index may be missing", zap.String("query", query), zap.Strings("scans", scans))
+	}
+}
+
+// isTableScan reports whether a step of a sqlite query plan reads every
+// row of a table rather than searching an index.
+func isTableScan(detail string) bool {
+	return strings.HasPrefix(detail, "SCAN ") && !strings.Contains(detail, " USING ")
+}
@@ -0,0 +1,107 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit throttles Store operations with a token bucket per key prefix,
+// the first segment of the key such as "certificates" or "ocsp".
+type RateLimit struct {
+	// Sustained number of writes per second allowed per prefix.
+	Rate float64 `json:"rate,omitempty"`
+	// Number of writes allowed in a burst above the rate. Defaults to the
+	// rate rounded up, but at least 1.
+	Burst int `json:"burst,omitempty"`
+}
+
+func (r *RateLimit) setDefaults() {
+	if r.Burst == 0 {
+		r.Burst = int(math.Max(1, math.Ceil(r.Rate)))
+	}
+}
+
+// ThrottledError is returned by Store when the write rate limit of the
+// key's prefix is exhausted. The write can be retried after RetryAfter.
+type ThrottledError struct {
+	Key        string
+	Prefix     string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("write to %s throttled: rate limit of prefix %q exceeded, retry after %v", e.Key, e.Prefix, e.RetryAfter)
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// keyPrefix returns the first path segment of key.
+func keyPrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, "/")
+	return prefix
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per prefix.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(r *RateLimit) *rateLimiter {
+	if r == nil || r.Rate <= 0 {
+		return nil
+	}
+	r.setDefaults()
+	return &rateLimiter{
+		rate:    r.Rate,
+		burst:   float64(r.Burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take removes a token from the bucket of prefix. If none is left it
+// returns how long it takes until the next token is available.
+func (l *rateLimiter) take(prefix string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[prefix]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[prefix] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// throttle returns a *ThrottledError if a write to key exceeds the rate
+// limit.
+func (s *SqliteStorage) throttle(key string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	prefix := keyPrefix(key)
+	retryAfter, ok := s.limiter.take(prefix, time.Now())
+	if ok {
+		return nil
+	}
+	sqliteMetrics.throttledWrites.WithLabelValues(prefix).Inc()
+	return &ThrottledError{Key: key, Prefix: prefix, RetryAfter: retryAfter}
+}
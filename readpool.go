@@ -0,0 +1,124 @@
+package storagesqlite
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+)
+
+// readOnlyDSN turns a sqlite DSN into a URI opening the same file with
+// mode=ro. It returns false for in-memory databases, which a second pool
+// would not share, and for DSNs that are read-only already.
+func readOnlyDSN(dsn string) (string, bool) {
+	if dsn == "" || dsn == ":memory:" {
+		return "", false
+	}
+	path, query, err := splitDSN(dsn)
+	if err != nil {
+		return "", false
+	}
+	switch query.Get("mode") {
+	case "memory", "ro":
+		return "", false
+	}
+	query.Set("mode", "ro")
+	return "file:" + path + "?" + query.Encode(), true
+}
+
+// existingDSN returns the sqlite dsn opening the database with mode=rw,
+// which fails if the file doesn't exist instead of creating an empty
+// database. DSNs choosing another mode, immutable ones and in-memory
+// databases are returned as they are.
+func existingDSN(dsn string) string {
+	if dsn == "" || dsn == ":memory:" {
+		return dsn
+	}
+	path, query, err := splitDSN(dsn)
+	if err != nil || query.Has("immutable") {
+		return dsn
+	}
+	switch query.Get("mode") {
+	case "", "rwc":
+	default:
+		return dsn
+	}
+	query.Set("mode", "rw")
+	return "file:" + path + "?" + query.Encode()
+}
+
+// splitDSN splits a sqlite DSN, a file name or a file: URI, into the
+// escaped path and the query of the equivalent URI.
+func splitDSN(dsn string) (string, url.Values, error) {
+	if isWindowsPath(dsn) {
+		path, query := windowsURI(dsn)
+		return path, query, nil
+	}
+	path, rawQuery := dsn, ""
+	if strings.HasPrefix(dsn, "file:") {
+		path = strings.TrimPrefix(dsn, "file:")
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path, rawQuery = path[:i], path[i+1:]
+		}
+	} else {
+		path = escapeURIPath(path)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	return path, query, err
+}
+
+// escapeURIPath escapes the characters of a file path that end the path
+// of a URI or start an escape.
+func escapeURIPath(path string) string {
+	return strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+}
+
+// openReader opens the pool of read_conns read-only connections used by
+// Load, List, Stat and Exists, so that reads never take write locks and, in
+// WAL mode, run concurrently with the writer. Database is then reduced to
+// the single writer connection, handed out by the write queue. Other
+// dialects read and write through Database, and so does an exclusive
+// database, through the one connection holding its lock.
+func (s *SqliteStorage) openReader() error {
+	if s.dialect != dialects[Sqlite] {
+		return nil
+	}
+	if s.Exclusive {
+		s.handles.Lock()
+		defer s.handles.Unlock()
+		s.Database.SetMaxOpenConns(1)
+		s.Database.SetMaxIdleConns(1)
+		return nil
+	}
+	dsn, ok := readOnlyDSN(s.connectionString())
+	if !ok {
+		return nil
+	}
+	db, err := sql.Open(s.Driver, dsn)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+	db.SetMaxOpenConns(s.ReadConns)
+	s.handles.Lock()
+	defer s.handles.Unlock()
+	s.Database.SetMaxOpenConns(1)
+	s.Database.SetMaxIdleConns(1)
+	s.reader = db
+	if s.writes == nil {
+		s.writes = newWriteQueue()
+	}
+	return nil
+}
+
+// readDB returns the pool to run read-only queries on.
+func (s *SqliteStorage) readDB() *sql.DB {
+	s.handles.RLock()
+	defer s.handles.RUnlock()
+	if s.reader != nil {
+		return s.reader
+	}
+	return s.Database
+}
@@ -0,0 +1,117 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// rebuildAttempts is how many copies a rebuild takes while writes go on.
+// If writes finished during each of them, the last copy is taken with
+// writes paused.
+const rebuildAttempts = 3
+
+// errRebuildOutdated is returned when writes finished while the copy of a
+// rebuild was taken.
+var errRebuildOutdated = errors.New("database changed during the rebuild")
+
+// rebuild writes a compacted copy of the database next to it with
+// statement, VACUUM INTO, checks it and swaps it in place of the
+// database. The copy is taken from a read connection while writes go on,
+// in WAL mode without blocking them; writes are only paused for the swap,
+// which happens only if none finished meanwhile. Otherwise a new copy is
+// taken.
+func (s *SqliteStorage) rebuild(ctx context.Context, statement string) error {
+	if _, ok := readOnlyDSN(s.Dsn); !ok || s.writes == nil {
+		return errors.New("rebuild requires a sqlite database file with read_conns")
+	}
+	path := dbFilePath(s.Dsn)
+	tmp := path + ".rebuild"
+	defer os.Remove(tmp)
+
+	for attempt := 1; attempt < rebuildAttempts; attempt++ {
+		written := s.writes.done.Load()
+		if err := s.rebuildCopy(ctx, statement, tmp); err != nil {
+			return err
+		}
+		err := s.writes.do(ctx, s.QueryTimeout*time.Second, func(ctx context.Context) error {
+			if s.writes.done.Load() != written {
+				return errRebuildOutdated
+			}
+			return s.swapDatabase(ctx, tmp)
+		})
+		if !errors.Is(err, errRebuildOutdated) {
+			return err
+		}
+		caddy.Log().Named(logMaintenance).Debug(fmt.Sprintf("rebuild attempt %d of %d: %v", attempt, rebuildAttempts, err))
+	}
+	return s.writes.do(ctx, s.QueryTimeout*time.Second, func(ctx context.Context) error {
+		if err := s.rebuildCopy(ctx, statement, tmp); err != nil {
+			return err
+		}
+		return s.swapDatabase(ctx, tmp)
+	})
+}
+
+// rebuildCopy writes the compacted copy of the database to tmp and checks
+// it.
+func (s *SqliteStorage) rebuildCopy(ctx context.Context, statement, tmp string) error {
+	caddy.Log().Named(logMaintenance).Debug(fmt.Sprintf("VACUUM INTO %s", tmp))
+	err := s.retry(ctx, MaintenanceRebuild, func(ctx context.Context) error {
+		os.Remove(tmp)
+		_, err := s.exec(ctx, s.readDB(), statement, nil, tmp)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writing the new database: %v", err)
+	}
+	return verifySnapshot(ctx, tmp)
+}
+
+// swapDatabase replaces the database file with the one at tmp, while the
+// caller holds the writer. The handles are closed first, so that the WAL
+// of the old file is checkpointed and removed rather than applied to the
+// new one. Operations are paused until the new handles are open: running
+// reads finish on the old ones, up to drain_timeout, and new ones wait.
+// Handles returned by DB before the swap are closed with the old ones.
+func (s *SqliteStorage) swapDatabase(ctx context.Context, tmp string) error {
+	path := dbFilePath(s.Dsn)
+	resume := s.pauseOperations()
+	defer resume()
+	if _, err := s.exec(ctx, s.writeDB(), "PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		return err
+	}
+
+	s.handles.Lock()
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	s.Database.Close()
+	renamed := os.Rename(tmp, path)
+	if renamed == nil {
+		os.Remove(path + "-wal")
+		os.Remove(path + "-shm")
+	}
+	// The old file is opened again if the rename failed.
+	db, err := sql.Open(s.Driver, s.connectionString())
+	if err == nil {
+		err = db.Ping()
+	}
+	s.Database, s.reader = db, nil
+	s.handles.Unlock()
+	if err != nil {
+		return fmt.Errorf("reopening the database: %v", err)
+	}
+	if err := s.openReader(); err != nil {
+		return err
+	}
+	if renamed != nil {
+		return fmt.Errorf("replacing the database: %v", renamed)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Names of the certmagic_meta rows tracking the encryption of values that
+// were stored before encryption was enabled: the last key the migration
+// reached, and the number of values it encrypted.
+const (
+	metaEncryptCursor  = "encrypt_migration_cursor"
+	metaEncryptedCount = "encrypt_migration_encrypted"
+)
+
+// encryptBatchSize is the number of keys the migration encrypts per
+// transaction, encryptPause the time it waits between batches so that it
+// does not starve other writes, and encryptRetry the time it waits after
+// a failure.
+const (
+	encryptBatchSize = 100
+	encryptPause     = 100 * time.Millisecond
+	encryptRetry     = 10 * time.Second
+)
+
+// needsEncryption reports whether the stored value of key is plaintext,
+// or encrypted without being bound to its key name, although the
+// encryption rules say it is to be encrypted.
+func (s *SqliteStorage) needsEncryption(key string, encoding sql.NullString) bool {
+	return s.aead != nil && s.Encryption.encrypts(key) && !strings.Contains(encoding.String, encodingAESGCM+":")
+}
+
+// queueEncryption asks the migration to encrypt key soon, without waiting
+// for it. Keys are dropped while the queue is full; the migration scan
+// reaches them anyway.
+func (s *SqliteStorage) queueEncryption(key string) {
+	select {
+	case s.encryptQueue <- key:
+		wakeJob(s.encryptKick)
+	default:
+	}
+}
+
+// encryptMigrationJob returns the job encrypting the values stored in
+// plaintext before encryption was enabled, without downtime: it scans
+// every key in batches, resuming from the cursor in certmagic_meta after a
+// restart, and in between encrypts the keys that were read in plaintext.
+// Once the scan is done, it runs whenever keys are read in plaintext, such
+// as values stored by an instance without encryption. Values encrypted
+// before key IDs were recorded are encrypted again the same way, binding
+// them to their key. The job returns the number of values it encrypted.
+func (s *SqliteStorage) encryptMigrationJob() func(context.Context) (int64, error) {
+	var cursor string
+	resumed, scanning := false, true
+	return func(ctx context.Context) (int64, error) {
+		if !resumed {
+			var err error
+			if cursor, err = s.meta(ctx, metaEncryptCursor); err != nil {
+				return 0, err
+			}
+			resumed = true
+		}
+		encrypted, err := s.encryptQueued(ctx)
+		for err == nil && scanning {
+			var n int
+			var done bool
+			cursor, n, done, err = s.encryptBatch(ctx, cursor)
+			encrypted += int64(n)
+			if err != nil {
+				break
+			}
+			if done {
+				scanning = false
+				total, _ := s.meta(ctx, metaEncryptedCount)
+				caddy.Log().Named(logMaintenance).Info(fmt.Sprintf("encryption migration done, %s values encrypted", total))
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return encrypted, ctx.Err()
+			case <-time.After(encryptPause):
+			}
+			queued, queueErr := s.encryptQueued(ctx)
+			encrypted, err = encrypted+queued, queueErr
+		}
+		return encrypted, err
+	}
+}
+
+// encryptQueued encrypts the keys waiting in the queue.
+func (s *SqliteStorage) encryptQueued(ctx context.Context) (int64, error) {
+	var encrypted int64
+	for {
+		select {
+		case key := <-s.encryptQueue:
+			ok, err := s.encryptValue(ctx, key)
+			if err != nil {
+				return encrypted, fmt.Errorf("encrypting %s: %v", key, err)
+			}
+			if ok {
+				encrypted++
+				if err := s.countEncrypted(ctx, 1); err != nil {
+					return encrypted, err
+				}
+			}
+		default:
+			return encrypted, nil
+		}
+	}
+}
+
+// encryptBatch encrypts the plaintext values of the keys after cursor, up
+// to encryptBatchSize of them, and records the progress. It returns the
+// new cursor, the number of values encrypted, and whether no keys are
+// left.
+func (s *SqliteStorage) encryptBatch(ctx context.Context, cursor string) (string, int, bool, error) {
+	var keys []string
+	err := s.retry(ctx, "encrypt_scan", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		order := s.dialect.keyOrder
+		rows, err := s.query(ctx, s.readDB(), "SELECT key FROM certmagic_data WHERE "+order+" > ? AND (encoding IS NULL OR encoding NOT LIKE '%"+encodingAESGCM+":%') ORDER BY "+order+" LIMIT ?", nil, cursor, encryptBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys = keys[:0]
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return cursor, 0, false, err
+	}
+	if len(keys) == 0 {
+		return "", 0, true, s.setMeta(ctx, metaEncryptCursor, "")
+	}
+
+	// The cursor is the key as stored, hidden keys are ordered by their
+	// encrypted names.
+	encrypted := 0
+	for _, stored := range keys {
+		key, err := s.plainKey(stored)
+		if err != nil {
+			return cursor, 0, false, err
+		}
+		ok, err := s.encryptValue(ctx, key)
+		if err != nil {
+			return cursor, encrypted, false, fmt.Errorf("encrypting %s: %v", key, err)
+		}
+		if ok {
+			encrypted++
+		}
+		cursor = stored
+	}
+	if err := s.countEncrypted(ctx, encrypted); err != nil {
+		return cursor, encrypted, false, err
+	}
+	return cursor, encrypted, false, s.setMeta(ctx, metaEncryptCursor, cursor)
+}
+
+// countEncrypted adds n to the number of values the migration encrypted.
+func (s *SqliteStorage) countEncrypted(ctx context.Context, n int) error {
+	if n == 0 {
+		return nil
+	}
+	value, err := s.meta(ctx, metaEncryptedCount)
+	if err != nil {
+		return err
+	}
+	total, _ := strconv.Atoi(value)
+	return s.setMeta(ctx, metaEncryptedCount, strconv.Itoa(total+n))
+}
+
+// encryptValue rewrites the value of key encrypted if it is stored in
+// plaintext but is to be encrypted, and reports whether it did. The
+// version is bumped so that the modification time is kept.
+func (s *SqliteStorage) encryptValue(ctx context.Context, key string) (bool, error) {
+	encrypted := false
+	err := s.retryWrite(ctx, "encrypt", func(ctx context.Context) error {
+		encrypted = false
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var stored []byte
+		var encoding sql.NullString
+		err = s.queryRow(ctx, tx, "SELECT value, encoding FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash).Scan(&stored, &encoding)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.needsEncryption(key, encoding) {
+			return nil
+		}
+		value, err := s.decodeValue(key, newSecret(stored), encoding)
+		if err != nil {
+			return err
+		}
+		reencoded, reencoding, err := s.encodeValue(key, value)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(ctx, tx, "UPDATE certmagic_data SET value = ?, stored_size = ?, encoding = ?, version = version + 1 WHERE key_hash = ?", []string{key},
+			reencoded.reveal(), reencoded.len(), reencoding, key_hash)
+		if err != nil {
+			return err
+		}
+		if err := s.addUsage(ctx, tx, key, usageDelta{storedSize: int64(reencoded.len() - len(stored))}); err != nil {
+			return err
+		}
+		if s.macKey != nil {
+			if err := s.signRow(ctx, tx, key); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.invalidate(key_hash)
+		encrypted = true
+		return nil
+	})
+	return encrypted, err
+}
+
+// rebindValue encodes the value that tx moved or copied from srcKey to
+// dstKey again for dstKey: encrypted values only decrypt under the key
+// they were stored with, and the encryption rules may differ between the
+// two keys. The version is bumped so that the modification time is kept.
+func (s *SqliteStorage) rebindValue(ctx context.Context, tx *sql.Tx, srcKey, dstKey string) error {
+	dstHash := s.keyHash(dstKey)
+	var stored []byte
+	var encoding sql.NullString
+	err := s.queryRow(ctx, tx, "SELECT value, encoding FROM certmagic_data WHERE key_hash = ?", []string{dstKey}, dstHash).Scan(&stored, &encoding)
+	if err != nil {
+		return err
+	}
+	// Encrypted values are always encoded again, legacy ones without a
+	// key ID too, so that the copy is bound to dstKey.
+	encrypted := strings.Contains(encoding.String, encodingAESGCM)
+	wantEncrypted := s.aead != nil && s.Encryption.encrypts(dstKey)
+	if !encrypted && !wantEncrypted {
+		return nil
+	}
+	value, err := s.decodeValue(srcKey, newSecret(stored), encoding)
+	if err != nil {
+		return err
+	}
+	reencoded, reencoding, err := s.encodeValue(dstKey, value)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, tx, "UPDATE certmagic_data SET value = ?, stored_size = ?, encoding = ?, version = version + 1 WHERE key_hash = ?", []string{dstKey},
+		reencoded.reveal(), reencoded.len(), reencoding, dstHash)
+	if err != nil {
+		return err
+	}
+	return s.addUsage(ctx, tx, dstKey, usageDelta{storedSize: int64(reencoded.len() - len(stored))})
+}
@@ -0,0 +1,318 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ReplicationConfig pulls the change feed of another instance's storage
+// and applies it locally, for example to keep a passive Caddy in another
+// region in sync with the active one. Conflicts are resolved by the last
+// writer winning: a remote change is applied unless the local key changed
+// later, in which case the remote change is recorded in
+// certmagic_conflicts and discarded. Of two values written in the same
+// second the greater one wins.
+type ReplicationConfig struct {
+	// URL of the /storage/sqlite/changes admin endpoint of the source,
+	// with a dsn query parameter if it has more than one storage.
+	Source string `json:"source,omitempty"`
+	// How often the source is polled. Defaults to 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Changes requested at once. Defaults to 500.
+	BatchSize int `json:"batch_size,omitempty"`
+}
+
+func (c *ReplicationConfig) setDefaults() {
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(30 * time.Second)
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 500
+	}
+}
+
+// Outcomes of applying a remote change, the result label of
+// replication_changes_total.
+const (
+	replicationApplied  = "applied"
+	replicationSkipped  = "skipped"
+	replicationConflict = "conflict"
+)
+
+// replicationMeta names the certmagic_meta row holding the sequence number
+// replicated from source so far.
+func replicationMeta(source string) string {
+	return "replication:" + source
+}
+
+// replicationJob pulls the source, every interval, and returns the number
+// of changes applied.
+func (s *SqliteStorage) replicationJob(ctx context.Context) (int64, error) {
+	applied, err := s.replicate(ctx)
+	return int64(applied), err
+}
+
+// replicate pulls the changes of the replication source.
+func (s *SqliteStorage) replicate(ctx context.Context) (int, error) {
+	return s.pull(ctx, s.Replication.Source, s.Replication.BatchSize)
+}
+
+// pull applies batches of the changes of source until it has no more, and
+// returns the number of changes applied.
+func (s *SqliteStorage) pull(ctx context.Context, source string, batchSize int) (int, error) {
+	value, err := s.meta(ctx, replicationMeta(source))
+	if err != nil {
+		return 0, err
+	}
+	since, _ := strconv.ParseInt(value, 10, 64)
+
+	applied := 0
+	for {
+		set, err := s.fetchChanges(ctx, source, since, batchSize)
+		if err != nil {
+			return applied, err
+		}
+		for _, c := range set.Changes {
+			result, err := s.applyChange(ctx, source, c)
+			if err != nil {
+				return applied, fmt.Errorf("applying %s: %v", c.Key, err)
+			}
+			sqliteMetrics.replicatedChanges.WithLabelValues(result).Inc()
+			if result == replicationApplied {
+				applied++
+			}
+		}
+		if set.Last == since {
+			return applied, nil
+		}
+		since = set.Last
+		if err := s.setMeta(ctx, replicationMeta(source), strconv.FormatInt(since, 10)); err != nil {
+			return applied, err
+		}
+		if len(set.Changes) < batchSize {
+			return applied, nil
+		}
+	}
+}
+
+// fetchChanges requests a batch of the change feed from source.
+func (s *SqliteStorage) fetchChanges(ctx context.Context, source string, since int64, limit int) (ChangeSet, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	q := u.Query()
+	q.Set("since", strconv.FormatInt(since, 10))
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	s.signRequest(req, nil)
+	client, err := s.httpClient()
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ChangeSet{}, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+	var set ChangeSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return ChangeSet{}, fmt.Errorf("decoding changes: %v", err)
+	}
+	return set, nil
+}
+
+// applyChange applies a remote change unless the local key changed later.
+func (s *SqliteStorage) applyChange(ctx context.Context, source string, c Change) (string, error) {
+	local, deleted, err := s.lastChange(ctx, c.Key)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case deleted && c.Deleted, c.Deleted && local.IsZero():
+		return replicationSkipped, nil
+	case local.Equal(c.Modified) && !deleted && !c.Deleted:
+		// Modification times have a precision of a second, so two writes
+		// may tie. The greater value wins, so that either side of the tie
+		// ends up with the same one.
+		value, err := s.changedValue(ctx, c.Key)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Compare(c.Value, value) <= 0 {
+			return replicationSkipped, nil
+		}
+	case local.Equal(c.Modified):
+		return replicationSkipped, nil
+	case local.After(c.Modified):
+		return replicationConflict, s.recordConflict(ctx, source, c, local)
+	}
+	pattern, policy := strings.CutPrefix(c.Key, domainPolicyFeedPrefix)
+	if policy {
+		if normalized, err := normalizePattern(pattern); err != nil || normalized != pattern {
+			return "", fmt.Errorf("invalid domain pattern %q", pattern)
+		}
+		if action := string(c.Value); !c.Deleted && action != PolicyAllow && action != PolicyDeny {
+			return "", fmt.Errorf("unknown action %q", action)
+		}
+	}
+	switch {
+	case policy && c.Deleted:
+		err = s.deleteDomainPolicy(ctx, pattern, c.Modified)
+	case policy:
+		err = s.setDomainPolicy(ctx, pattern, string(c.Value), c.Modified)
+	case c.Deleted:
+		err = s.deleteAt(ctx, c.Key, c.Modified)
+	default:
+		err = s.StoreWithModTime(ctx, c.Key, c.Value, c.Modified)
+	}
+	if err != nil {
+		return "", err
+	}
+	return replicationApplied, nil
+}
+
+// changedValue returns the local value of a key of the change feed: the
+// value of a key, or the action of a domain policy.
+func (s *SqliteStorage) changedValue(ctx context.Context, key string) ([]byte, error) {
+	pattern, ok := strings.CutPrefix(key, domainPolicyFeedPrefix)
+	if !ok {
+		return s.Load(ctx, key)
+	}
+	var action string
+	err := s.retry(ctx, "domain_policy", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		var err error
+		action, _, err = s.domainPolicy(ctx, s.readDB(), pattern)
+		return err
+	})
+	return []byte(action), err
+}
+
+// deleteAt deletes key like Delete, but records the deletion in the change
+// feed at deleted, when it happened at the origin of a replicated change,
+// so that the feed keeps comparing the times of the original changes.
+func (s *SqliteStorage) deleteAt(ctx context.Context, key string, deleted time.Time) error {
+	key_hash := s.keyHash(key)
+	err := s.retryWrite(ctx, "delete", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		prev, err := s.rowUsage(ctx, tx, key, key_hash)
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash); err != nil {
+			return err
+		}
+		if err := s.addUsage(ctx, tx, key, usageDelta{}.minus(prev)); err != nil {
+			return err
+		}
+		if s.dialect == dialects[Sqlite] {
+			_, err := s.exec(ctx, tx, "UPDATE certmagic_changes SET deleted_at = ? WHERE key = ? AND deleted_at IS NOT NULL", []string{key},
+				deleted.UTC().Format(deletedAtLayout), s.storedKey(key))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	s.versions.forget(key_hash)
+	s.invalidate(key_hash)
+	s.deleted()
+	return nil
+}
+
+// lastChange returns when key was last written or deleted locally, and
+// whether it was deleted. The time is zero if key never existed.
+func (s *SqliteStorage) lastChange(ctx context.Context, key string) (time.Time, bool, error) {
+	if pattern, ok := strings.CutPrefix(key, domainPolicyFeedPrefix); ok {
+		var created time.Time
+		err := s.retry(ctx, "last_change", func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+			defer cancel()
+			var err error
+			_, created, err = s.domainPolicy(ctx, s.readDB(), pattern)
+			return err
+		})
+		if err == nil {
+			return created, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, false, err
+		}
+	} else {
+		info, err := s.Stat(ctx, key)
+		if err == nil && info.IsTerminal {
+			return info.Modified, false, nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return time.Time{}, false, err
+		}
+	}
+	// The feed holds hidden key names, policy keys are never hidden.
+	stored := s.storedKey(key)
+	if strings.HasPrefix(key, domainPolicyFeedPrefix) {
+		stored = key
+	}
+	var deletedAt sql.NullString
+	err := s.retry(ctx, "last_change", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		return s.queryRow(ctx, s.readDB(), "SELECT deleted_at FROM certmagic_changes WHERE key = ? AND deleted_at IS NOT NULL", []string{key}, stored).Scan(&deletedAt)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	t, err := time.Parse(deletedAtLayout, deletedAt.String)
+	return t, true, err
+}
+
+// recordConflict logs a remote change discarded because the local key
+// changed later.
+func (s *SqliteStorage) recordConflict(ctx context.Context, source string, c Change, local time.Time) error {
+	caddy.Log().Named(logReplication).Warn(fmt.Sprintf("conflict on %s: keeping the local change of %s over the remote one of %s from %s",
+		c.Key, local.Format(time.RFC3339Nano), c.Modified.Format(time.RFC3339Nano), source))
+	return s.retryWrite(ctx, "conflict", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		stored := s.storedKey(c.Key)
+		if strings.HasPrefix(c.Key, domainPolicyFeedPrefix) {
+			stored = c.Key
+		}
+		_, err := s.exec(ctx, s.writeDB(), "INSERT INTO certmagic_conflicts (key, source, local_modified, remote_modified, remote_deleted) VALUES (?, ?, ?, ?, ?)",
+			[]string{c.Key}, stored, source, local, c.Modified, c.Deleted)
+		return err
+	})
+}
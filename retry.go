@@ -0,0 +1,99 @@
+package storagesqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// RetryPolicy controls how storage operations are retried when sqlite
+// reports a transient error such as SQLITE_BUSY or SQLITE_LOCKED.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff before the first retry, doubled on every further attempt.
+	InitialBackoff caddy.Duration `json:"initial_backoff,omitempty"`
+	// Upper bound for the backoff between two attempts.
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+	// Fraction (0-1) of the backoff that is randomized.
+	Jitter float64 `json:"jitter,omitempty"`
+}
+
+func (r *RetryPolicy) setDefaults() {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 3
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = caddy.Duration(50 * time.Millisecond)
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = caddy.Duration(time.Second)
+	}
+}
+
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	d := time.Duration(r.InitialBackoff) << (attempt - 1)
+	if d > time.Duration(r.MaxBackoff) || d <= 0 {
+		d = time.Duration(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(d))
+	}
+	return d
+}
+
+// isTransient reports whether err is a sqlite error worth retrying.
+func isTransient(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// retry runs fn until it succeeds, fails with a non transient error or the
+// retry policy is exhausted. Without a policy fn is run exactly once. The
+// error is returned as an *OpError.
+func (s *SqliteStorage) retry(ctx context.Context, operation string, fn func(context.Context) error) (err error) {
+	if err := s.drain.enter(operation); err != nil {
+		return wrapError(operation, err)
+	}
+	defer s.drain.leave()
+	if err := s.breakerAllow(); err != nil {
+		return wrapError(operation, err)
+	}
+
+	err = fn(ctx)
+	defer func() {
+		s.countOperation(operation, err)
+		s.breakerRecord(err)
+		err = wrapError(operation, err)
+	}()
+	if s.Retry == nil {
+		return err
+	}
+	for attempt := 1; attempt < s.Retry.MaxAttempts && isTransient(err); attempt++ {
+		sqliteMetrics.retries.WithLabelValues(operation).Inc()
+		caddy.Log().Named(logStorage).Debug(fmt.Sprintf("retrying %s after %v (attempt %d)", operation, err, attempt+1))
+
+		timer := time.NewTimer(s.Retry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = fn(ctx)
+	}
+	return err
+}
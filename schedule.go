@@ -0,0 +1,68 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Jobs that can be scheduled by ScheduleConfig besides the maintenance
+// operations.
+const jobBackup = "backup"
+
+// ScheduleConfig runs maintenance jobs at the times given by cron
+// expressions, such as "30 2 * * *" for every night at 02:30, so that
+// heavy maintenance only runs in defined windows. The expressions have
+// the five fields minute, hour, day of month, month and day of week, or
+// are one of @hourly, @daily, @weekly, @monthly and @yearly.
+type ScheduleConfig struct {
+	// IANA name of the time zone the expressions are in, such as
+	// Europe/Berlin. Defaults to the local time zone.
+	Timezone string `json:"timezone,omitempty"`
+	// When to write a snapshot to the backup dir, in addition to the
+	// backup interval.
+	Backup string `json:"backup,omitempty"`
+	// When to run a full VACUUM.
+	Vacuum string `json:"vacuum,omitempty"`
+	// When to run an integrity check (sqlite only).
+	IntegrityCheck string `json:"integrity_check,omitempty"`
+	// When to remove expired locks.
+	LockGC string `json:"lock_gc,omitempty"`
+}
+
+// jobs returns the parsed schedules of the configured jobs by name.
+func (c *ScheduleConfig) jobs() (map[string]*cronSchedule, error) {
+	loc := time.Local
+	if c.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	jobs := map[string]*cronSchedule{}
+	for job, expr := range map[string]string{
+		jobBackup:                 c.Backup,
+		MaintenanceVacuum:         c.Vacuum,
+		MaintenanceIntegrityCheck: c.IntegrityCheck,
+		MaintenanceLockGC:         c.LockGC,
+	} {
+		if expr == "" {
+			continue
+		}
+		schedule, err := parseCron(expr, loc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", job, err)
+		}
+		jobs[job] = schedule
+	}
+	return jobs, nil
+}
+
+// maintenanceJob returns the job running the maintenance operation op at
+// the times of its schedule. lock_gc counts the locks it removed.
+func (s *SqliteStorage) maintenanceJob(op string) func(context.Context) (int64, error) {
+	return func(ctx context.Context) (int64, error) {
+		result, err := s.Maintain(ctx, op)
+		return result.RemovedLocks, err
+	}
+}
@@ -0,0 +1,37 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"io"
+)
+
+const redacted = "[REDACTED]"
+
+// secret holds stored values and key material inside the storage. It
+// formats as [REDACTED] with every fmt verb, as a zap field and as JSON.
+// Being a struct, it can't be passed where []byte is expected by accident:
+// a value only reaches a log by an explicit call of reveal. Values are
+// revealed at the certmagic.Storage API and at the database and crypto
+// boundaries only.
+type secret struct {
+	b []byte
+}
+
+// newSecret wraps b without copying it.
+func newSecret(b []byte) secret { return secret{b: b} }
+
+// reveal returns the wrapped bytes without copying them.
+func (s secret) reveal() []byte { return s.b }
+
+// len returns the length of the wrapped bytes.
+func (s secret) len() int { return len(s.b) }
+
+func (secret) String() string { return redacted }
+
+func (secret) GoString() string { return redacted }
+
+func (secret) Format(f fmt.State, verb rune) { io.WriteString(f, redacted) }
+
+func (secret) MarshalText() ([]byte, error) { return []byte(redacted), nil }
+
+func (secret) MarshalJSON() ([]byte, error) { return []byte(`"` + redacted + `"`), nil }
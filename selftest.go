@@ -0,0 +1,81 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// SelfTestStep is the outcome of one step of the self-test.
+type SelfTestStep struct {
+	Name    string
+	Latency time.Duration
+	Err     error
+}
+
+// selfTest runs a store, load, stat, list, lock, unlock and delete round
+// trip on a scratch key and times every step. It stops at the first
+// failing step, deleting the scratch key if it was written.
+func (s *SqliteStorage) selfTest(ctx context.Context) []SelfTestStep {
+	key := "selftest/" + s.InstanceID
+	value := []byte("sqlite storage self-test " + time.Now().UTC().Format(time.RFC3339Nano))
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"store", func() error { return s.Store(ctx, key, value) }},
+		{"load", func() error {
+			loaded, err := s.Load(ctx, key)
+			if err == nil && !bytes.Equal(loaded, value) {
+				err = fmt.Errorf("loaded %q, stored %q", loaded, value)
+			}
+			return err
+		}},
+		{"stat", func() error {
+			info, err := s.Stat(ctx, key)
+			if err == nil && info.Size != int64(len(value)) {
+				err = fmt.Errorf("size %d, stored %d bytes", info.Size, len(value))
+			}
+			return err
+		}},
+		{"list", func() error {
+			keys, err := s.List(ctx, "selftest/", false)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if k == key {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s not listed", key)
+		}},
+		{"lock", func() error { return s.Lock(ctx, key) }},
+		{"unlock", func() error { return s.Unlock(ctx, key) }},
+		{"delete", func() error {
+			if err := s.Delete(ctx, key); err != nil {
+				return err
+			}
+			if s.Exists(ctx, key) {
+				return fmt.Errorf("%s still exists", key)
+			}
+			return nil
+		}},
+	}
+
+	var results []SelfTestStep
+	for i, step := range steps {
+		start := time.Now()
+		err := step.fn()
+		results = append(results, SelfTestStep{Name: step.name, Latency: time.Since(start), Err: err})
+		if err != nil {
+			if i > 0 && step.name != "delete" {
+				s.Delete(ctx, key)
+			}
+			break
+		}
+	}
+	return results
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package storagesqlite
+
+import "os"
+
+// backupSignals is empty where SIGUSR1 does not exist.
+var backupSignals []os.Signal
@@ -0,0 +1,12 @@
+//go:build unix
+
+package storagesqlite
+
+import (
+	"os"
+	"syscall"
+)
+
+// backupSignals are the signals that make signalBackupJob write a
+// snapshot.
+var backupSignals = []os.Signal{syscall.SIGUSR1}
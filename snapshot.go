@@ -0,0 +1,86 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// ReadView is a point-in-time view of the storage. Everything read through
+// it sees the database as it was at the first read, whatever is written
+// concurrently. It is only valid within the function passed to View.
+type ReadView struct {
+	s  *SqliteStorage
+	tx *sql.Tx
+}
+
+// View runs fn with a ReadView backed by a single read-only transaction,
+// a WAL snapshot for sqlite and a repeatable read transaction for the
+// other dialects. The transaction is bound by ctx only, not by the query
+// timeout, and is not retried. Without WAL, the transaction holds a shared
+// lock on the database from its first read until fn returns: writers
+// cannot commit meanwhile and fail with SQLITE_BUSY once their busy
+// timeout, zero unless set by a busy_timeout pragma in the dsn, runs out.
+// Keep fn short there.
+func (s *SqliteStorage) View(ctx context.Context, fn func(v *ReadView) error) error {
+	opts := &sql.TxOptions{ReadOnly: true}
+	if s.dialect != dialects[Sqlite] {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	if err := s.drain.enter("view"); err != nil {
+		return wrapError("view", err)
+	}
+	defer s.drain.leave()
+	tx, err := s.readDB().BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&ReadView{s: s, tx: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// List returns the keys starting with prefix, like List of the storage
+// with recursive set to false.
+func (v *ReadView) List(ctx context.Context, prefix string) ([]string, error) {
+	cond, args := v.s.prefixCond(prefix)
+	rows, err := v.s.query(ctx, v.tx, "select key from certmagic_data where "+cond, []string{prefix}, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return nil, err
+		}
+		key, ok, err := v.s.matchKey(stored, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// Load returns the value of key as of the view.
+func (v *ReadView) Load(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := v.LoadWithInfo(ctx, key)
+	return value, err
+}
+
+// LoadWithInfo returns the value of key and its KeyInfo as of the view.
+// It bypasses the read cache, which may hold newer values.
+func (v *ReadView) LoadWithInfo(ctx context.Context, key string) ([]byte, certmagic.KeyInfo, error) {
+	value, modified, _, err := v.s.loadRow(ctx, v.tx, key)
+	if err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+	return value.reveal(), keyInfo(key, value, modified), nil
+}
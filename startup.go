@@ -0,0 +1,70 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Startup phases timed by NewStorage, in the order they run.
+const (
+	phaseSchema     = "schema"
+	phaseMigrations = "migrations"
+	phaseIndexes    = "indexes"
+	phaseReaders    = "read_connections"
+	phaseAutoImport = "auto_import"
+)
+
+// StartupPhase is the time one phase of opening the storage took.
+type StartupPhase struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// startupTimes collects the phases of NewStorage.
+type startupTimes struct {
+	mu     sync.Mutex
+	phases []StartupPhase
+}
+
+// recordPhase records that phase ran from start until now. A phase
+// recorded again, such as after a retried setup, replaces the earlier
+// time.
+func (s *SqliteStorage) recordPhase(phase string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	sqliteMetrics.startupPhases.WithLabelValues(phase).Set(seconds)
+
+	t := s.startup
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.phases {
+		if t.phases[i].Phase == phase {
+			t.phases[i].Seconds = seconds
+			return
+		}
+	}
+	t.phases = append(t.phases, StartupPhase{Phase: phase, Seconds: seconds})
+}
+
+// startupPhases returns a copy of the recorded phases.
+func (s *SqliteStorage) startupPhases() []StartupPhase {
+	s.startup.mu.Lock()
+	defer s.startup.mu.Unlock()
+	return append([]StartupPhase(nil), s.startup.phases...)
+}
+
+// logStartup logs the total startup time with the time of every phase.
+func (s *SqliteStorage) logStartup(start time.Time) {
+	var phases []string
+	for _, p := range s.startupPhases() {
+		phases = append(phases, fmt.Sprintf("%s %s", p.Phase, time.Duration(p.Seconds*float64(time.Second)).Round(time.Microsecond)))
+	}
+	name := s.Dialect + " database"
+	if s.dialect == dialects[Sqlite] {
+		name = dbFilePath(s.Dsn)
+	}
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("opened %s in %s (%s)", name, time.Since(start).Round(time.Microsecond), strings.Join(phases, ", ")))
+}
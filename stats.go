@@ -0,0 +1,179 @@
+package storagesqlite
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats describes the health of a storage database.
+type Stats struct {
+	Dsn          string `json:"dsn"`
+	InstanceID   string `json:"instance_id"`
+	DatabaseSize int64  `json:"database_size"`
+	WalSize      int64  `json:"wal_size"`
+	// Pages of a sqlite database and how many of them are unused.
+	PageCount     int64 `json:"page_count,omitempty"`
+	FreelistPages int64 `json:"freelist_pages,omitempty"`
+	Keys          int64 `json:"keys"`
+	// Total size of all values and the bytes they take up after
+	// compression.
+	ValueSize    int64            `json:"value_size"`
+	StoredSize   int64            `json:"stored_size"`
+	KeysByPrefix map[string]int64 `json:"keys_by_prefix"`
+	KeysByKind   map[string]int64 `json:"keys_by_kind"`
+	Locks        int64            `json:"locks"`
+	LastBackup   *time.Time       `json:"last_backup,omitempty"`
+	LastVacuum   *time.Time       `json:"last_vacuum,omitempty"`
+	// Time the storage was degraded to read-only, nil while writable.
+	ReadOnlySince *time.Time `json:"read_only_since,omitempty"`
+	// State of the circuit breaker if enabled: closed, open or half_open.
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+	// Time the phases of opening the storage took.
+	Startup []StartupPhase `json:"startup,omitempty"`
+	// Background jobs and their last runs.
+	Jobs []JobStatus `json:"jobs,omitempty"`
+}
+
+// storages holds every storage opened by NewStorage keyed by DSN, so that
+// admin endpoints can reach them.
+var storages = struct {
+	sync.Mutex
+	m map[string]*SqliteStorage
+}{m: make(map[string]*SqliteStorage)}
+
+func registerStorage(s *SqliteStorage) {
+	storages.Lock()
+	defer storages.Unlock()
+	storages.m[s.Dsn] = s
+}
+
+func unregisterStorage(s *SqliteStorage) {
+	storages.Lock()
+	defer storages.Unlock()
+	if storages.m[s.Dsn] == s {
+		delete(storages.m, s.Dsn)
+	}
+}
+
+func registeredStorages() []*SqliteStorage {
+	storages.Lock()
+	defer storages.Unlock()
+	list := make([]*SqliteStorage, 0, len(storages.m))
+	for _, s := range storages.m {
+		list = append(list, s)
+	}
+	return list
+}
+
+// dbFilePath returns the path of the database file named by dsn, which
+// may be a plain path or a file: URI.
+func dbFilePath(dsn string) string {
+	if !strings.HasPrefix(dsn, "file:") {
+		return dsn
+	}
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	return uriFilePath(strings.TrimPrefix(path, "//"))
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Stats collects size, key and lock counts for the database.
+func (s *SqliteStorage) Stats(ctx context.Context) (Stats, error) {
+	stats := Stats{
+		Dsn:          s.Dsn,
+		InstanceID:   s.InstanceID,
+		KeysByPrefix: make(map[string]int64),
+		KeysByKind:   make(map[string]int64),
+	}
+	err := s.retry(ctx, "stats", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		row := s.writeDB().QueryRowContext(ctx, s.dialect.sizeQuery)
+		if err := row.Scan(&stats.DatabaseSize); err != nil {
+			return err
+		}
+
+		query := "SELECT COALESCE(kind, 'other'), count(*) FROM certmagic_data GROUP BY kind"
+		if s.indexKey != nil {
+			// The kind of hidden keys is not stored, see storedKind.
+			query = "SELECT key, 1 FROM certmagic_data"
+		}
+		rows, err := s.query(ctx, s.writeDB(), query, nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(stats.KeysByKind)
+		for rows.Next() {
+			var kind string
+			var count int64
+			if err := rows.Scan(&kind, &count); err != nil {
+				return err
+			}
+			if s.indexKey != nil {
+				key, err := s.plainKey(kind)
+				if err != nil {
+					return err
+				}
+				kind = keyKind(key)
+			}
+			stats.KeysByKind[kind] += count
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		row = s.writeDB().QueryRowContext(ctx, s.dialect.rebind("SELECT count(*) FROM certmagic_locks WHERE expires > ?"), time.Now())
+		return row.Scan(&stats.Locks)
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	usage, err := s.Usage(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	for _, u := range usage {
+		stats.KeysByPrefix[u.Prefix] = u.Keys
+		stats.Keys += u.Keys
+		stats.ValueSize += u.Size
+		stats.StoredSize += u.StoredSize
+	}
+	stats.WalSize = fileSize(dbFilePath(s.Dsn) + "-wal")
+	if s.dialect == dialects[Sqlite] {
+		files, err := s.fileStats(ctx)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.PageCount, stats.FreelistPages = files.PageCount, files.FreelistPages
+	}
+	stats.LastVacuum = s.lastVacuum()
+	stats.Startup = s.startupPhases()
+	stats.Jobs = s.jobStatuses()
+	stats.CircuitBreaker = s.breakerState()
+	if since := s.readOnlySince(); !since.IsZero() {
+		stats.ReadOnlySince = &since
+	}
+	if lastBackup := s.background.lastBackup.Load(); lastBackup != 0 {
+		t := time.Unix(0, lastBackup)
+		stats.LastBackup = &t
+	}
+	return stats, nil
+}
@@ -2,27 +2,230 @@ package storagesqlite
 
 import (
 	"context"
+	"crypto/cipher"
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
 	_ "modernc.org/sqlite"
 )
 
 type SqliteStorage struct {
 	QueryTimeout time.Duration `json:"query_timeout,omitempty"`
 	LockTimeout  time.Duration `json:"lock_timeout,omitempty"`
-	Dsn          string        `json:"dsn,omitempty"`
-	Database     *sql.DB       `json:"-"`
+	// How often a blocked Lock checks whether the lock was released.
+	LockPollInterval caddy.Duration `json:"lock_poll_interval,omitempty"`
+	// How long Lock waits for a held lock before giving up. Zero waits
+	// until the context is done.
+	LockAcquireTimeout caddy.Duration `json:"lock_acquire_timeout,omitempty"`
+	// Warn about locks held or waited for longer than this. Zero disables
+	// the lock watchdog.
+	LockWarnAfter caddy.Duration `json:"lock_warn_after,omitempty"`
+	// How long closing the storage waits for running operations to finish
+	// and held locks to be released. Defaults to 5s.
+	DrainTimeout caddy.Duration `json:"drain_timeout,omitempty"`
+	// How long a write waits for the single writer connection while other
+	// writes hold it, before failing. Defaults to 10s.
+	WriteWaitTimeout caddy.Duration `json:"write_wait_timeout,omitempty"`
+	// The database: for sqlite a file name or a file: URI, whose vfs
+	// parameter selects the VFS, such as unix-dotfile on file systems
+	// without working locks, and whose mode=ro opens a replica updated by
+	// another process read-only, immutable=1 a snapshot that never changes.
+	// A leading ~ is the home directory, and relative
+	// paths are relative to Caddy's data directory. Unset, it is read from
+	// the CADDY_SQLITE_DSN or sqlite_DSN environment variable, or defaults
+	// to certs.sqlite in the data directory.
+	Dsn string `json:"dsn,omitempty"`
+	// SQL dialect of the database: sqlite (default), postgres or mysql.
+	Dialect string `json:"dialect,omitempty"`
+	// database/sql driver name, defaults to the one of the dialect.
+	Driver string       `json:"driver,omitempty"`
+	Retry  *RetryPolicy `json:"retry,omitempty"`
+	// Cache loaded values in memory.
+	Cache *CacheConfig `json:"cache,omitempty"`
+	// Limit the rate of Store operations per key prefix.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// Record the instance ID of the last writer in the updated_by column
+	// of certmagic_data.
+	RecordWriter bool `json:"record_writer,omitempty"`
+	// Detect writes that overwrite updates from other instances this
+	// instance has not seen. Implies record_writer.
+	TrackConflicts bool `json:"track_conflicts,omitempty"`
+	// Skip Store when the value is identical to the stored one. Implies
+	// storing checksums, rows written without one are always rewritten.
+	SkipUnchanged bool `json:"skip_unchanged,omitempty"`
+	// Delete of a key that does not exist fails with fs.ErrNotExist
+	// instead of succeeding.
+	StrictDelete bool `json:"strict_delete,omitempty"`
+	// Set to file_system to make List and Stat treat the segments of keys
+	// as directories, exactly like certmagic's file system storage.
+	Compat string `json:"compat,omitempty"`
+	// Compress values with gzip before storing them.
+	Compress bool `json:"compress,omitempty"`
+	// Values shorter than this many bytes are stored uncompressed.
+	// Defaults to 512.
+	CompressMinSize int `json:"compress_min_size,omitempty"`
+	// gzip level from 1 (fastest) to 9 (smallest). Defaults to 6.
+	CompressLevel int `json:"compress_level,omitempty"`
+	// Encrypt stored values, optionally only those of some keys.
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+	// Store a SHA-256 checksum of every value and verify it on Load.
+	Checksum bool `json:"checksum,omitempty"`
+	// Secret to record an HMAC-SHA256 of the key, value and modification
+	// time of every row with, verified on Load, so that changes made to the
+	// database file without it are detected even if values are not
+	// encrypted. Rows written before it was set are signed on startup; all
+	// instances sharing the database need it. Modification times are kept
+	// to the second. Accepts file:<path> and env:<name> references.
+	MACKey string `json:"mac_key,omitempty"`
+	// Only use FIPS-approved algorithms: hash keys with SHA-256 instead of
+	// MD5, and restrict the TLS of replication to AES-GCM cipher suites and
+	// NIST curves. Values and backups are always encrypted with AES-GCM.
+	// Turning it on or off hashes every key again on the next start. Always
+	// on when built with the fips build tag, which is meant to be combined
+	// with a FIPS validated Go crypto module such as
+	// GOEXPERIMENT=boringcrypto.
+	FIPS bool `json:"fips,omitempty"`
+	// Log every SQL statement with the keys it concerns, its duration and
+	// the rows it affected at debug level as storage.sqlite.sql. Values
+	// are never logged.
+	LogQueries bool `json:"log_queries,omitempty"`
+	// Log the query plan of every distinct statement once as
+	// storage.sqlite.sql, and warn about full table scans, to find
+	// missing indexes (sqlite only).
+	ExplainQueries bool `json:"explain_queries,omitempty"`
+	// Publish operation counters and pool stats via expvar.
+	Expvar bool `json:"expvar,omitempty"`
+	// On first start against an empty database, import Caddy's default
+	// file system storage. Runs once per database.
+	AutoImport bool `json:"auto_import,omitempty"`
+	// Number of read-only connections to a sqlite database. Writes use a
+	// single connection of their own. Defaults to 4.
+	ReadConns int `json:"read_conns,omitempty"`
+	// Checkpoint and truncate the WAL of a sqlite database once a write
+	// leaves it larger than this many bytes. Zero leaves the WAL to the
+	// automatic checkpoints of sqlite.
+	MaxWALSize int `json:"max_wal_size,omitempty"`
+	// Open a sqlite database in exclusive locking mode, with temporary
+	// tables in memory, for less overhead per write. Only for a single
+	// process: the database stays locked until the storage is closed, so
+	// that other processes fail to open it.
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Compact a sqlite database once too many of its pages are unused.
+	Compaction *CompactionConfig `json:"compaction,omitempty"`
+	// Run backups, vacuums, integrity checks and lock GC at the times of
+	// cron expressions.
+	Schedule *ScheduleConfig `json:"schedule,omitempty"`
+	// Ping the database periodically and reopen it after repeated
+	// failures.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// Switch to read-only after writes failed persistently instead of
+	// failing every write.
+	ReadOnlyFallback *FallbackConfig `json:"read_only_fallback,omitempty"`
+	// Fail operations fast for a while after repeated failures.
+	CircuitBreaker *BreakerConfig `json:"circuit_breaker,omitempty"`
+	// Pull the changes of another instance's storage.
+	Replication *ReplicationConfig `json:"replication,omitempty"`
+	// URLs of the /storage/sqlite/changes admin endpoints of other
+	// instances to exchange changes with in both directions.
+	SyncPeers []string `json:"sync_peers,omitempty"`
+	// How often changes are exchanged with the sync peers. Defaults to
+	// 30s.
+	SyncInterval caddy.Duration `json:"sync_interval,omitempty"`
+	// Push changes to followers as they are committed.
+	Push *PushConfig `json:"push,omitempty"`
+	// Address to serve the change feed of this storage on, outside of
+	// Caddy's admin API. The feed holds private keys, so it requires tls
+	// with cert_file, and a CA to verify peers or auth.
+	Listen string `json:"listen,omitempty"`
+	// Mutual TLS for the listener and for the requests of replication,
+	// sync_peers and push.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Tokens required by the admin endpoints and the replication listener
+	// for this storage.
+	Auth *AuthConfig `json:"auth,omitempty"`
+	// Credential sent to replication sources, sync peers and followers.
+	PeerAuth *AuthToken `json:"peer_auth,omitempty"`
+	// Read the credentials in the dsn from HashiCorp Vault.
+	Vault *VaultConfig `json:"vault,omitempty"`
+	// Periodic, optionally encrypted snapshots of the database.
+	Backups *BackupConfig `json:"backup,omitempty"`
+	// Periodic copies of the database kept for auditing.
+	Archive *ArchiveConfig `json:"archive,omitempty"`
+	// Modules of the caddy.storage.sqlite.middleware namespace wrapping
+	// the storage operations, the first one outermost. See
+	// StorageMiddleware.
+	MiddlewareRaw []json.RawMessage `json:"middleware,omitempty" caddy:"namespace=caddy.storage.sqlite.middleware inline_key=middleware"`
+	InstanceID    string            `json:"-"`
+	// Handle writes run on. The health check may replace it, see
+	// writeDB.
+	Database *sql.DB `json:"-"`
+	// guards Database and reader against reopen.
+	handles *sync.RWMutex
+	// read-only connections to a sqlite database, see openReader.
+	reader *sql.DB
+	// serializes writes on the writer connection when reader is set.
+	writes *writeQueue
+	// logger of log_queries, nil if disabled.
+	queryLog *zap.Logger
+	// query plans logged by explain_queries, nil if disabled.
+	explained *queryPlans
+	// events app and context of the Caddy config that provisioned the
+	// storage, nil outside of Caddy.
+	events    *caddyevents.App
+	eventsCtx caddy.Context
+
+	dialect    *dialect
+	background *background
+	drain      *drainer
+	fallback   *fallback
+	breaker    *breaker
+	followers  []*follower
+	tlsFiles   *tlsFiles
+	tlsClient  *tlsClient
+	listener   net.Listener
+	vault      *vaultCredentials
+	versions   *versionTracker
+	limiter    *rateLimiter
+	cache      *readCache
+	certInfos  *certInfos
+	aead       cipher.AEAD
+	keyID      string
+	indexKey   []byte
+	macKey     []byte
+	// time the phases of NewStorage took.
+	startup *startupTimes
+	// wake the jobs running the budgeted incremental vacuum after deletes,
+	// and checking the size of the WAL after writes.
+	vacuumKick chan struct{}
+	walKick    chan struct{}
+	// the dsn opens the database read-only, with mode=ro or immutable=1.
+	readOnly bool
+	// keys read in plaintext that are to be encrypted, and the wakeup of
+	// the job encrypting them.
+	encryptQueue chan string
+	encryptKick  chan struct{}
+	// storage opened by CertMagicStorage, closed on Cleanup.
+	storage *SqliteStorage
+	// loaded from MiddlewareRaw by Provision.
+	middleware []StorageMiddleware
 }
 
 func init() {
@@ -31,317 +234,2371 @@ func init() {
 
 func (c *SqliteStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		var value string
-		key := d.Val()
-		if !d.Args(&value) {
-			continue
+		if d.NextArg() {
+			return d.ArgErr()
 		}
-		switch key {
-		case "query_timeout":
-			QueryTimeout, err := strconv.Atoi(value)
-			if err == nil {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			key := d.Val()
+			var err error
+			switch key {
+			case "retry":
+				c.Retry = new(RetryPolicy)
+				err = c.unmarshalRetry(d)
+			case "cache":
+				c.Cache = new(CacheConfig)
+				err = c.unmarshalCache(d)
+			case "encryption":
+				c.Encryption = new(EncryptionConfig)
+				err = c.unmarshalEncryption(d)
+			case "rate_limit":
+				c.RateLimit = new(RateLimit)
+				err = c.unmarshalRateLimit(d)
+			case "backup":
+				c.Backups = new(BackupConfig)
+				err = c.unmarshalBackup(d)
+			case "archive":
+				c.Archive = new(ArchiveConfig)
+				err = c.unmarshalArchive(d)
+			case "compaction":
+				c.Compaction = new(CompactionConfig)
+				err = c.unmarshalCompaction(d)
+			case "schedule":
+				c.Schedule = new(ScheduleConfig)
+				err = c.unmarshalSchedule(d)
+			case "health_check":
+				c.HealthCheck = new(HealthCheckConfig)
+				err = c.unmarshalHealthCheck(d)
+			case "read_only_fallback":
+				c.ReadOnlyFallback = new(FallbackConfig)
+				err = c.unmarshalFallback(d)
+			case "circuit_breaker":
+				c.CircuitBreaker = new(BreakerConfig)
+				err = c.unmarshalBreaker(d)
+			case "replication":
+				c.Replication = new(ReplicationConfig)
+				err = c.unmarshalReplication(d)
+			case "sync_peers":
+				c.SyncPeers = d.RemainingArgs()
+				if len(c.SyncPeers) == 0 {
+					err = d.ArgErr()
+				}
+			case "sync_interval":
+				c.SyncInterval, err = durationArg(d)
+			case "push":
+				c.Push = new(PushConfig)
+				err = c.unmarshalPush(d)
+			case "listen":
+				c.Listen, err = stringArg(d)
+			case "tls":
+				c.TLS = new(TLSConfig)
+				err = c.unmarshalTLS(d)
+			case "auth":
+				c.Auth = new(AuthConfig)
+				err = unmarshalAuth(d, c.Auth)
+			case "middleware":
+				err = c.unmarshalMiddleware(d)
+			case "vault":
+				c.Vault = new(VaultConfig)
+				err = c.unmarshalVault(d)
+			case "peer_auth":
+				c.PeerAuth = new(AuthToken)
+				if !d.Args(&c.PeerAuth.Type, &c.PeerAuth.ID, &c.PeerAuth.Secret) || d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "record_writer":
+				c.RecordWriter, err = true, noArgs(d)
+			case "track_conflicts":
+				c.TrackConflicts, err = true, noArgs(d)
+			case "skip_unchanged":
+				c.SkipUnchanged, err = true, noArgs(d)
+			case "strict_delete":
+				c.StrictDelete, err = true, noArgs(d)
+			case "compat":
+				c.Compat, err = stringArg(d)
+			case "checksum":
+				c.Checksum, err = true, noArgs(d)
+			case "compress":
+				c.Compress, err = true, noArgs(d)
+			case "fips":
+				c.FIPS, err = true, noArgs(d)
+			case "mac_key":
+				c.MACKey, err = stringArg(d)
+			case "expvar":
+				c.Expvar, err = true, noArgs(d)
+			case "log_queries":
+				c.LogQueries, err = true, noArgs(d)
+			case "explain_queries":
+				c.ExplainQueries, err = true, noArgs(d)
+			case "auto_import":
+				c.AutoImport, err = true, noArgs(d)
+			case "query_timeout":
+				var QueryTimeout int
+				QueryTimeout, err = intArg(d)
 				c.QueryTimeout = time.Duration(QueryTimeout)
-			}
-		case "lock_timeout":
-			LockTimeout, err := strconv.Atoi(value)
-			if err == nil {
+			case "lock_timeout":
+				var LockTimeout int
+				LockTimeout, err = intArg(d)
 				c.LockTimeout = time.Duration(LockTimeout)
+			case "lock_poll_interval":
+				c.LockPollInterval, err = durationArg(d)
+			case "lock_warn_after":
+				c.LockWarnAfter, err = durationArg(d)
+			case "lock_acquire_timeout":
+				c.LockAcquireTimeout, err = durationArg(d)
+			case "drain_timeout":
+				c.DrainTimeout, err = durationArg(d)
+			case "write_wait_timeout":
+				c.WriteWaitTimeout, err = durationArg(d)
+			case "compress_min_size":
+				c.CompressMinSize, err = intArg(d)
+			case "compress_level":
+				c.CompressLevel, err = intArg(d)
+			case "read_conns":
+				c.ReadConns, err = intArg(d)
+			case "max_wal_size":
+				c.MaxWALSize, err = intArg(d)
+			case "exclusive":
+				c.Exclusive, err = true, noArgs(d)
+			case "dsn":
+				c.Dsn, err = stringArg(d)
+			case "dialect":
+				c.Dialect, err = stringArg(d)
+			case "driver":
+				c.Driver, err = stringArg(d)
+			default:
+				err = d.Errf("unrecognized subdirective %s", key)
+			}
+			if err != nil {
+				return err
 			}
-		case "dsn":
-			c.Dsn = value
 		}
 	}
-	caddy.Log().Named("storage.sqlite").Debug(fmt.Sprintf("UnmarshalCaddyfile %v", c))
+	caddy.Log().Named(logStorage).Debug(fmt.Sprintf("UnmarshalCaddyfile %v", c))
 
 	return nil
 }
 
-func (c *SqliteStorage) Provision(ctx caddy.Context) error {
-
-	// Load Environment
-	if c.Dsn == "" {
-		c.Dsn = os.Getenv("sqlite_DSN")
-	}
-	if c.Dsn == "" {
-		c.Dsn = "/var/lib/caddy/.local/share/caddy/certs.sqlite"
-	}
-	if c.QueryTimeout == 0 {
-		c.QueryTimeout = 3
+// noArgs returns an error if the current directive has arguments.
+func noArgs(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
 	}
-	if c.LockTimeout == 0 {
-		c.LockTimeout = 60
-	}
-
-	caddy.Log().Named("storage.sqlite").Debug(fmt.Sprintf("Provision %v", c))
-
 	return nil
 }
 
-func (SqliteStorage) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID: "caddy.storage.sqlite",
-		New: func() caddy.Module {
-			return new(SqliteStorage)
-		},
+// stringArg returns the single argument of the current directive.
+func stringArg(d *caddyfile.Dispenser) (string, error) {
+	if !d.NextArg() {
+		return "", d.ArgErr()
+	}
+	value := d.Val()
+	if d.NextArg() {
+		return "", d.ArgErr()
 	}
+	return value, nil
 }
 
-func NewStorage(c SqliteStorage) (certmagic.Storage, error) {
-	var connStr string
-	if len(c.Dsn) > 0 {
-		connStr = c.Dsn
-	} else {
-		return nil, errors.New("Dsn not set")
+func intArg(d *caddyfile.Dispenser) (int, error) {
+	key := d.Val()
+	value, err := stringArg(d)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, d.Errf("invalid %s %q: must be an integer", key, value)
 	}
+	return n, nil
+}
 
-	db, err := sql.Open("sqlite", connStr)
+func floatArg(d *caddyfile.Dispenser) (float64, error) {
+	key := d.Val()
+	value, err := stringArg(d)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	s := &SqliteStorage{
-		Database:     db,
-		QueryTimeout: c.QueryTimeout,
-		LockTimeout:  c.LockTimeout,
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, d.Errf("invalid %s %q: must be a number", key, value)
 	}
-
-	caddy.Log().Named("storage.sqlite").Debug(fmt.Sprintf("NewStorage %v %v", c, s))
-	return s, s.ensureTableSetup()
+	return f, nil
 }
 
-func (c *SqliteStorage) CertMagicStorage() (certmagic.Storage, error) {
-	return NewStorage(*c)
+func durationArg(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	key := d.Val()
+	value, err := stringArg(d)
+	if err != nil {
+		return 0, err
+	}
+	duration, err := caddy.ParseDuration(value)
+	if err != nil {
+		return 0, d.Errf("invalid %s %q: %v", key, value, err)
+	}
+	return caddy.Duration(duration), nil
 }
 
-type DB interface {
-	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
-	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
-	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
-	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+func (c *SqliteStorage) unmarshalRetry(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "max_attempts":
+			c.Retry.MaxAttempts, err = intArg(d)
+		case "initial_backoff":
+			c.Retry.InitialBackoff, err = durationArg(d)
+		case "max_backoff":
+			c.Retry.MaxBackoff, err = durationArg(d)
+		case "jitter":
+			c.Retry.Jitter, err = floatArg(d)
+		default:
+			err = d.Errf("unrecognized retry subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Database RDBs this library supports, currently supports Postgres only.
-type Database int
-
-const (
-	Sqlite Database = iota
-)
-
-func (s *SqliteStorage) ensureTableSetup() error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.QueryTimeout*time.Second)
-	defer cancel()
-	tx, err := s.Database.BeginTx(ctx, nil)
-	if err != nil {
+func (c *SqliteStorage) unmarshalCache(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("ensureTableSetup"))
-	dataTable := `CREATE TABLE IF NOT EXISTS
-	certmagic_data (
-  	key_hash char(40) NOT NULL,
-  	key TEXT NOT NULL,
-  	value BLOB,
-  	modified TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-  	PRIMARY KEY (key_hash)
-	)`
-	_, err = tx.ExecContext(ctx, dataTable)
-	if err != nil {
-		return err
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "size":
+			c.Cache.Size, err = intArg(d)
+		case "revalidate":
+			c.Cache.Revalidate, err = durationArg(d)
+		default:
+			err = d.Errf("unrecognized cache subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	lockTable := `
-  	CREATE TABLE IF NOT EXISTS certmagic_locks (
-  	key_hash char(40) NOT NULL,
-  	key TEXT NOT NULL,
-  	expires TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-  	PRIMARY KEY (key_hash)
-	)`
-	_, err = tx.ExecContext(ctx, lockTable)
-	if err != nil {
+	return nil
+}
+
+func (c *SqliteStorage) unmarshalEncryption(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "key":
+			c.Encryption.Key, err = stringArg(d)
+		case "key_id":
+			c.Encryption.KeyID, err = stringArg(d)
+		case "hide_keys":
+			c.Encryption.HideKeys, err = true, noArgs(d)
+		case "default":
+			c.Encryption.Default, err = stringArg(d)
+		case "rule":
+			var rule EncryptionRule
+			if !d.Args(&rule.Match, &rule.Policy) || d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Encryption.Rules = append(c.Encryption.Rules, rule)
+		default:
+			err = d.Errf("unrecognized encryption subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	triggerUpdate := `
-	CREATE TRIGGER if not exists Trg_LastUpdated
-	AFTER UPDATE ON certmagic_data
-	FOR EACH ROW
-	BEGIN
-	UPDATE certmagic_data SET modified = CURRENT_TIMESTAMP WHERE key_hash = OLD.key_hash;
-	END
-	`
-	_, err = tx.ExecContext(ctx, triggerUpdate)
-	if err != nil {
+func (c *SqliteStorage) unmarshalRateLimit(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
-	return tx.Commit()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "rate":
+			c.RateLimit.Rate, err = floatArg(d)
+		case "burst":
+			c.RateLimit.Burst, err = intArg(d)
+		default:
+			err = d.Errf("unrecognized rate_limit subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func getMD5String(s string) string {
-	md5Code := md5.Sum([]byte(s + "storage.sqlite.salt"))
-	return hex.EncodeToString(md5Code[:])
+func (c *SqliteStorage) unmarshalBackup(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "snapshot_on_signal":
+			c.Backups.SnapshotOnSignal, err = true, noArgs(d)
+		case "dir":
+			c.Backups.Dir, err = stringArg(d)
+		case "interval":
+			c.Backups.Interval, err = durationArg(d)
+		case "keep":
+			c.Backups.Keep, err = intArg(d)
+		case "encryption_key":
+			c.Backups.EncryptionKey, err = stringArg(d)
+		default:
+			err = d.Errf("unrecognized backup subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Lock the key and implement certmagic.Storage.Lock.
-func (s *SqliteStorage) Lock(ctx context.Context, key string) error {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-
-	tx, err := s.Database.BeginTx(ctx, nil)
-	if err != nil {
+func (c *SqliteStorage) unmarshalArchive(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "dir":
+			c.Archive.Dir, err = stringArg(d)
+		case "interval":
+			c.Archive.Interval, err = durationArg(d)
+		case "max_age":
+			c.Archive.MaxAge, err = durationArg(d)
+		case "keep":
+			c.Archive.Keep, err = intArg(d)
+		default:
+			err = d.Errf("unrecognized archive subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if err := s.isLocked(tx, key); err != nil {
+func (c *SqliteStorage) unmarshalCompaction(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "free_ratio":
+			c.Compaction.FreeRatio, err = floatArg(d)
+		case "interval":
+			c.Compaction.Interval, err = durationArg(d)
+		case "window":
+			c.Compaction.Window, err = stringArg(d)
+		case "incremental":
+			c.Compaction.Incremental, err = true, noArgs(d)
+		case "vacuum_pages_per_second":
+			c.Compaction.PagesPerSecond, err = intArg(d)
+		default:
+			err = d.Errf("unrecognized compaction subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	expires := time.Now().Add(s.LockTimeout * time.Second)
-	key_hash := getMD5String(key)
-	query := `INSERT INTO certmagic_locks (key_hash,key, expires) VALUES (?, ?, ?) ON CONFLICT(key_hash) DO UPDATE set expires = ?`
-	if _, err := tx.ExecContext(ctx, query, key_hash, key, expires, expires); err != nil {
-		return fmt.Errorf("failed to lock key: %s: %w", key, err)
+// cronArg returns the remaining arguments of the line as a cron
+// expression, so that it may be given quoted or not.
+func cronArg(d *caddyfile.Dispenser) (string, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return "", d.ArgErr()
 	}
+	return strings.Join(args, " "), nil
+}
 
-	return tx.Commit()
+func (c *SqliteStorage) unmarshalSchedule(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "timezone":
+			c.Schedule.Timezone, err = stringArg(d)
+		case "backup":
+			c.Schedule.Backup, err = cronArg(d)
+		case "vacuum":
+			c.Schedule.Vacuum, err = cronArg(d)
+		case "integrity_check":
+			c.Schedule.IntegrityCheck, err = cronArg(d)
+		case "lock_gc":
+			c.Schedule.LockGC, err = cronArg(d)
+		default:
+			err = d.Errf("unrecognized schedule subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Unlock the key and implement certmagic.Storage.Unlock.
-func (s *SqliteStorage) Unlock(ctx context.Context, key string) error {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	key_hash := getMD5String(key)
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("DELETE FROM certmagic_locks WHERE key_hash = %s", key_hash))
-	_, err := s.Database.ExecContext(ctx, "DELETE FROM certmagic_locks WHERE key_hash = ?", key_hash)
-	return err
+func (c *SqliteStorage) unmarshalHealthCheck(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "interval":
+			c.HealthCheck.Interval, err = durationArg(d)
+		case "failures":
+			c.HealthCheck.Failures, err = intArg(d)
+		default:
+			err = d.Errf("unrecognized health_check subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type queryer interface {
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+func (c *SqliteStorage) unmarshalFallback(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "failures":
+			c.ReadOnlyFallback.Failures, err = intArg(d)
+		case "retry_interval":
+			c.ReadOnlyFallback.RetryInterval, err = durationArg(d)
+		default:
+			err = d.Errf("unrecognized read_only_fallback subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// isLocked returns nil if the key is not locked.
-func (s *SqliteStorage) isLocked(queryer queryer, key string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.QueryTimeout*time.Second)
-	defer cancel()
-	key_hash := getMD5String(key)
-	current_timestamp := time.Now()
+func (c *SqliteStorage) unmarshalBreaker(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "failures":
+			c.CircuitBreaker.Failures, err = intArg(d)
+		case "cooldown":
+			c.CircuitBreaker.Cooldown, err = durationArg(d)
+		default:
+			err = d.Errf("unrecognized circuit_breaker subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	row := queryer.QueryRowContext(ctx, "select exists(select 1 from certmagic_locks where key_hash = ? and expires > ?)", key_hash, current_timestamp)
-	var locked bool
-	if err := row.Scan(&locked); err != nil {
+func (c *SqliteStorage) unmarshalVault(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
 		return err
 	}
-	if locked {
-		return fmt.Errorf("key is locked: %s", key)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "address":
+			c.Vault.Address, err = stringArg(d)
+		case "token":
+			c.Vault.Token, err = stringArg(d)
+		case "path":
+			c.Vault.Path, err = stringArg(d)
+		default:
+			err = d.Errf("unrecognized vault subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Store puts value at key.
-func (s *SqliteStorage) Store(ctx context.Context, key string, value []byte) error {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	key_hash := getMD5String(key)
-	_, err := s.Database.ExecContext(ctx, `INSERT INTO certmagic_data (key_hash, key, value)
-	VALUES (?, ?, ?) ON CONFLICT(key_hash) DO UPDATE
-	set value = ?, modified = current_timestamp`, key_hash, key, value, value)
-	return err
+func unmarshalAuth(d *caddyfile.Dispenser, a *AuthConfig) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch key := d.Val(); key {
+		case AuthBearer, AuthHMAC:
+			t := AuthToken{Type: key}
+			if !d.Args(&t.ID, &t.Secret) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				t.Scope = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Tokens = append(a.Tokens, t)
+		default:
+			return d.Errf("unrecognized auth subdirective %s", key)
+		}
+	}
+	return nil
 }
 
-// Load retrieves the value at key.
-func (s *SqliteStorage) Load(ctx context.Context, key string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	var value []byte
-	key_hash := getMD5String(key)
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("SELECT value FROM certmagic_data WHERE key_hash = %s", key_hash))
+func (c *SqliteStorage) unmarshalTLS(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "cert_file":
+			c.TLS.CertFile, err = stringArg(d)
+		case "key_file":
+			c.TLS.KeyFile, err = stringArg(d)
+		case "ca_file":
+			c.TLS.CAFile, err = stringArg(d)
+		case "allowed_sans":
+			c.TLS.AllowedSANs = append(c.TLS.AllowedSANs, d.RemainingArgs()...)
+			if len(c.TLS.AllowedSANs) == 0 {
+				err = d.ArgErr()
+			}
+		default:
+			err = d.Errf("unrecognized tls subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	err := s.Database.QueryRowContext(ctx, "SELECT value FROM certmagic_data WHERE key_hash = ?", key_hash).Scan(&value)
-	if err == sql.ErrNoRows {
-		return nil, fs.ErrNotExist
+func (c *SqliteStorage) unmarshalPush(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
 	}
-	return value, err
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "follower":
+			var follower string
+			follower, err = stringArg(d)
+			c.Push.Followers = append(c.Push.Followers, follower)
+		case "batch_size":
+			c.Push.BatchSize, err = intArg(d)
+		case "retry_interval":
+			c.Push.RetryInterval, err = durationArg(d)
+		default:
+			err = d.Errf("unrecognized push subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Delete deletes key. An error should be
-// returned only if the key still exists
-// when the method returns.
-func (s *SqliteStorage) Delete(ctx context.Context, key string) error {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	key_hash := getMD5String(key)
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("DELETE FROM certmagic_data WHERE key_hash =  %s", key_hash))
-	_, err := s.Database.ExecContext(ctx, "DELETE FROM certmagic_data WHERE key_hash = ?", key_hash)
-	return err
+func (c *SqliteStorage) unmarshalReplication(d *caddyfile.Dispenser) error {
+	if err := noArgs(d); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch key := d.Val(); key {
+		case "source":
+			c.Replication.Source, err = stringArg(d)
+		case "interval":
+			c.Replication.Interval, err = durationArg(d)
+		case "batch_size":
+			c.Replication.BatchSize, err = intArg(d)
+		default:
+			err = d.Errf("unrecognized replication subdirective %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Exists returns true if the key exists
-// and there was no error checking.
-func (s *SqliteStorage) Exists(ctx context.Context, key string) bool {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	key_hash := getMD5String(key)
+func (c *SqliteStorage) Provision(ctx caddy.Context) error {
+	c.replacePlaceholders(caddy.NewReplacer())
+	if err := c.resolveSecrets(); err != nil {
+		return err
+	}
+	c.setDefaults()
+	c.InstanceID = newInstanceID()
+	// Events name the module that emits them, which only exists when Caddy
+	// loaded the storage as one, not when it is provisioned directly.
+	if ctx.Module() != nil {
+		app, err := ctx.App("events")
+		if err != nil {
+			return err
+		}
+		c.events, c.eventsCtx = app.(*caddyevents.App), ctx
+	}
+	if err := c.loadMiddleware(ctx); err != nil {
+		return err
+	}
 
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM certmagic_data WHERE key_hash = %s)", key_hash))
+	caddy.Log().Named(logStorage).Debug(fmt.Sprintf("Provision %v", c))
 
-	row := s.Database.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM certmagic_data WHERE key_hash = ?)", key_hash)
-	var exists bool
-	err := row.Scan(&exists)
-	return err == nil && exists
+	return nil
 }
 
-// List returns all keys that match prefix.
-// If recursive is true, non-terminal keys
-// will be enumerated (i.e. "directories"
-// should be walked); otherwise, only keys
-// prefixed exactly by prefix will be listed.
-func (s *SqliteStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	if recursive {
-		return nil, fmt.Errorf("recursive not supported")
+// replacePlaceholders expands global placeholders such as {env.SQLITE_DSN}
+// in the options naming files, databases and keys.
+func (c *SqliteStorage) replacePlaceholders(repl *caddy.Replacer) {
+	// Unknown placeholders, such as {vault.password}, are left for later.
+	c.Dsn = repl.ReplaceKnown(c.Dsn, "")
+	c.Driver = repl.ReplaceAll(c.Driver, "")
+	if c.Encryption != nil {
+		c.Encryption.Key = repl.ReplaceAll(c.Encryption.Key, "")
+	}
+	c.MACKey = repl.ReplaceAll(c.MACKey, "")
+	if c.Backups != nil {
+		c.Backups.Dir = repl.ReplaceAll(c.Backups.Dir, "")
+		c.Backups.EncryptionKey = repl.ReplaceAll(c.Backups.EncryptionKey, "")
+	}
+	if c.Archive != nil {
+		c.Archive.Dir = repl.ReplaceAll(c.Archive.Dir, "")
 	}
+	if c.TLS != nil {
+		c.TLS.CertFile = repl.ReplaceAll(c.TLS.CertFile, "")
+		c.TLS.KeyFile = repl.ReplaceAll(c.TLS.KeyFile, "")
+		c.TLS.CAFile = repl.ReplaceAll(c.TLS.CAFile, "")
+	}
+	if c.Auth != nil {
+		for i := range c.Auth.Tokens {
+			c.Auth.Tokens[i].Secret = repl.ReplaceAll(c.Auth.Tokens[i].Secret, "")
+		}
+	}
+	if c.PeerAuth != nil {
+		c.PeerAuth.Secret = repl.ReplaceAll(c.PeerAuth.Secret, "")
+	}
+	if c.Vault != nil {
+		c.Vault.Address = repl.ReplaceAll(c.Vault.Address, "")
+		c.Vault.Token = repl.ReplaceAll(c.Vault.Token, "")
+	}
+}
 
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("select key from certmagic_data where key like '%s%%'", prefix))
+// resolveSecrets replaces the keys and token secrets of the form
+// file:<path> with the contents of the file, and env:<name> with the
+// environment variable, so they need not be written into the config.
+func (c *SqliteStorage) resolveSecrets() error {
+	secrets := []*string{&c.MACKey}
+	if c.Encryption != nil {
+		secrets = append(secrets, &c.Encryption.Key)
+	}
+	if c.Backups != nil {
+		secrets = append(secrets, &c.Backups.EncryptionKey)
+	}
+	if c.Auth != nil {
+		for i := range c.Auth.Tokens {
+			secrets = append(secrets, &c.Auth.Tokens[i].Secret)
+		}
+	}
+	if c.PeerAuth != nil {
+		secrets = append(secrets, &c.PeerAuth.Secret)
+	}
+	if c.Vault != nil {
+		secrets = append(secrets, &c.Vault.Token)
+	}
+	for _, value := range secrets {
+		resolved, err := resolveSecret(*value)
+		if err != nil {
+			return err
+		}
+		*value = resolved
+	}
+	return nil
+}
 
-	rows, err := s.Database.QueryContext(ctx, fmt.Sprintf("select key from certmagic_data where key like '%s%%'", prefix))
-	if err != nil {
-		return nil, err
+// resolveSecret returns the secret referenced by value, or value itself if
+// it is no reference. Trailing newlines of secret files are dropped.
+func resolveSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "file:"); ok {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("reading secret: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
 	}
-	defer rows.Close()
-	var keys []string
-	for rows.Next() {
-		var key string
-		if err := rows.Scan(&key); err != nil {
-			return nil, err
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
 		}
-		keys = append(keys, key)
+		return resolved, nil
 	}
-	return keys, nil
+	return value, nil
 }
 
-// Stat returns information about key.
-func (s *SqliteStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
-	defer cancel()
-	var modified time.Time
-	var size int64
-	key_hash := getMD5String(key)
-	caddy.Log().Named("storage.sqlite.sql").Debug(fmt.Sprintf("select length(value), modified from certmagic_data where key_hash = %s", key_hash))
+// legacyDSN is the database used by default before the default followed
+// caddy.AppDataDir.
+var legacyDSN = "/var/lib/caddy/.local/share/caddy/certs.sqlite"
 
-	row := s.Database.QueryRowContext(ctx, "select length(value), modified from certmagic_data where key_hash = ?", key_hash)
-	err := row.Scan(&size, &modified)
-	if err != nil {
-		return certmagic.KeyInfo{}, err
+// defaultDSN returns the database file in Caddy's data directory, as
+// given by caddy.AppDataDir for the platform, or the former default if
+// only a database there exists.
+func defaultDSN() string {
+	dsn := filepath.Join(caddy.AppDataDir(), "certs.sqlite")
+	if _, err := os.Stat(dsn); err == nil || dsn == legacyDSN {
+		return dsn
 	}
-	return certmagic.KeyInfo{
-		Key:        key,
-		Modified:   modified,
-		Size:       size,
-		IsTerminal: true,
-	}, nil
+	if _, err := os.Stat(legacyDSN); err == nil {
+		caddy.Log().Named(logStorage).Info(fmt.Sprintf("using the database at the former default location %s, move it to %s to use the data directory", legacyDSN, dsn))
+		return legacyDSN
+	}
+	return dsn
 }
 
-func (s SqliteStorage) Validate() error {
-	caddy.Log().Named("storage.sqlite.sql").Info(fmt.Sprintf("Validate"))
+// dsnEnv are the environment variables the dsn is read from when the
+// config has none, by precedence. sqlite_DSN is the former name.
+var dsnEnv = []string{"CADDY_SQLITE_DSN", "sqlite_DSN"}
+
+// envDSN returns the first of the dsnEnv variables that is set, and its
+// name.
+func envDSN() (string, string) {
+	for i, name := range dsnEnv {
+		dsn := os.Getenv(name)
+		if dsn == "" {
+			continue
+		}
+		for _, other := range dsnEnv[i+1:] {
+			if v := os.Getenv(other); v != "" && v != dsn {
+				caddy.Log().Named(logStorage).Warn(fmt.Sprintf("both %s and %s are set, using %s", name, other, name))
+			}
+		}
+		return "the " + name + " environment variable", dsn
+	}
+	return "", ""
+}
+
+// expandDSN expands a leading ~ in the path of a sqlite DSN to the home
+// directory and resolves relative paths against caddy.AppDataDir rather
+// than the working directory, which differs between systemd, Docker and
+// running Caddy by hand. In-memory databases are returned unchanged.
+func expandDSN(dsn string) string {
+	if dsn == "" || dsn == ":memory:" {
+		return dsn
+	}
+	uri := strings.HasPrefix(dsn, "file:")
+	path, rawQuery := dsn, ""
+	if uri {
+		path, rawQuery, _ = strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+		unescaped, err := url.PathUnescape(path)
+		if err != nil || strings.HasPrefix(path, "//") || unescaped == ":memory:" {
+			return dsn
+		}
+		if query, err := url.ParseQuery(rawQuery); err == nil && query.Get("mode") == "memory" {
+			return dsn
+		}
+		path = unescaped
+	}
+	expanded := path
+	if home, err := os.UserHomeDir(); err == nil && (path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`)) {
+		expanded = filepath.Join(home, path[1:])
+	} else if !filepath.IsAbs(path) && !strings.HasPrefix(path, "/") {
+		expanded = filepath.Join(caddy.AppDataDir(), path)
+	}
+	if !uri {
+		return expanded
+	}
+	if expanded == path {
+		return dsn
+	}
+	uriPath := filepath.ToSlash(expanded)
+	if filepath.VolumeName(expanded) != "" {
+		uriPath = "/" + uriPath
+	}
+	dsn = "file:" + escapeURIPath(uriPath)
+	if rawQuery != "" {
+		dsn += "?" + rawQuery
+	}
+	return dsn
+}
+
+// setDefaults fills in unset options from the environment and defaults.
+func (c *SqliteStorage) setDefaults() {
+	// The dsn is taken from the config, then the environment, then the
+	// default location.
+	source := "the config"
+	if c.Dsn == "" {
+		source, c.Dsn = envDSN()
+	}
+	if c.Dsn == "" {
+		source, c.Dsn = "the default location", defaultDSN()
+	}
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("using the dsn from %s", source))
+	if c.Dialect == "" || c.Dialect == dialects[Sqlite].name {
+		c.Dsn = expandDSN(c.Dsn)
+	}
+	if c.QueryTimeout == 0 {
+		c.QueryTimeout = 3
+	}
+	if c.LockTimeout == 0 {
+		c.LockTimeout = 60
+	}
+	if c.LockPollInterval == 0 {
+		c.LockPollInterval = caddy.Duration(time.Second)
+	}
+	if c.Retry != nil {
+		c.Retry.setDefaults()
+	}
+	if c.Cache != nil {
+		c.Cache.setDefaults()
+	}
+	if c.RateLimit != nil {
+		c.RateLimit.setDefaults()
+	}
+	if c.Compaction != nil {
+		c.Compaction.setDefaults()
+	}
+	if c.Archive != nil {
+		c.Archive.setDefaults(c.Dsn)
+	}
+	if c.HealthCheck != nil {
+		c.HealthCheck.setDefaults()
+	}
+	if c.ReadOnlyFallback != nil {
+		c.ReadOnlyFallback.setDefaults()
+	}
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.setDefaults()
+	}
+	if c.Replication != nil {
+		c.Replication.setDefaults()
+	}
+	if c.Push != nil {
+		c.Push.setDefaults()
+	}
+	if c.Auth != nil {
+		for i := range c.Auth.Tokens {
+			c.Auth.Tokens[i].setDefaults()
+		}
+	}
+	if c.PeerAuth != nil {
+		c.PeerAuth.setDefaults()
+	}
+}
+
+func (SqliteStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.sqlite",
+		New: func() caddy.Module {
+			return new(SqliteStorage)
+		},
+	}
+}
+
+func NewStorage(c SqliteStorage) (certmagic.Storage, error) {
+	var connStr string
+	if len(c.Dsn) > 0 {
+		connStr = c.Dsn
+	} else {
+		return nil, errors.New("Dsn not set")
+	}
+
+	dbType := Sqlite
+	if c.Dialect != "" {
+		var err error
+		if dbType, err = parseDialect(c.Dialect); err != nil {
+			return nil, err
+		}
+	}
+	dialect := dialects[dbType]
+	driver := c.Driver
+	if driver == "" {
+		driver = dialect.driver
+	}
+
+	if c.CompressLevel < 0 || c.CompressLevel > 9 {
+		return nil, fmt.Errorf("compress_level must be between 1 and 9, got %d", c.CompressLevel)
+	}
+	var aead cipher.AEAD
+	var keyID string
+	var indexKey []byte
+	if c.Encryption != nil {
+		var err error
+		if aead, err = c.Encryption.aead(); err != nil {
+			return nil, fmt.Errorf("value encryption: %v", err)
+		}
+		keyID, indexKey = c.Encryption.keyID(), c.Encryption.indexKey()
+	}
+
+	var vault *vaultCredentials
+	if c.Vault != nil {
+		vault = &vaultCredentials{config: c.Vault}
+		ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+		err := vault.read(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("reading credentials from vault: %v", err)
+		}
+		connStr = vault.expand(connStr)
+	}
+	if dbType == Sqlite {
+		if _, writable := readOnlyDSN(c.Dsn); writable {
+			if err := createDBDir(dbFilePath(c.Dsn)); err != nil {
+				return nil, fmt.Errorf("creating the directory of the database: %v", err)
+			}
+		}
+		connStr = windowsDSN(connStr)
+		if c.Exclusive {
+			connStr = exclusiveDSN(connStr)
+		}
+	}
+
+	db, err := sql.Open(driver, connStr)
+	if err != nil {
+		return nil, err
+	}
+	s := &SqliteStorage{
+		Dsn:          c.Dsn,
+		Dialect:      dialect.name,
+		Driver:       driver,
+		dialect:      dialect,
+		Database:     db,
+		handles:      new(sync.RWMutex),
+		QueryTimeout: c.QueryTimeout,
+		LockTimeout:  c.LockTimeout,
+		Retry:        c.Retry,
+		Cache:        c.Cache,
+		RateLimit:    c.RateLimit,
+
+		LockPollInterval:   c.LockPollInterval,
+		LockAcquireTimeout: c.LockAcquireTimeout,
+		LockWarnAfter:      c.LockWarnAfter,
+		DrainTimeout:       c.DrainTimeout,
+		WriteWaitTimeout:   c.WriteWaitTimeout,
+
+		RecordWriter:   c.RecordWriter,
+		TrackConflicts: c.TrackConflicts,
+		SkipUnchanged:  c.SkipUnchanged,
+		StrictDelete:   c.StrictDelete,
+		Compat:         c.Compat,
+		Checksum:       c.Checksum,
+		FIPS:           c.FIPS || fipsBuild,
+		MACKey:         c.MACKey,
+
+		Compress:        c.Compress,
+		CompressMinSize: c.CompressMinSize,
+		CompressLevel:   c.CompressLevel,
+		Encryption:      c.Encryption,
+		aead:            aead,
+		keyID:           keyID,
+		indexKey:        indexKey,
+
+		ReadConns:        c.ReadConns,
+		MaxWALSize:       c.MaxWALSize,
+		Exclusive:        c.Exclusive,
+		LogQueries:       c.LogQueries,
+		ExplainQueries:   c.ExplainQueries,
+		Expvar:           c.Expvar,
+		AutoImport:       c.AutoImport,
+		Backups:          c.Backups,
+		Archive:          c.Archive,
+		MiddlewareRaw:    c.MiddlewareRaw,
+		Compaction:       c.Compaction,
+		Schedule:         c.Schedule,
+		HealthCheck:      c.HealthCheck,
+		ReadOnlyFallback: c.ReadOnlyFallback,
+		CircuitBreaker:   c.CircuitBreaker,
+		Replication:      c.Replication,
+		SyncPeers:        c.SyncPeers,
+		SyncInterval:     c.SyncInterval,
+		Push:             c.Push,
+		Listen:           c.Listen,
+		TLS:              c.TLS,
+		Auth:             c.Auth,
+		PeerAuth:         c.PeerAuth,
+		Vault:            c.Vault,
+		vault:            vault,
+		breaker:          new(breaker),
+		fallback:         new(fallback),
+		events:           c.events,
+		eventsCtx:        c.eventsCtx,
+		InstanceID:       c.InstanceID,
+		background:       newBackground(),
+		drain:            newDrainer(),
+		versions:         newVersionTracker(),
+		limiter:          newRateLimiter(c.RateLimit),
+		cache:            newReadCache(c.Cache),
+		certInfos:        newCertInfos(),
+		startup:          new(startupTimes),
+	}
+	if s.LockPollInterval == 0 {
+		s.LockPollInterval = caddy.Duration(time.Second)
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = caddy.Duration(5 * time.Second)
+	}
+	if s.WriteWaitTimeout == 0 {
+		s.WriteWaitTimeout = caddy.Duration(10 * time.Second)
+	}
+	if s.Archive != nil {
+		// auto_import needs the directory to skip the archives.
+		s.Archive.setDefaults(s.Dsn)
+	}
+	if s.dialect == dialects[Sqlite] {
+		params, err := parseURI(s.Dsn)
+		if err != nil {
+			return s, fmt.Errorf("dsn: %v", err)
+		}
+		s.readOnly = params.readOnly()
+	}
+	if s.aead != nil && !s.readOnly {
+		s.encryptQueue = make(chan string, encryptBatchSize)
+		s.encryptKick = make(chan struct{}, 1)
+	}
+	if s.MACKey != "" {
+		s.macKey = []byte(s.MACKey)
+	}
+	if s.SyncInterval == 0 {
+		s.SyncInterval = caddy.Duration(30 * time.Second)
+	}
+	if s.Auth != nil {
+		for i := range s.Auth.Tokens {
+			s.Auth.Tokens[i].setDefaults()
+		}
+	}
+	if s.PeerAuth != nil {
+		s.PeerAuth.setDefaults()
+	}
+	if s.Push != nil {
+		s.Push.setDefaults()
+		for _, endpoint := range s.Push.Followers {
+			s.followers = append(s.followers, newFollower(endpoint))
+		}
+	}
+	if s.InstanceID == "" {
+		s.InstanceID = newInstanceID()
+	}
+	if s.CompressMinSize == 0 {
+		s.CompressMinSize = 512
+	}
+	if s.CompressLevel == 0 {
+		s.CompressLevel = 6
+	}
+	if s.ReadConns == 0 {
+		s.ReadConns = 4
+	}
+	if s.LogQueries {
+		s.queryLog = caddy.Log().Named(logSQL)
+	}
+	if s.ExplainQueries {
+		s.explained = &queryPlans{log: caddy.Log().Named(logSQL)}
+	}
+	if s.TLS != nil {
+		files, err := newTLSFiles(s.TLS, s.FIPS)
+		if err != nil {
+			return s, err
+		}
+		s.tlsFiles, s.tlsClient = files, &tlsClient{files: files}
+	}
+
+	registerStorage(s)
+	if s.Expvar {
+		publishExpvars()
+	}
+	initSqliteMetrics()
+
+	caddy.Log().Named(logStorage).Debug(fmt.Sprintf("NewStorage %v %v", c, s))
+	opened := time.Now()
+	if s.readOnly {
+		if err := s.checkTables(); err != nil {
+			return s, err
+		}
+	} else if err := s.ensureTableSetup(); err != nil {
+		if s.Exclusive && isTransient(err) {
+			return s, fmt.Errorf("%s is locked by another process, exclusive requires it to be used by this process only: %v", dbFilePath(s.Dsn), err)
+		}
+		return s, err
+	}
+	start := time.Now()
+	if err := s.openReader(); err != nil {
+		return s, fmt.Errorf("opening read-only connections: %v", err)
+	}
+	s.recordPhase(phaseReaders, start)
+	if err := s.loadLastVacuum(context.Background()); err != nil {
+		return s, err
+	}
+	if s.macKey != nil && !s.readOnly {
+		if err := s.signRows(context.Background()); err != nil {
+			return s, fmt.Errorf("signing rows: %v", err)
+		}
+	}
+	if s.AutoImport {
+		start := time.Now()
+		if err := s.autoImport(context.Background()); err != nil {
+			return s, err
+		}
+		s.recordPhase(phaseAutoImport, start)
+	}
+	s.logStartup(opened)
+	if s.Listen != "" {
+		if err := s.listen(); err != nil {
+			return s, err
+		}
+	}
+	if s.vault != nil {
+		s.goBackground(s.runVault)
+	}
+	if s.encryptQueue != nil {
+		j := s.registerJob(jobEncryptMigration, 0, nil, s.encryptMigrationJob())
+		j.atStart, j.retry, j.wake = true, encryptRetry, s.encryptKick
+	}
+	if s.Backups != nil && s.Backups.Interval > 0 {
+		s.registerJob(jobBackup, time.Duration(s.Backups.Interval), nil, s.backupJob)
+	}
+	if s.MaxWALSize > 0 && s.dialect == dialects[Sqlite] {
+		j := s.registerJob(jobWALLimit, 0, nil, s.walLimitJob)
+		s.walKick = j.wake
+	}
+	if s.Archive != nil {
+		s.registerJob(jobArchive, time.Duration(s.Archive.Interval), nil, s.archiveJob)
+	}
+	if s.LockWarnAfter > 0 {
+		s.registerJob(jobLockWatchdog, s.lockWatchInterval(), nil, s.watchLocks)
+	}
+	if s.Backups != nil && s.Backups.SnapshotOnSignal && len(backupSignals) > 0 {
+		s.registerJob(jobSignalBackup, 0, nil, s.backupJob).signals = backupSignals
+	}
+	if s.Compaction != nil {
+		s.Compaction.setDefaults()
+		s.registerJob(jobCompaction, time.Duration(s.Compaction.Interval), nil, s.compactionJob)
+		if s.Compaction.PagesPerSecond > 0 {
+			s.vacuumKick = s.registerJob(jobVacuumBudget, 0, nil, s.vacuumBudgetJob).wake
+		}
+	}
+	if s.HealthCheck != nil {
+		s.HealthCheck.setDefaults()
+		s.registerJob(jobHealthCheck, time.Duration(s.HealthCheck.Interval), nil, s.healthCheckJob())
+	}
+	if s.Schedule != nil {
+		jobs, err := s.Schedule.jobs()
+		if err != nil {
+			return s, fmt.Errorf("schedule: %v", err)
+		}
+		for name, schedule := range jobs {
+			run := s.backupJob
+			if name != jobBackup {
+				run = s.maintenanceJob(name)
+			}
+			s.registerJob(name, 0, schedule, run)
+		}
+	}
+	if s.ReadOnlyFallback != nil {
+		s.ReadOnlyFallback.setDefaults()
+		s.registerJob(jobWriteProbe, time.Duration(s.ReadOnlyFallback.RetryInterval), nil, s.writeProbeJob)
+	}
+	if s.CircuitBreaker != nil {
+		s.CircuitBreaker.setDefaults()
+	}
+	if s.Replication != nil {
+		s.Replication.setDefaults()
+		s.registerJob(jobReplication, time.Duration(s.Replication.Interval), nil, s.replicationJob).atStart = true
+	}
+	if len(s.SyncPeers) > 0 {
+		s.registerJob(jobSync, time.Duration(s.SyncInterval), nil, s.syncJob).atStart = true
+	}
+	if !s.readOnly {
+		s.registerJob(jobKVExpire, kvExpireInterval, nil, s.expireKV)
+	}
+	// Unless scheduled, these only run when triggered through the admin
+	// API.
+	s.registerJob(MaintenanceVacuum, 0, nil, s.maintenanceJob(MaintenanceVacuum))
+	s.registerJob(MaintenanceLockGC, 0, nil, s.maintenanceJob(MaintenanceLockGC))
+	if s.dialect == dialects[Sqlite] {
+		s.registerJob(MaintenanceIntegrityCheck, 0, nil, s.maintenanceJob(MaintenanceIntegrityCheck))
+		if s.Backups != nil && s.Backups.Dir != "" {
+			s.registerJob(jobBackup, 0, nil, s.backupJob)
+		}
+	}
+	s.registerFollowers()
+	s.startJobs()
+	return s, nil
+}
+
+// CertMagicStorage opens the storage on first use; later calls return the
+// same storage until Cleanup closes it.
+func (c *SqliteStorage) CertMagicStorage() (certmagic.Storage, error) {
+	if c.storage == nil {
+		s, err := NewStorage(*c)
+		if err != nil {
+			return nil, err
+		}
+		c.storage = s.(*SqliteStorage)
+	}
+	if len(c.middleware) > 0 {
+		return Chain(c.storage, c.middleware...), nil
+	}
+	return c.storage, nil
+}
+
+func (c *SqliteStorage) Cleanup() error {
+	if c.storage == nil {
+		return nil
+	}
+	err := c.storage.Close()
+	c.storage = nil
+	return err
+}
+
+type DB interface {
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// Database RDBs this library supports.
+type Database int
+
+const (
+	Sqlite Database = iota
+	Postgres
+	MySQL
+)
+
+func (s *SqliteStorage) ensureTableSetup() error {
+	return s.retryWrite(context.Background(), "setup", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		start := time.Now()
+		for _, statement := range s.dialect.schema {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(statement)); err != nil {
+				return err
+			}
+		}
+		s.recordPhase(phaseSchema, start)
+
+		start = time.Now()
+		if err := s.ensureColumn(ctx, tx, "certmagic_locks", "owner", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_locks", "owner_host", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_locks", "owner_pid", "INTEGER"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_locks", "acquired_at", "TIMESTAMP"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "updated_by", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "checksum", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "size", "INTEGER"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE certmagic_data SET size = length(value) WHERE size IS NULL"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "encoding", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "stored_size", "INTEGER"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE certmagic_data SET stored_size = size WHERE stored_size IS NULL"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "kind", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.ensureColumn(ctx, tx, "certmagic_data", "mac", "TEXT"); err != nil {
+			return err
+		}
+		if err := s.migrateKeyHashes(ctx, tx); err != nil {
+			return err
+		}
+		if s.indexKey == nil {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE certmagic_data SET kind = "+kindExpr(kindRules)+" WHERE kind IS NULL")); err != nil {
+				return err
+			}
+		}
+		if err := s.ensureUsage(ctx, tx); err != nil {
+			return err
+		}
+		s.recordPhase(phaseMigrations, start)
+
+		start = time.Now()
+		for _, statement := range s.dialect.indexes {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(statement)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.recordPhase(phaseIndexes, start)
+		return nil
+	})
+}
+
+// checkTables checks that a database opened read-only was set up by a
+// storage that could write to it.
+func (s *SqliteStorage) checkTables() error {
+	return s.retry(context.Background(), "setup", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		var version int64
+		err := s.queryRow(ctx, s.readDB(), "SELECT COALESCE(MAX(version), 0) FROM certmagic_data", nil).Scan(&version)
+		if err != nil {
+			return fmt.Errorf("read-only database not set up: %v", err)
+		}
+		return nil
+	})
+}
+
+// ensureColumn adds column to table if an older schema lacks it.
+func (s *SqliteStorage) ensureColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(s.dialect.columnsQuery), table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func getMD5String(s string) string {
+	md5Code := md5.Sum([]byte(s + keyHashSalt))
+	return hex.EncodeToString(md5Code[:])
+}
+
+// Lock the key and implement certmagic.Storage.Lock. If the key is
+// already locked, Lock polls until the lock is released or expires, the
+// acquire timeout elapses or ctx is done.
+func (s *SqliteStorage) Lock(ctx context.Context, key string) error {
+	defer observeLatency("lock", key, time.Now())
+	if s.LockAcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.LockAcquireTimeout))
+		defer cancel()
+	}
+	return s.lock(ctx, key, s.LockTimeout*time.Second)
+}
+
+// lock polls until it takes the lock for key with the given ttl or ctx is
+// done.
+func (s *SqliteStorage) lock(ctx context.Context, key string, ttl time.Duration) error {
+	start := time.Now()
+	warned := false
+	for {
+		err := s.tryLock(ctx, key, ttl)
+		if err == nil {
+			sqliteMetrics.lockWait.Observe(time.Since(start).Seconds())
+			s.drain.acquired()
+			caddy.Log().Named(logLocks).Debug(fmt.Sprintf("acquired lock %s after %s", key, time.Since(start)))
+			return nil
+		}
+		if !errors.Is(err, ErrLocked) {
+			sqliteMetrics.lockWait.Observe(time.Since(start).Seconds())
+			sqliteMetrics.lockFailures.Inc()
+			return err
+		}
+
+		if s.LockWarnAfter > 0 && !warned && time.Since(start) > time.Duration(s.LockWarnAfter) {
+			warned = true
+			sqliteMetrics.longLockWaits.Inc()
+			caddy.Log().Named(logLocks).Warn(fmt.Sprintf("waiting for lock %s for %s", key, time.Since(start).Round(time.Second)))
+		}
+
+		caddy.Log().Named(logLocks).Debug(fmt.Sprintf("lock %s is held, polling again in %s", key, time.Duration(s.LockPollInterval)))
+		timer := time.NewTimer(time.Duration(s.LockPollInterval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			sqliteMetrics.lockWait.Observe(time.Since(start).Seconds())
+			sqliteMetrics.lockFailures.Inc()
+			return fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// tryLock makes a single attempt to take the lock for key.
+func (s *SqliteStorage) tryLock(ctx context.Context, key string, ttl time.Duration) error {
+	return s.retryWrite(ctx, "lock", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := s.isLocked(tx, key); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		expires := now.Add(ttl)
+		key_hash := s.keyHash(key)
+		hostname, _ := os.Hostname()
+		pid := os.Getpid()
+		query := `INSERT INTO certmagic_locks (key_hash,key, expires, owner, owner_host, owner_pid, acquired_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(key_hash) DO UPDATE set expires = ?, owner = ?, owner_host = ?, owner_pid = ?, acquired_at = ?`
+		if _, err := s.exec(ctx, tx, query, []string{key}, key_hash, s.storedKey(key), expires, s.InstanceID, hostname, pid, now,
+			expires, s.InstanceID, hostname, pid, now); err != nil {
+			return fmt.Errorf("failed to lock key: %s: %w", key, err)
+		}
+
+		return tx.Commit()
+	})
+}
+
+// Unlock the key and implement certmagic.Storage.Unlock.
+func (s *SqliteStorage) Unlock(ctx context.Context, key string) error {
+	defer observeLatency("unlock", key, time.Now())
+	return s.retryWrite(ctx, "unlock", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		res, err := s.exec(ctx, s.writeDB(), "DELETE FROM certmagic_locks WHERE key_hash = ?", []string{key}, key_hash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			s.drain.released()
+			caddy.Log().Named(logLocks).Debug(fmt.Sprintf("released lock %s", key))
+		}
+		return nil
+	})
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// isLocked returns nil if the key is not locked.
+func (s *SqliteStorage) isLocked(queryer queryer, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.QueryTimeout*time.Second)
+	defer cancel()
+	key_hash := s.keyHash(key)
+	current_timestamp := time.Now()
+
+	row := s.queryRow(ctx, queryer, "select exists(select 1 from certmagic_locks where key_hash = ? and expires > ?)", []string{key}, key_hash, current_timestamp)
+	var locked bool
+	if err := row.Scan(&locked); err != nil {
+		return err
+	}
+	if locked {
+		return fmt.Errorf("key %s is %w", key, ErrLocked)
+	}
+	return nil
+}
+
+// Store puts value at key.
+func (s *SqliteStorage) Store(ctx context.Context, key string, value []byte) error {
+	return s.store(ctx, key, newSecret(value), sql.NullTime{})
+}
+
+// StoreWithModTime puts value at key like Store, but records modified as
+// its modification time instead of the current time, unless modified is
+// zero. It is meant for tooling that moves keys between storages.
+func (s *SqliteStorage) StoreWithModTime(ctx context.Context, key string, value []byte, modified time.Time) error {
+	return s.store(ctx, key, newSecret(value), sql.NullTime{Time: modified.UTC(), Valid: !modified.IsZero()})
+}
+
+// store writes value at key with the modification time modified, or the
+// current time if modified is NULL.
+func (s *SqliteStorage) store(ctx context.Context, key string, value secret, modified sql.NullTime) error {
+	defer observeLatency("store", key, time.Now())
+	if err := s.throttle(key); err != nil {
+		return wrapError("store", err)
+	}
+	written := false
+	err := s.retryWrite(ctx, "store", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		var updatedBy sql.NullString
+		if s.RecordWriter || s.TrackConflicts {
+			updatedBy = sql.NullString{String: s.InstanceID, Valid: true}
+		}
+		var checksum sql.NullString
+		if s.Checksum || s.SkipUnchanged {
+			checksum = sql.NullString{String: valueChecksum(value.reveal()), Valid: true}
+		}
+		stored, encoding, err := s.encodeValue(key, value)
+		if err != nil {
+			return err
+		}
+		if s.macKey != nil {
+			// The modification time has to be known to sign the row.
+			if !modified.Valid {
+				modified = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			}
+			modified.Time = modified.Time.Truncate(time.Second)
+		}
+
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if s.SkipUnchanged {
+			var stored sql.NullString
+			err := s.queryRow(ctx, tx, "SELECT checksum FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash).Scan(&stored)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if stored.Valid && stored.String == checksum.String {
+				sqliteMetrics.skippedWrites.Inc()
+				return nil
+			}
+		}
+		var version int64
+		if s.TrackConflicts {
+			if version, err = s.checkConflict(ctx, tx, key, key_hash); err != nil {
+				return err
+			}
+		}
+		var mac sql.NullString
+		if s.macKey != nil {
+			// The row is signed with the version the write gives it.
+			var current int64
+			err := s.queryRow(ctx, tx, "SELECT version FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash).Scan(&current)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			mac = sql.NullString{String: s.rowMAC(key, value.reveal(), modified.Time, current+1), Valid: true}
+		}
+		prev, err := s.rowUsage(ctx, tx, key, key_hash)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(ctx, tx, `INSERT INTO certmagic_data (key_hash, key, value, size, stored_size, encoding, kind, updated_by, checksum, mac, version, modified)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, COALESCE(?, current_timestamp)) ON CONFLICT(key_hash) DO UPDATE
+	set value = ?, size = ?, stored_size = ?, encoding = ?, updated_by = ?, checksum = ?, mac = ?, version = certmagic_data.version + 1, modified = COALESCE(?, current_timestamp)`, []string{key},
+			key_hash, s.storedKey(key), stored.reveal(), value.len(), stored.len(), encoding, s.storedKind(key), updatedBy, checksum, mac, modified,
+			stored.reveal(), value.len(), stored.len(), encoding, updatedBy, checksum, mac, modified)
+		if err != nil {
+			return err
+		}
+		if err := s.addUsage(ctx, tx, key, usageDelta{1, int64(value.len()), int64(stored.len())}.minus(prev)); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.invalidate(key_hash)
+		if s.TrackConflicts {
+			s.versions.observe(key_hash, version+1)
+		}
+		written = true
+		return nil
+	})
+	if written && keyKind(key) == KindCertificate && strings.HasPrefix(key, "certificates/") {
+		s.certificateUpdated(key, value.reveal())
+	}
+	return err
+}
+
+// Load retrieves the value at key.
+func (s *SqliteStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := s.LoadWithInfo(ctx, key)
+	return value, err
+}
+
+// LoadWithInfo retrieves the value at key together with the information
+// Stat would return, in a single query.
+func (s *SqliteStorage) LoadWithInfo(ctx context.Context, key string) ([]byte, certmagic.KeyInfo, error) {
+	defer observeLatency("load", key, time.Now())
+	key_hash := s.keyHash(key)
+	if value, modified, ok := s.cachedValue(ctx, key_hash); ok {
+		return value.reveal(), keyInfo(key, value, modified), nil
+	}
+	var generation uint64
+	if s.cache != nil {
+		generation = s.cache.begin()
+	}
+	var value secret
+	var version int64
+	var modified time.Time
+	err := s.retry(ctx, "load", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		var err error
+		value, modified, version, err = s.loadRow(ctx, s.readDB(), key)
+		return err
+	})
+	if err != nil {
+		return nil, certmagic.KeyInfo{}, err
+	}
+	if s.TrackConflicts {
+		s.versions.observe(key_hash, version)
+	}
+	if s.cache != nil {
+		s.cache.add(key_hash, value, modified, version, generation)
+	}
+	return value.reveal(), keyInfo(key, value, modified), nil
+}
+
+// loadRow reads the value of key through q and returns it decoded and
+// verified together with its modification time and version.
+func (s *SqliteStorage) loadRow(ctx context.Context, q queryer, key string) (secret, time.Time, int64, error) {
+	var stored []byte
+	var checksum, mac sql.NullString
+	var version int64
+	var modified time.Time
+	var encoding sql.NullString
+	key_hash := s.keyHash(key)
+	err := s.queryRow(ctx, q, "SELECT value, checksum, version, modified, encoding, mac FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash).Scan(&stored, &checksum, &version, &modified, &encoding, &mac)
+	if err == sql.ErrNoRows {
+		return secret{}, time.Time{}, 0, fs.ErrNotExist
+	}
+	if err != nil {
+		return secret{}, time.Time{}, 0, err
+	}
+	value, err := s.decodeValue(key, newSecret(stored), encoding)
+	if err != nil {
+		return secret{}, time.Time{}, 0, err
+	}
+	if s.encryptQueue != nil && s.needsEncryption(key, encoding) {
+		s.queueEncryption(key)
+	}
+	if s.Checksum {
+		if err := verifyChecksum(key, value.reveal(), checksum); err != nil {
+			return secret{}, time.Time{}, 0, err
+		}
+	}
+	if err := s.verifyMAC(key, value.reveal(), modified, version, mac); err != nil {
+		return secret{}, time.Time{}, 0, err
+	}
+	return value, modified, version, nil
+}
+
+// loadManyBatch is the number of keys LoadMany fetches per query, well
+// below the bound parameter limits of the supported databases.
+const loadManyBatch = 500
+
+// LoadMany retrieves the values of several keys with one query per batch
+// of keys. Keys that do not exist are missing from the returned map.
+func (s *SqliteStorage) LoadMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for start := 0; start < len(keys); start += loadManyBatch {
+		batch := keys[start:min(start+loadManyBatch, len(keys))]
+		args := make([]any, len(batch))
+		for i, key := range batch {
+			args[i] = s.keyHash(key)
+		}
+		query := "SELECT key, value, checksum, encoding, modified, version, mac FROM certmagic_data WHERE key_hash IN (?" + strings.Repeat(", ?", len(batch)-1) + ")"
+		err := s.retry(ctx, "load_many", func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+			defer cancel()
+			rows, err := s.query(ctx, s.readDB(), query, batch, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var key string
+				var stored []byte
+				var checksum, encoding, mac sql.NullString
+				var modified time.Time
+				var version int64
+				if err := rows.Scan(&key, &stored, &checksum, &encoding, &modified, &version, &mac); err != nil {
+					return err
+				}
+				if key, err = s.plainKey(key); err != nil {
+					return err
+				}
+				value, err := s.decodeValue(key, newSecret(stored), encoding)
+				if err != nil {
+					return err
+				}
+				if s.encryptQueue != nil && s.needsEncryption(key, encoding) {
+					s.queueEncryption(key)
+				}
+				if s.Checksum {
+					if err := verifyChecksum(key, value.reveal(), checksum); err != nil {
+						return err
+					}
+				}
+				if err := s.verifyMAC(key, value.reveal(), modified, version, mac); err != nil {
+					return err
+				}
+				values[key] = value.reveal()
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func keyInfo(key string, value secret, modified time.Time) certmagic.KeyInfo {
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   modified,
+		Size:       int64(value.len()),
+		IsTerminal: true,
+	}
+}
+
+// Delete deletes key. An error should be
+// returned only if the key still exists
+// when the method returns. With strict_delete
+// a missing key fails with fs.ErrNotExist.
+func (s *SqliteStorage) Delete(ctx context.Context, key string) error {
+	defer observeLatency("delete", key, time.Now())
+	return s.retryWrite(ctx, "delete", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		prev, err := s.rowUsage(ctx, tx, key, key_hash)
+		if err != nil {
+			return err
+		}
+		res, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE key_hash = ?", []string{key}, key_hash)
+		if err != nil {
+			return err
+		}
+		if err := s.addUsage(ctx, tx, key, usageDelta{}.minus(prev)); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.versions.forget(key_hash)
+		s.invalidate(key_hash)
+		s.deleted()
+		if s.StrictDelete {
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return fs.ErrNotExist
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePrefix deletes every key starting with prefix in a single
+// transaction and returns the number of keys deleted.
+func (s *SqliteStorage) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	var deleted int64
+	err := s.retryWrite(ctx, "delete_prefix", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		if s.indexKey != nil {
+			tx, err := s.writeDB().BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if deleted, err = s.deleteHiddenPrefix(ctx, tx, prefix); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+		cond, args := s.dialect.prefixRange(prefix)
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		// The prefix may end inside the first segment and span several
+		// accounted prefixes.
+		rows, err := s.query(ctx, tx, fmt.Sprintf(`SELECT %s, count(*), COALESCE(SUM(size), 0), COALESCE(SUM(stored_size), 0)
+	FROM certmagic_data WHERE %s GROUP BY 1`, s.dialect.prefixExpr, cond), []string{prefix}, args...)
+		if err != nil {
+			return err
+		}
+		usage := map[string]usageDelta{}
+		for rows.Next() {
+			var p string
+			var d usageDelta
+			if err := rows.Scan(&p, &d.keys, &d.size, &d.storedSize); err != nil {
+				rows.Close()
+				return err
+			}
+			usage[p] = d
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		res, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE "+cond, []string{prefix}, args...)
+		if err != nil {
+			return err
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for p, d := range usage {
+			if err := s.addUsage(ctx, tx, p, usageDelta{}.minus(d)); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err == nil && s.cache != nil {
+		s.cache.clear()
+	}
+	if err == nil && deleted > 0 {
+		s.deleted()
+	}
+	return deleted, err
+}
+
+// Move renames oldKey to newKey in a single transaction. Like os.Rename,
+// an existing newKey is replaced.
+func (s *SqliteStorage) Move(ctx context.Context, oldKey, newKey string) error {
+	oldHash, newHash := s.keyHash(oldKey), s.keyHash(newKey)
+	if oldHash == newHash {
+		return nil
+	}
+	err := s.retryWrite(ctx, "move", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		moved, err := s.rowUsage(ctx, tx, oldKey, oldHash)
+		if err != nil {
+			return err
+		}
+		replaced, err := s.rowUsage(ctx, tx, newKey, newHash)
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE key_hash = ?", []string{newKey}, newHash); err != nil {
+			return err
+		}
+		res, err := s.exec(ctx, tx, "UPDATE certmagic_data SET key_hash = ?, key = ?, kind = ?, mac = NULL WHERE key_hash = ?", []string{oldKey, newKey}, newHash, s.storedKey(newKey), s.storedKind(newKey), oldHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fs.ErrNotExist
+		}
+		if err := s.addUsage(ctx, tx, oldKey, usageDelta{}.minus(moved)); err != nil {
+			return err
+		}
+		if err := s.addUsage(ctx, tx, newKey, moved.minus(replaced)); err != nil {
+			return err
+		}
+		if err := s.rebindValue(ctx, tx, oldKey, newKey); err != nil {
+			return err
+		}
+		if s.macKey != nil {
+			if err := s.signRow(ctx, tx, newKey); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	for _, keyHash := range []string{oldHash, newHash} {
+		s.versions.forget(keyHash)
+		s.invalidate(keyHash)
+	}
+	return nil
+}
+
+// Copy duplicates the value of srcKey to dstKey without loading it into
+// the process, unless it is encrypted or dstKey is to be encrypted. An
+// existing dstKey is replaced.
+func (s *SqliteStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	srcHash, dstHash := s.keyHash(srcKey), s.keyHash(dstKey)
+	if srcHash == dstHash {
+		return nil
+	}
+	var updatedBy sql.NullString
+	if s.RecordWriter || s.TrackConflicts {
+		updatedBy = sql.NullString{String: s.InstanceID, Valid: true}
+	}
+	err := s.retryWrite(ctx, "copy", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		// Keep counting versions of dstKey so other instances tracking
+		// conflicts notice the overwrite.
+		var version int64
+		err = s.queryRow(ctx, tx, "SELECT version FROM certmagic_data WHERE key_hash = ?", []string{dstKey}, dstHash).Scan(&version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		copied, err := s.rowUsage(ctx, tx, srcKey, srcHash)
+		if err != nil {
+			return err
+		}
+		replaced, err := s.rowUsage(ctx, tx, dstKey, dstHash)
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, tx, "DELETE FROM certmagic_data WHERE key_hash = ?", []string{dstKey}, dstHash); err != nil {
+			return err
+		}
+		res, err := s.exec(ctx, tx, `INSERT INTO certmagic_data (key_hash, key, value, size, stored_size, encoding, kind, updated_by, checksum, version)
+	SELECT ?, ?, value, size, stored_size, encoding, ?, ?, checksum, ? FROM certmagic_data WHERE key_hash = ?`, []string{srcKey, dstKey}, dstHash, s.storedKey(dstKey), s.storedKind(dstKey), updatedBy, version+1, srcHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fs.ErrNotExist
+		}
+		if err := s.addUsage(ctx, tx, dstKey, copied.minus(replaced)); err != nil {
+			return err
+		}
+		if err := s.rebindValue(ctx, tx, srcKey, dstKey); err != nil {
+			return err
+		}
+		if s.macKey != nil {
+			if err := s.signRow(ctx, tx, dstKey); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	s.invalidate(dstHash)
+	return nil
+}
+
+// Exists returns true if the key exists
+// and there was no error checking.
+func (s *SqliteStorage) Exists(ctx context.Context, key string) bool {
+	if _, _, ok := s.cachedValue(ctx, s.keyHash(key)); ok {
+		return true
+	}
+	var exists bool
+	err := s.retry(ctx, "exists", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+
+		row := s.queryRow(ctx, s.readDB(), "SELECT EXISTS(SELECT 1 FROM certmagic_data WHERE key_hash = ?)", []string{key}, key_hash)
+		return row.Scan(&exists)
+	})
+	return err == nil && exists
+}
+
+// List returns all keys that match prefix.
+// If recursive is true, non-terminal keys
+// will be enumerated (i.e. "directories"
+// should be walked); otherwise, only keys
+// prefixed exactly by prefix will be listed.
+func (s *SqliteStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	defer observeLatency("list", prefix, time.Now())
+	if s.Compat == CompatFileSystem {
+		return s.listDir(ctx, prefix, recursive)
+	}
+	if recursive {
+		return nil, fmt.Errorf("recursive not supported")
+	}
+	return s.keysWithPrefix(ctx, prefix)
+}
+
+// ListFunc calls fn for every key that List would return, reading the keys
+// from the database one row at a time instead of collecting them first.
+// Iteration stops at the first error returned by fn, which is returned.
+// The query is bound by ctx only, not by the query timeout. Unless the
+// database is in WAL mode, writes made by fn wait for the iteration to end.
+func (s *SqliteStorage) ListFunc(ctx context.Context, prefix string, recursive bool, fn func(key string) error) error {
+	defer observeLatency("list", prefix, time.Now())
+	if s.Compat == CompatFileSystem {
+		keys, err := s.listDir(ctx, prefix, recursive)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if recursive {
+		return fmt.Errorf("recursive not supported")
+	}
+	var rows *sql.Rows
+	err := s.retry(ctx, "list", func(ctx context.Context) error {
+		cond, args := s.prefixCond(prefix)
+		var err error
+		rows, err = s.query(ctx, s.readDB(), "select key from certmagic_data where "+cond, []string{prefix}, args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return err
+		}
+		key, ok, err := s.matchKey(stored, prefix)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// keysWithPrefix returns every key starting with prefix.
+func (s *SqliteStorage) keysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.retry(ctx, "list", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+
+		cond, args := s.prefixCond(prefix)
+		rows, err := s.query(ctx, s.readDB(), "select key from certmagic_data where "+cond, []string{prefix}, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys = nil
+		for rows.Next() {
+			var stored string
+			if err := rows.Scan(&stored); err != nil {
+				return err
+			}
+			key, ok, err := s.matchKey(stored, prefix)
+			if err != nil {
+				return err
+			}
+			if ok {
+				keys = append(keys, key)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Stat returns information about key, or fs.ErrNotExist if it does not
+// exist.
+func (s *SqliteStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	defer observeLatency("stat", key, time.Now())
+	var modified time.Time
+	var size sql.NullInt64
+	err := s.retry(ctx, "stat", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		key_hash := s.keyHash(key)
+		// The size column is covered by an index, so the value is not read.
+		row := s.queryRow(ctx, s.readDB(), s.dialect.statQuery, []string{key}, key_hash)
+		err := row.Scan(&size, &modified)
+		if err == sql.ErrNoRows {
+			return fs.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if !size.Valid {
+			// Written by a version without the size column since startup.
+			return s.queryRow(ctx, s.readDB(), "select length(value) from certmagic_data where key_hash = ?", []string{key}, key_hash).Scan(&size)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) && s.Compat == CompatFileSystem {
+		return s.statDir(ctx, key)
+	}
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   modified,
+		Size:       size.Int64,
+		IsTerminal: true,
+	}, nil
+}
+
+// Validate rejects configurations that cannot work, so that they fail
+// when the config is loaded rather than on first use.
+func (s SqliteStorage) Validate() error {
+	caddy.Log().Named(logStorage).Info(fmt.Sprintf("Validate"))
+
+	if s.QueryTimeout <= 0 {
+		return fmt.Errorf("query_timeout must be positive, got %d", s.QueryTimeout)
+	}
+	if s.LockTimeout <= 0 {
+		return fmt.Errorf("lock_timeout must be positive, got %d", s.LockTimeout)
+	}
+	if s.LockPollInterval <= 0 {
+		return fmt.Errorf("lock_poll_interval must be positive, got %v", time.Duration(s.LockPollInterval))
+	}
+	if s.LockTimeout*time.Second < time.Duration(s.LockPollInterval) {
+		return fmt.Errorf("lock_timeout (%v) is shorter than lock_poll_interval (%v), locks would expire between two polls",
+			s.LockTimeout*time.Second, time.Duration(s.LockPollInterval))
+	}
+	if s.LockAcquireTimeout < 0 || s.LockWarnAfter < 0 || s.DrainTimeout < 0 || s.WriteWaitTimeout < 0 {
+		return errors.New("lock_acquire_timeout, lock_warn_after, drain_timeout and write_wait_timeout must not be negative")
+	}
+	if s.Compat != "" && s.Compat != CompatFileSystem {
+		return fmt.Errorf("compat must be %s, got %q", CompatFileSystem, s.Compat)
+	}
+	if s.ReadConns < 0 {
+		return fmt.Errorf("read_conns must not be negative, got %d", s.ReadConns)
+	}
+	if s.MaxWALSize < 0 {
+		return fmt.Errorf("max_wal_size must not be negative, got %d", s.MaxWALSize)
+	}
+	if s.CompressMinSize < 0 || s.CompressLevel < 0 || s.CompressLevel > 9 {
+		return fmt.Errorf("compress_min_size must not be negative and compress_level must be between 1 and 9")
+	}
+
+	dialect := Sqlite
+	if s.Dialect != "" {
+		var err error
+		if dialect, err = parseDialect(s.Dialect); err != nil {
+			return err
+		}
+	}
+	if dialect == Sqlite {
+		if info, err := os.Stat(dbFilePath(s.Dsn)); err == nil && info.IsDir() {
+			return fmt.Errorf("dsn %s is a directory, not a database file", s.Dsn)
+		}
+	}
+
+	if r := s.Retry; r != nil {
+		if r.MaxAttempts < 1 || r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+			return errors.New("retry: max_attempts must be at least 1 and backoffs must not be negative")
+		}
+		if r.Jitter < 0 || r.Jitter > 1 {
+			return fmt.Errorf("retry: jitter must be between 0 and 1, got %v", r.Jitter)
+		}
+	}
+	if s.Cache != nil && (s.Cache.Size < 0 || s.Cache.Revalidate < 0) {
+		return errors.New("cache: size and revalidate must not be negative")
+	}
+	if s.RateLimit != nil && (s.RateLimit.Rate <= 0 || s.RateLimit.Burst < 0) {
+		return errors.New("rate_limit: rate must be positive and burst must not be negative")
+	}
+	if s.Encryption != nil {
+		if _, err := s.Encryption.aead(); err != nil {
+			return fmt.Errorf("encryption: %v", err)
+		}
+	}
+	if c := s.Compaction; c != nil {
+		if c.FreeRatio < 0 || c.FreeRatio > 1 || c.Interval < 0 {
+			return errors.New("compaction: free_ratio must be between 0 and 1 and interval must not be negative")
+		}
+		if c.PagesPerSecond < 0 {
+			return errors.New("compaction: vacuum_pages_per_second must not be negative")
+		}
+		if c.Window != "" {
+			if _, _, err := parseWindow(c.Window); err != nil {
+				return fmt.Errorf("compaction: %v", err)
+			}
+		}
+		if dialect != Sqlite {
+			return fmt.Errorf("compaction: not supported for %s", s.Dialect)
+		}
+	}
+	if sc := s.Schedule; sc != nil {
+		if _, err := sc.jobs(); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		if sc.Backup != "" && (s.Backups == nil || s.Backups.Dir == "") {
+			return errors.New("schedule: backup requires a backup dir")
+		}
+		if (sc.Backup != "" || sc.IntegrityCheck != "") && dialect != Sqlite {
+			return fmt.Errorf("schedule: backup and integrity_check are not supported for %s", s.Dialect)
+		}
+	}
+	if h := s.HealthCheck; h != nil && (h.Interval < 0 || h.Failures < 0) {
+		return errors.New("health_check: interval and failures must not be negative")
+	}
+	if f := s.ReadOnlyFallback; f != nil && (f.Failures < 0 || f.RetryInterval < 0) {
+		return errors.New("read_only_fallback: failures and retry_interval must not be negative")
+	}
+	if b := s.CircuitBreaker; b != nil && (b.Failures < 0 || b.Cooldown < 0) {
+		return errors.New("circuit_breaker: failures and cooldown must not be negative")
+	}
+	if r := s.Replication; r != nil {
+		if r.Interval < 0 || r.BatchSize < 0 {
+			return errors.New("replication: interval and batch_size must not be negative")
+		}
+		if u, err := url.Parse(r.Source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("replication: source must be an http or https URL, got %q", r.Source)
+		}
+		if dialect != Sqlite {
+			return fmt.Errorf("replication: not supported for %s", s.Dialect)
+		}
+	}
+	if s.SyncInterval < 0 {
+		return errors.New("sync_interval must not be negative")
+	}
+	for _, peer := range s.SyncPeers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("sync_peers: peer must be an http or https URL, got %q", peer)
+		}
+	}
+	if p := s.Push; p != nil {
+		if p.BatchSize < 0 || p.RetryInterval < 0 {
+			return errors.New("push: batch_size and retry_interval must not be negative")
+		}
+		if len(p.Followers) == 0 {
+			return errors.New("push: at least one follower is required")
+		}
+		for _, follower := range p.Followers {
+			if u, err := url.Parse(follower); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("push: follower must be an http or https URL, got %q", follower)
+			}
+		}
+		if dialect != Sqlite {
+			return fmt.Errorf("push: not supported for %s", s.Dialect)
+		}
+	}
+	if a := s.Auth; a != nil {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if t := s.PeerAuth; t != nil {
+		t := *t
+		t.setDefaults()
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("peer_auth: %v", err)
+		}
+	}
+	if v := s.Vault; v != nil {
+		if u, err := url.Parse(v.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("vault: address must be an http or https URL, got %q", v.Address)
+		}
+		if v.Path == "" || v.Token == "" {
+			return errors.New("vault: path and token are required")
+		}
+	}
+	if t := s.TLS; t != nil {
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			return errors.New("tls: cert_file and key_file must be set together")
+		}
+		if s.Listen != "" && t.CertFile == "" {
+			return errors.New("tls: cert_file is required to serve the listener")
+		}
+	}
+	if s.ExplainQueries && dialect != Sqlite {
+		return fmt.Errorf("explain_queries: not supported for %s", s.Dialect)
+	}
+	if s.Listen != "" && dialect != Sqlite {
+		return fmt.Errorf("listen: not supported for %s", s.Dialect)
+	}
+	// The listener is reachable from outside the admin API, so it needs
+	// TLS to keep the private keys in the feed from travelling in
+	// plaintext, which auth alone doesn't, and client certificates or
+	// tokens to tell peers apart.
+	if s.Listen != "" && (s.TLS == nil || s.TLS.CertFile == "") {
+		return errPlaintextListener
+	}
+	if s.Listen != "" && s.Auth == nil && s.TLS.CAFile == "" {
+		return errors.New("listen: requires tls with cert_file and ca_file, or auth")
+	}
+	if len(s.SyncPeers) > 0 && dialect != Sqlite {
+		return fmt.Errorf("sync_peers: not supported for %s", s.Dialect)
+	}
+	if s.MaxWALSize > 0 && dialect != Sqlite {
+		return fmt.Errorf("max_wal_size: not supported for %s", s.Dialect)
+	}
+	if s.Exclusive && dialect != Sqlite {
+		return fmt.Errorf("exclusive: not supported for %s", s.Dialect)
+	}
+	if dialect == Sqlite {
+		if err := s.validateURI(); err != nil {
+			return fmt.Errorf("dsn: %v", err)
+		}
+	}
+	if b := s.Backups; b != nil {
+		if b.Interval < 0 || b.Keep < 0 {
+			return errors.New("backup: interval and keep must not be negative")
+		}
+		if b.Dir == "" && (b.Interval > 0 || b.SnapshotOnSignal) {
+			return errors.New("backup: dir is required for scheduled and signal triggered snapshots")
+		}
+		if _, err := b.aead(); err != nil {
+			return fmt.Errorf("backup: %v", err)
+		}
+		if dialect != Sqlite {
+			return fmt.Errorf("backup: snapshots are not supported for %s", s.Dialect)
+		}
+	}
+	if a := s.Archive; a != nil {
+		if a.Interval < 0 || a.MaxAge < 0 || a.Keep < 0 {
+			return errors.New("archive: interval, max_age and keep must not be negative")
+		}
+		if dialect != Sqlite {
+			return fmt.Errorf("archive: not supported for %s", s.Dialect)
+		}
+	}
 	return nil
 }
 
@@ -349,5 +2606,6 @@ var (
 	_ caddy.Module          = (*SqliteStorage)(nil)
 	_ caddy.Provisioner     = (*SqliteStorage)(nil)
 	_ caddy.Validator       = (*SqliteStorage)(nil)
+	_ caddy.CleanerUpper    = (*SqliteStorage)(nil)
 	_ caddyfile.Unmarshaler = (*SqliteStorage)(nil)
 )
@@ -0,0 +1,105 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// syncBatchSize is the number of changes exchanged with a sync peer at once.
+const syncBatchSize = 500
+
+// syncPushMeta names the certmagic_meta row holding the sequence number of
+// the local change feed pushed to peer so far.
+func syncPushMeta(peer string) string {
+	return "sync_push:" + peer
+}
+
+// syncJob exchanges changes with every sync peer, it runs at startup and
+// then every sync_interval. It counts the changes it pulled.
+func (s *SqliteStorage) syncJob(ctx context.Context) (int64, error) {
+	var pulled int64
+	var errs []error
+	for _, peer := range s.SyncPeers {
+		n, err := s.syncPeer(ctx, peer)
+		pulled += int64(n)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("syncing with %s: %v", peer, err))
+		}
+	}
+	return pulled, errors.Join(errs...)
+}
+
+// syncPeer pulls the changes of peer, then pushes the local ones to it.
+// Both sides resolve conflicts the same way, so they converge whichever
+// of them syncs. It returns the number of changes pulled.
+func (s *SqliteStorage) syncPeer(ctx context.Context, peer string) (int, error) {
+	pulled, err := s.pull(ctx, peer, syncBatchSize)
+	if err != nil {
+		return pulled, fmt.Errorf("pulling: %v", err)
+	}
+	if _, err := s.push(ctx, peer, syncBatchSize); err != nil {
+		return pulled, fmt.Errorf("pushing: %v", err)
+	}
+	return pulled, nil
+}
+
+// push sends batches of the local change feed to peer until it is caught
+// up, and returns the sequence number pushed so far. Changes pulled from
+// peer are sent back too, and skipped by it.
+func (s *SqliteStorage) push(ctx context.Context, peer string, batchSize int) (int64, error) {
+	value, err := s.meta(ctx, syncPushMeta(peer))
+	if err != nil {
+		return 0, err
+	}
+	since, _ := strconv.ParseInt(value, 10, 64)
+	for {
+		set, err := s.Changes(ctx, since, batchSize)
+		if err != nil {
+			return since, err
+		}
+		if set.Last == since {
+			return since, nil
+		}
+		if len(set.Changes) > 0 {
+			if err := s.postChanges(ctx, peer, set); err != nil {
+				return since, err
+			}
+		}
+		if err := s.setMeta(ctx, syncPushMeta(peer), strconv.FormatInt(set.Last, 10)); err != nil {
+			return since, err
+		}
+		since = set.Last
+	}
+}
+
+// postChanges sends a batch of changes to the changes endpoint of peer.
+func (s *SqliteStorage) postChanges(ctx context.Context, peer string, set ChangeSet) error {
+	body, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.signRequest(req, body)
+	client, err := s.httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", peer, resp.Status)
+	}
+	return nil
+}
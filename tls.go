@@ -0,0 +1,234 @@
+package storagesqlite
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TLSConfig secures the replication listener and the requests of
+// replication, sync_peers and push with mutual TLS. The same files serve
+// both roles: the certificate identifies this instance to its peers, and
+// the CA verifies theirs. Certificate and CA files are read again when
+// they change, so they can be rotated without a restart.
+type TLSConfig struct {
+	// Certificate and key identifying this instance, as PEM files.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// PEM file of the CAs that issue the peer certificates. The listener
+	// requires client certificates signed by them; requests verify
+	// servers with them instead of the system roots.
+	CAFile string `json:"ca_file,omitempty"`
+	// Subject alternative names (DNS names, IP addresses, URIs or email
+	// addresses) a peer certificate needs one of. Any verified peer is
+	// allowed if empty.
+	AllowedSANs []string `json:"allowed_sans,omitempty"`
+}
+
+// tlsFiles caches the certificate and CA pool of a TLSConfig and reloads
+// them when the modification time of their files changes.
+type tlsFiles struct {
+	config *TLSConfig
+	// restrict the connections to FIPS-approved algorithms.
+	fips bool
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	pool     *x509.CertPool
+	poolTime time.Time
+}
+
+func newTLSFiles(config *TLSConfig, fips bool) (*tlsFiles, error) {
+	f := &tlsFiles{config: config, fips: fips}
+	if config.CertFile != "" {
+		if _, err := f.certificate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.CAFile != "" {
+		if _, _, err := f.caPool(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// modTime returns the latest modification time of files.
+func modTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certificate returns the certificate, loading it again if its files
+// changed. The last good certificate is kept if they can't be loaded.
+func (f *tlsFiles) certificate() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed, err := modTime(f.config.CertFile, f.config.KeyFile)
+	if err == nil && changed.Equal(f.certTime) {
+		return f.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile); err == nil {
+			f.cert, f.certTime = &cert, changed
+			return f.cert, nil
+		}
+	}
+	if f.cert == nil {
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	return f.cert, nil
+}
+
+// caPool returns the CA pool and whether it changed since the last call,
+// loading it again if its file changed.
+func (f *tlsFiles) caPool() (*x509.CertPool, time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed, err := modTime(f.config.CAFile)
+	if err == nil && changed.Equal(f.poolTime) {
+		return f.pool, f.poolTime, nil
+	}
+	if err == nil {
+		var pem []byte
+		if pem, err = os.ReadFile(f.config.CAFile); err == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				err = errors.New("no certificates found")
+			} else {
+				f.pool, f.poolTime = pool, changed
+				return f.pool, f.poolTime, nil
+			}
+		}
+	}
+	if f.pool == nil {
+		return nil, time.Time{}, fmt.Errorf("loading TLS CA file: %v", err)
+	}
+	return f.pool, f.poolTime, nil
+}
+
+// verifyPeer authorizes a verified peer by the subject alternative names
+// of its certificate.
+func (f *tlsFiles) verifyPeer(cs tls.ConnectionState) error {
+	if len(f.config.AllowedSANs) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	cert := cs.PeerCertificates[0]
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if slices.Contains(f.config.AllowedSANs, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate names %v are not allowed", sans)
+}
+
+// serverConfig returns the tls.Config of the replication listener, which
+// requires client certificates if a CA is configured.
+func (f *tlsFiles) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					return f.certificate()
+				},
+				VerifyConnection: f.verifyPeer,
+			}
+			if f.config.CAFile != "" {
+				pool, _, err := f.caPool()
+				if err != nil {
+					return nil, err
+				}
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			if f.fips {
+				restrictTLS(config)
+			}
+			return config, nil
+		},
+	}
+}
+
+// tlsClient builds HTTP clients for requests to peers, and builds a new
+// one when the CA file changes.
+type tlsClient struct {
+	files *tlsFiles
+
+	mu       sync.Mutex
+	client   *http.Client
+	poolTime time.Time
+}
+
+// get returns a client trusting the current CA pool.
+func (c *tlsClient) get() (*http.Client, error) {
+	var pool *x509.CertPool
+	var poolTime time.Time
+	if c.files.config.CAFile != "" {
+		var err error
+		if pool, poolTime, err = c.files.caPool(); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil && poolTime.Equal(c.poolTime) {
+		return c.client, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		RootCAs:          pool,
+		VerifyConnection: c.files.verifyPeer,
+	}
+	if c.files.fips {
+		restrictTLS(transport.TLSClientConfig)
+	}
+	if c.files.config.CertFile != "" {
+		transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.files.certificate()
+		}
+	}
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+	c.client, c.poolTime = &http.Client{Transport: transport}, poolTime
+	return c.client, nil
+}
+
+// httpClient returns the client for requests to replication sources, sync
+// peers and followers.
+func (s *SqliteStorage) httpClient() (*http.Client, error) {
+	if s.tlsClient == nil {
+		return http.DefaultClient, nil
+	}
+	return s.tlsClient.get()
+}
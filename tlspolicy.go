@@ -0,0 +1,197 @@
+package storagesqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// Actions of a DomainPolicy.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// domainPolicyFeedPrefix starts the keys under which the change feed
+// records the domain policies, followed by the pattern, so that
+// replication and sync carry them along with the certificates. Hidden key
+// names never contain a colon, and certmagic keys don't start with one.
+const domainPolicyFeedPrefix = ":domain_policies/"
+
+// DomainPolicy allows or denies on-demand TLS certificates for the
+// domains matching a pattern: a domain name, or *. followed by a domain
+// name for all of its subdomains at any depth.
+type DomainPolicy struct {
+	Pattern string    `json:"pattern"`
+	Action  string    `json:"action"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// normalizePattern validates a DomainPolicy pattern and returns it in
+// lower case ASCII.
+func normalizePattern(pattern string) (string, error) {
+	name, wildcard := strings.CutPrefix(strings.TrimSuffix(pattern, "."), "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return "", fmt.Errorf("invalid domain pattern %q", pattern)
+	}
+	name, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain pattern %q: %v", pattern, err)
+	}
+	if wildcard {
+		return "*." + name, nil
+	}
+	return name, nil
+}
+
+// SetDomainPolicy allows or denies on-demand TLS for the domains matching
+// pattern, replacing the action previously set for it.
+func (s *SqliteStorage) SetDomainPolicy(ctx context.Context, pattern, action string) error {
+	if action != PolicyAllow && action != PolicyDeny {
+		return fmt.Errorf("unknown action %q, expected %s or %s", action, PolicyAllow, PolicyDeny)
+	}
+	pattern, err := normalizePattern(pattern)
+	if err != nil {
+		return err
+	}
+	return s.setDomainPolicy(ctx, pattern, action, time.Now())
+}
+
+// setDomainPolicy sets the action of the normalized pattern, created at
+// created.
+func (s *SqliteStorage) setDomainPolicy(ctx context.Context, pattern, action string, created time.Time) error {
+	return s.retryWrite(ctx, "set_domain_policy", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		_, err := s.exec(ctx, s.writeDB(), `INSERT INTO certmagic_domain_policies (key_hash, pattern, action, created) VALUES (?, ?, ?, ?)
+	ON CONFLICT(key_hash) DO UPDATE SET action = ?, created = ?`, nil,
+			nameHash(pattern), pattern, action, created,
+			action, created)
+		return err
+	})
+}
+
+// DeleteDomainPolicy removes the action set for pattern, or returns
+// fs.ErrNotExist if there is none.
+func (s *SqliteStorage) DeleteDomainPolicy(ctx context.Context, pattern string) error {
+	pattern, err := normalizePattern(pattern)
+	if err != nil {
+		return err
+	}
+	return s.deleteDomainPolicy(ctx, pattern, time.Time{})
+}
+
+// deleteDomainPolicy removes the action of the normalized pattern. Unless
+// deleted is zero, the change feed records the deletion at deleted, like
+// deleteAt does for keys.
+func (s *SqliteStorage) deleteDomainPolicy(ctx context.Context, pattern string, deleted time.Time) error {
+	return s.retryWrite(ctx, "delete_domain_policy", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		tx, err := s.writeDB().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := s.exec(ctx, tx, "DELETE FROM certmagic_domain_policies WHERE key_hash = ?", nil, nameHash(pattern))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fs.ErrNotExist
+		}
+		if !deleted.IsZero() && s.dialect == dialects[Sqlite] {
+			_, err := s.exec(ctx, tx, "UPDATE certmagic_changes SET deleted_at = ? WHERE key = ? AND deleted_at IS NOT NULL", nil,
+				deleted.UTC().Format(deletedAtLayout), domainPolicyFeedPrefix+pattern)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// domainPolicy returns the action of the normalized pattern and when it
+// was set, or sql.ErrNoRows if there is none.
+func (s *SqliteStorage) domainPolicy(ctx context.Context, q queryer, pattern string) (string, time.Time, error) {
+	var action string
+	var created sql.NullTime
+	err := s.queryRow(ctx, q, "SELECT action, created FROM certmagic_domain_policies WHERE key_hash = ?", nil, nameHash(pattern)).Scan(&action, &created)
+	return action, created.Time, err
+}
+
+// DomainPolicies returns every pattern with its action, by pattern.
+func (s *SqliteStorage) DomainPolicies(ctx context.Context) ([]DomainPolicy, error) {
+	var policies []DomainPolicy
+	err := s.retry(ctx, "domain_policies", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		rows, err := s.query(ctx, s.readDB(), "SELECT pattern, action, created FROM certmagic_domain_policies ORDER BY pattern", nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		policies = policies[:0]
+		for rows.Next() {
+			var p DomainPolicy
+			var created sql.NullTime
+			if err := rows.Scan(&p.Pattern, &p.Action, &created); err != nil {
+				return err
+			}
+			p.Created = created.Time
+			policies = append(policies, p)
+		}
+		return rows.Err()
+	})
+	return policies, err
+}
+
+// DomainAllowed reports whether on-demand TLS may obtain a certificate for
+// domain: some pattern allows it and none denies it. The domain itself and
+// the wildcards of its parents are the patterns that can match it.
+func (s *SqliteStorage) DomainAllowed(ctx context.Context, domain string) (bool, error) {
+	allowed, denied, err := s.domainPolicies(ctx, domain)
+	return allowed && !denied, err
+}
+
+// domainPolicies reports whether any of the patterns matching domain
+// allows it, and whether any denies it.
+func (s *SqliteStorage) domainPolicies(ctx context.Context, domain string) (allowed, denied bool, err error) {
+	name, err := normalizePattern(domain)
+	if err != nil || strings.HasPrefix(name, "*.") {
+		return false, false, errors.New("invalid domain")
+	}
+	hashes := []any{nameHash(name)}
+	labels := strings.Split(name, ".")
+	for i := 1; i < len(labels); i++ {
+		hashes = append(hashes, nameHash("*."+strings.Join(labels[i:], ".")))
+	}
+	err = s.retry(ctx, "domain_allowed", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		rows, err := s.query(ctx, s.readDB(), "SELECT action FROM certmagic_domain_policies WHERE key_hash IN (?"+strings.Repeat(", ?", len(hashes)-1)+")", nil, hashes...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		allowed, denied = false, false
+		for rows.Next() {
+			var action string
+			if err := rows.Scan(&action); err != nil {
+				return err
+			}
+			allowed = allowed || action == PolicyAllow
+			denied = denied || action == PolicyDeny
+		}
+		return rows.Err()
+	})
+	return allowed, denied, err
+}
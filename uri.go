@@ -0,0 +1,111 @@
+package storagesqlite
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// builtinVFS lists the VFS implementations compiled into the sqlite
+// driver, by operating system. Opening a database with any other fails
+// with a misleading out of memory error.
+var builtinVFS = map[string][]string{
+	"windows": {"win32", "win32-longpath", "win32-none", "win32-longpath-none"},
+	"":        {"unix", "unix-dotfile", "unix-excl", "unix-none"},
+}
+
+// lockingVFS reports whether vfs locks the database file, which exclusive
+// relies on.
+func lockingVFS(vfs string) bool {
+	return !strings.HasSuffix(vfs, "-none")
+}
+
+// uriParams are the parameters of a sqlite file: URI the storage acts on:
+// the VFS opening the file, and whether the file is opened read-only.
+type uriParams struct {
+	vfs       string
+	mode      string
+	immutable bool
+}
+
+// parseURI returns the parameters of a sqlite DSN. Plain file names have
+// none.
+func parseURI(dsn string) (uriParams, error) {
+	if !strings.HasPrefix(dsn, "file:") {
+		return uriParams{}, nil
+	}
+	_, query, err := splitDSN(dsn)
+	if err != nil {
+		return uriParams{}, err
+	}
+	p := uriParams{vfs: query.Get("vfs"), mode: query.Get("mode")}
+	if v := query.Get("immutable"); v != "" {
+		if p.immutable, err = strconv.ParseBool(v); err != nil {
+			return uriParams{}, fmt.Errorf("invalid immutable=%s, expected 0 or 1", v)
+		}
+	}
+	return p, nil
+}
+
+// readOnly reports whether the URI opens the database read-only: mode=ro
+// for a replica that another process keeps updating, immutable=1 only for
+// a snapshot that never changes, since sqlite then skips locking and
+// change detection and may read stale or corrupt data after an update.
+func (p uriParams) readOnly() bool {
+	return p.mode == "ro" || p.immutable
+}
+
+// validateURI checks the parameters of the dsn of a sqlite database and
+// the options they can't be combined with.
+func (s SqliteStorage) validateURI() error {
+	p, err := parseURI(s.Dsn)
+	if err != nil {
+		return err
+	}
+	if p.vfs != "" {
+		available, ok := builtinVFS[runtime.GOOS]
+		if !ok {
+			available = builtinVFS[""]
+		}
+		if !slices.Contains(available, p.vfs) {
+			return fmt.Errorf("unknown vfs %q, expected one of %s", p.vfs, strings.Join(available, ", "))
+		}
+		if s.Exclusive && !lockingVFS(p.vfs) {
+			return fmt.Errorf("vfs %s takes no locks, which exclusive relies on", p.vfs)
+		}
+	}
+	switch p.mode {
+	case "", "ro", "rw", "rwc":
+	case "memory":
+		if p.immutable {
+			return fmt.Errorf("immutable=1 can't be combined with mode=memory")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected ro, rw, rwc or memory", p.mode)
+	}
+	if p.immutable && p.mode != "" && p.mode != "ro" {
+		return fmt.Errorf("immutable=1 opens the database read-only and can't be combined with mode=%s", p.mode)
+	}
+	if !p.readOnly() {
+		return nil
+	}
+	for _, o := range []struct {
+		option string
+		set    bool
+	}{
+		{"exclusive", s.Exclusive},
+		{"compaction", s.Compaction != nil},
+		{"max_wal_size", s.MaxWALSize > 0},
+		{"auto_import", s.AutoImport},
+		{"sync_peers", len(s.SyncPeers) > 0},
+		{"replication", s.Replication != nil},
+		{"read_only_fallback", s.ReadOnlyFallback != nil},
+	} {
+		if o.set {
+			return fmt.Errorf("%s writes to the database, which the dsn opens read-only", o.option)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package storagesqlite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// vaultRetryInterval is how long to wait before trying again after Vault
+// could not be reached.
+const vaultRetryInterval = 10 * time.Second
+
+// vaultTimeout bounds the requests to Vault.
+const vaultTimeout = 30 * time.Second
+
+// VaultConfig reads the credentials of the database from a HashiCorp Vault
+// secret, such as the dynamic credentials of its database secrets engine.
+// The fields of the secret replace {vault.<field>} placeholders in the dsn,
+// for example postgres://{vault.username}:{vault.password}@db/caddy, and
+// are escaped in URL dsns.
+// Leased credentials are renewed before they expire, and replaced by new
+// ones, reconnecting the database, once they can't be renewed anymore.
+type VaultConfig struct {
+	// Address of the Vault server, such as https://vault:8200.
+	Address string `json:"address,omitempty"`
+	// Vault token, or file:<path> or env:<name> to read it from a file or
+	// environment variable.
+	Token string `json:"token,omitempty"`
+	// Path of the secret, such as database/creds/caddy. The fields of KV
+	// version 2 secrets are read from their data.
+	Path string `json:"path,omitempty"`
+}
+
+// vaultSecret is the part of a Vault read or renewal response used here.
+type vaultSecret struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int64          `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+}
+
+// vaultCredentials holds the secret read from Vault and its lease.
+type vaultCredentials struct {
+	config *VaultConfig
+
+	mu      sync.Mutex
+	fields  map[string]string
+	leaseID string
+	lease   time.Duration
+}
+
+// request sends a request to the Vault API and decodes its response.
+func (v *vaultCredentials) request(ctx context.Context, method, path string, body any) (vaultSecret, error) {
+	ctx, cancel := context.WithTimeout(ctx, vaultTimeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return vaultSecret{}, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.config.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.config.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return vaultSecret{}, fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return vaultSecret{}, fmt.Errorf("decoding vault response: %v", err)
+	}
+	return secret, nil
+}
+
+// read reads the secret, replacing the credentials and lease.
+func (v *vaultCredentials) read(ctx context.Context) error {
+	secret, err := v.request(ctx, http.MethodGet, v.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	fields := make(map[string]string, len(data))
+	for name, value := range data {
+		fields[name] = fmt.Sprint(value)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fields = fields
+	v.leaseID, v.lease = "", 0
+	if secret.Renewable {
+		v.leaseID, v.lease = secret.LeaseID, time.Duration(secret.LeaseDuration)*time.Second
+	}
+	return nil
+}
+
+// renew extends the lease, and reports false if it can't be extended for
+// at least half of its previous duration, as the maximum TTL nears.
+func (v *vaultCredentials) renew(ctx context.Context) (bool, error) {
+	leaseID, lease := v.currentLease()
+	secret, err := v.request(ctx, http.MethodPut, "sys/leases/renew", map[string]any{
+		"lease_id":  leaseID,
+		"increment": int64(lease / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+	renewed := time.Duration(secret.LeaseDuration) * time.Second
+	if renewed < lease/2 {
+		return false, nil
+	}
+	v.mu.Lock()
+	v.lease = renewed
+	v.mu.Unlock()
+	return true, nil
+}
+
+func (v *vaultCredentials) currentLease() (string, time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.leaseID, v.lease
+}
+
+// expand replaces the {vault.<field>} placeholders of dsn. The values
+// are escaped in URLs, as credentials may contain characters such as @, /
+// or &.
+func (v *vaultCredentials) expand(dsn string) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	escape := strings.Contains(dsn, "://") || strings.HasPrefix(dsn, "file:")
+	pairs := make([]string, 0, 2*len(v.fields))
+	for name, value := range v.fields {
+		if escape {
+			value = strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+		}
+		pairs = append(pairs, "{vault."+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(dsn)
+}
+
+// connectionString returns the dsn to open the database with, with the
+// current credentials from Vault.
+func (s *SqliteStorage) connectionString() string {
+	dsn := s.Dsn
+	if s.vault != nil {
+		dsn = s.vault.expand(dsn)
+	}
+	if s.dialect != dialects[Sqlite] {
+		return dsn
+	}
+	dsn = windowsDSN(dsn)
+	if s.Exclusive {
+		dsn = exclusiveDSN(dsn)
+	}
+	return dsn
+}
+
+// runVault renews the lease of the credentials when two thirds of it have
+// passed, and replaces the credentials once it can't be renewed.
+func (s *SqliteStorage) runVault(ctx context.Context) {
+	log := caddy.Log().Named(logStorage)
+	for {
+		leaseID, lease := s.vault.currentLease()
+		if leaseID == "" {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lease * 2 / 3):
+		}
+
+		renewed, err := s.vault.renew(ctx)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if renewed {
+			continue
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("renewing the vault lease of %s: %v", s.Dsn, err))
+		}
+		for {
+			err := s.rotateVault(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error(fmt.Sprintf("replacing the vault credentials of %s: %v", s.Dsn, err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(vaultRetryInterval):
+			}
+		}
+		log.Info(fmt.Sprintf("reconnected %s with new vault credentials", s.Dsn))
+	}
+}
+
+// rotateVault reads new credentials and reconnects the database with them.
+// reopen closes the old handles only once the operations using them have
+// finished, see replaceHandles.
+func (s *SqliteStorage) rotateVault(ctx context.Context) error {
+	if err := s.vault.read(ctx); err != nil {
+		return err
+	}
+	return s.reopen()
+}
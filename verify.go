@@ -0,0 +1,130 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Difference describes a key whose state differs between two storages.
+type Difference struct {
+	Key    string
+	Reason string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: %s", d.Key, d.Reason)
+}
+
+// verifyAgainstDir compares the database with the file_system storage
+// rooted at dir. Lock files are ignored.
+func (s *SqliteStorage) verifyAgainstDir(ctx context.Context, dir string) ([]Difference, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, "locks/") {
+			return nil
+		}
+		files[key] = path
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.keysWithPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []Difference
+	for _, key := range keys {
+		path, ok := files[key]
+		if !ok {
+			diffs = append(diffs, Difference{Key: key, Reason: "missing from " + dir})
+			continue
+		}
+		delete(files, key)
+
+		value, err := s.Load(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		fileValue, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(value) != len(fileValue) {
+			diffs = append(diffs, Difference{Key: key, Reason: fmt.Sprintf("size %d differs from file size %d", len(value), len(fileValue))})
+		} else if valueChecksum(value) != valueChecksum(fileValue) {
+			diffs = append(diffs, Difference{Key: key, Reason: "content differs"})
+		}
+	}
+	for key := range files {
+		diffs = append(diffs, Difference{Key: key, Reason: "missing from database"})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// diffStorages compares the contents of two databases, reporting keys
+// present in only one of them and keys whose values or modification times
+// differ.
+func diffStorages(ctx context.Context, a, b *SqliteStorage) ([]Difference, error) {
+	aKeys, err := a.keysWithPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	bKeys, err := b.keysWithPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	inB := make(map[string]bool, len(bKeys))
+	for _, key := range bKeys {
+		inB[key] = true
+	}
+
+	var diffs []Difference
+	for _, key := range aKeys {
+		if !inB[key] {
+			diffs = append(diffs, Difference{Key: key, Reason: "only in " + a.Dsn})
+			continue
+		}
+		delete(inB, key)
+
+		aValue, aInfo, err := a.LoadWithInfo(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		bValue, bInfo, err := b.LoadWithInfo(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if valueChecksum(aValue) != valueChecksum(bValue) {
+			diffs = append(diffs, Difference{Key: key, Reason: "values differ"})
+			continue
+		}
+		if !aInfo.Modified.Equal(bInfo.Modified) {
+			diffs = append(diffs, Difference{Key: key, Reason: fmt.Sprintf("modified %s differs from %s", aInfo.Modified, bInfo.Modified)})
+		}
+	}
+	for key := range inB {
+		diffs = append(diffs, Difference{Key: key, Reason: "only in " + b.Dsn})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
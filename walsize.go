@@ -0,0 +1,51 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// wrote checks the size of the WAL after a write, in the background.
+func (s *SqliteStorage) wrote() {
+	if s.walKick != nil {
+		wakeJob(s.walKick)
+	}
+}
+
+// walLimitJob checkpoints the WAL whenever a write left it larger than
+// max_wal_size. Automatic checkpoints don't shrink the file, and can't
+// keep up while readers hold on to old snapshots during write bursts. It
+// returns 1 if it checkpointed.
+func (s *SqliteStorage) walLimitJob(ctx context.Context) (int64, error) {
+	wal := dbFilePath(s.Dsn) + "-wal"
+	size := fileSize(wal)
+	if size <= int64(s.MaxWALSize) {
+		return 0, nil
+	}
+	busy, err := s.forceCheckpoint(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("checkpointing the WAL of %d bytes: %v", size, err)
+	}
+	sqliteMetrics.walCheckpoints.Inc()
+	if busy {
+		caddy.Log().Named(logMaintenance).Warn(fmt.Sprintf("WAL of %d bytes exceeds max_wal_size %d, readers kept it from being checkpointed fully", size, s.MaxWALSize))
+		return 1, nil
+	}
+	caddy.Log().Named(logMaintenance).Info(fmt.Sprintf("WAL of %d bytes exceeded max_wal_size %d, checkpointed it to %d bytes", size, s.MaxWALSize, fileSize(wal)))
+	return 1, nil
+}
+
+// forceCheckpoint checkpoints and truncates the WAL, it reports whether
+// readers kept it from completing.
+func (s *SqliteStorage) forceCheckpoint(ctx context.Context) (bool, error) {
+	var busy, pages, checkpointed int
+	err := s.retryWrite(ctx, MaintenanceCheckpoint, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout*time.Second)
+		defer cancel()
+		return s.queryRow(ctx, s.writeDB(), "PRAGMA wal_checkpoint(TRUNCATE)", nil).Scan(&busy, &pages, &checkpointed)
+	})
+	return busy != 0, err
+}
@@ -0,0 +1,84 @@
+package storagesqlite
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// maxPath is the length from which the default win32 VFS fails to open a
+// path, MAX_PATH.
+const maxPath = 260
+
+// isWindowsPath reports whether dsn is a bare path starting with a drive
+// letter or a UNC share, which only exist on Windows.
+func isWindowsPath(dsn string) bool {
+	return runtime.GOOS == "windows" && !strings.HasPrefix(dsn, "file:") && filepath.VolumeName(dsn) != ""
+}
+
+// windowsURI turns a Windows path into the path and query of the
+// equivalent file: URI: forward slashes, a slash before the drive letter
+// and two before a UNC share. Paths with the \\?\ prefix, which a URI can't
+// carry, and paths longer than MAX_PATH are opened with the
+// win32-longpath VFS instead.
+func windowsURI(path string) (string, url.Values) {
+	query := url.Values{}
+	long := len(path) >= maxPath
+	switch {
+	case strings.HasPrefix(path, `\\?\UNC\`):
+		path, long = `\\`+strings.TrimPrefix(path, `\\?\UNC\`), true
+	case strings.HasPrefix(path, `\\?\`):
+		path, long = strings.TrimPrefix(path, `\\?\`), true
+	}
+	if long {
+		query.Set("vfs", "win32-longpath")
+	}
+	path = strings.ReplaceAll(escapeURIPath(path), `\`, "/")
+	if strings.HasPrefix(path, "//") {
+		return "//" + path, query
+	}
+	return "///" + path, query
+}
+
+// windowsDSN turns a bare Windows path into a file: URI, so that sqlite
+// opens long paths and the read-only connections open the same file. Other
+// DSNs are returned unchanged.
+func windowsDSN(dsn string) string {
+	if !isWindowsPath(dsn) {
+		return dsn
+	}
+	path, query := windowsURI(dsn)
+	if len(query) == 0 {
+		return "file:" + path
+	}
+	return "file:" + path + "?" + query.Encode()
+}
+
+// uriFilePath turns the unescaped path of a file: URI into a file path,
+// without the slash before the drive letter on Windows.
+func uriFilePath(path string) string {
+	if runtime.GOOS != "windows" {
+		return path
+	}
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// createDBDir creates the missing directory of the database file at path,
+// accessible only to the user running Caddy.
+func createDBDir(path string) error {
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return restrictDir(dir)
+}
@@ -0,0 +1,96 @@
+package storagesqlite
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// writeQueue hands the single sqlite writer connection to one write at a
+// time. Writes wait in the queue instead of in the database/sql pool, so
+// that their number can be reported and the wait bounded.
+type writeQueue struct {
+	slot chan struct{}
+	// writes finished, so that a rebuild can tell whether the database
+	// changed since it took its snapshot.
+	done atomic.Int64
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{slot: make(chan struct{}, 1)}
+}
+
+// do runs fn once it is the only write in progress. Waiting for the
+// writer is bounded by timeout, write_wait_timeout, separately from the
+// query timeout that bounds fn itself.
+func (q *writeQueue) do(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	sqliteMetrics.writeQueue.Inc()
+	defer sqliteMetrics.writeQueue.Dec()
+
+	release, err := q.hold(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer q.done.Add(1)
+	return fn(ctx)
+}
+
+// hold waits up to timeout for the writer and returns the function
+// releasing it.
+func (q *writeQueue) hold(ctx context.Context, timeout time.Duration) (release func(), err error) {
+	wait, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case q.slot <- struct{}{}:
+		return func() { <-q.slot }, nil
+	case <-wait.Done():
+		return nil, fmt.Errorf("waiting for the writer: %w", wait.Err())
+	}
+}
+
+// retryWrite is retry for operations writing to the database. With a
+// separate read pool, every attempt waits for the single writer
+// connection; other dialects and in-memory databases run fn directly.
+// Writes fail with ErrReadOnly while the storage is degraded to read-only,
+// and always if the dsn opens the database read-only.
+func (s *SqliteStorage) retryWrite(ctx context.Context, operation string, fn func(context.Context) error) error {
+	if s.readOnly {
+		return &OpError{Op: operation, Err: fmt.Errorf("database is opened read-only: %w", ErrReadOnly)}
+	}
+	if !s.readOnlySince().IsZero() {
+		return &OpError{Op: operation, Err: fmt.Errorf("storage is degraded: %w", ErrReadOnly)}
+	}
+	err := s.runWrite(ctx, operation, fn)
+	s.noteWrite(err)
+	if err == nil {
+		s.wrote()
+	}
+	if err == nil && changeOps[operation] {
+		s.notifyFollowers()
+	}
+	return err
+}
+
+// runWrite runs the write fn with retries on the writer connection.
+func (s *SqliteStorage) runWrite(ctx context.Context, operation string, fn func(context.Context) error) error {
+	if s.writes == nil {
+		return s.retry(ctx, operation, fn)
+	}
+	return s.retry(ctx, operation, func(ctx context.Context) error {
+		// The write doesn't use the handles until it has the writer, so
+		// replacing them doesn't wait for it.
+		s.drain.park()
+		parked := true
+		err := s.writes.do(ctx, time.Duration(s.WriteWaitTimeout), func(ctx context.Context) error {
+			s.drain.unpark()
+			parked = false
+			return fn(ctx)
+		})
+		if parked {
+			s.drain.unpark()
+		}
+		return err
+	})
+}